@@ -0,0 +1,285 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+)
+
+// Record is a single request to the LLM back-end
+type Record struct {
+	Time      time.Time  `json:"time"`
+	Task      string     `json:"task"`
+	ChatID    int64      `json:"chat_id,omitempty"`
+	Endpoint  string     `json:"endpoint"`
+	Model     string     `json:"model"`
+	Stream    bool       `json:"stream,omitempty"`
+	Messages  []Message  `json:"messages"`
+	Params    Params     `json:"params"`
+	Response  string     `json:"response,omitempty"`
+	Reasoning string     `json:"reasoning,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Truncated bool       `json:"truncated,omitempty"`
+	Usage     *Usage     `json:"usage,omitempty"`
+	LatencyMs int64      `json:"latency_ms"`
+	Error     string     `json:"error,omitempty"`
+	// Names are names of the users and the chat which are redacted in the texts like usernames
+	Names []string `json:"-"`
+}
+
+// Message is a message of the request. Images are counted but not saved.
+type Message struct {
+	Role       string     `json:"role"`
+	Name       string     `json:"name,omitempty"`
+	Content    string     `json:"content"`
+	Images     int        `json:"images,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type ToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Params contains generation parameters of the request. Zero values are not sent to the back-end.
+type Params struct {
+	Temperature      float32  `json:"temperature,omitempty"`
+	TopP             float32  `json:"top_p,omitempty"`
+	MaxTokens        int      `json:"max_tokens,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
+	Tools            []string `json:"tools,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost,omitempty"`
+}
+
+// Telegram usernames are 5-32 characters long
+var usernamePattern = regexp.MustCompile(`@[A-Za-z0-9_]{5,32}`)
+
+// Logger writes records to a JSONL file. The file is rotated when it exceeds the size limit: "audit.jsonl" becomes
+// "audit.jsonl.1", the previous "audit.jsonl.1" becomes "audit.jsonl.2" and so on.
+type Logger struct {
+	mu   sync.Mutex
+	cfg  config.AuditConfig
+	file *os.File
+	size int64
+}
+
+func NewLogger(cfg config.AuditConfig) (*Logger, error) {
+	l := &Logger{cfg: cfg}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+
+	return nil
+}
+
+// Write saves the record applying the redaction and size limits
+func (l *Logger) Write(record Record) error {
+	l.prepare(&record)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return os.ErrClosed
+	}
+
+	if l.size > 0 && l.cfg.MaxFileSize > 0 && l.size+int64(len(data)) > l.cfg.MaxFileSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+
+	return err
+}
+
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	if l.cfg.MaxFiles <= 0 {
+		if err := os.Remove(l.cfg.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return l.open()
+	}
+
+	_ = os.Remove(rotatedPath(l.cfg.Path, l.cfg.MaxFiles))
+	for i := l.cfg.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedPath(l.cfg.Path, i), rotatedPath(l.cfg.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.cfg.Path, rotatedPath(l.cfg.Path, 1)); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+func rotatedPath(path string, index int) string {
+	return path + "." + strconv.Itoa(index)
+}
+
+// prepare redacts and crops the texts of the record
+func (l *Logger) prepare(record *Record) {
+	names := namesReplacer(record.Names)
+
+	for i := range record.Messages {
+		msg := &record.Messages[i]
+		// The main system prompt is written by the bot owner while the rest of messages contain chat data
+		keepText := i == 0 && msg.Role == "system"
+
+		if msg.Role == "user" {
+			msg.Name = l.redactName(msg.Name)
+		}
+		if !keepText {
+			msg.Content = l.text(msg.Content, names)
+		} else if l.cfg.RedactUsernames || l.cfg.RedactText {
+			// The prompt contains the request context with names of the user and the chat
+			msg.Content = l.crop(redactNames(msg.Content, names))
+		} else {
+			msg.Content = l.crop(msg.Content)
+		}
+		for j := range msg.ToolCalls {
+			msg.ToolCalls[j].Arguments = l.text(msg.ToolCalls[j].Arguments, names)
+		}
+	}
+
+	record.Response = l.text(record.Response, names)
+	record.Reasoning = l.text(record.Reasoning, names)
+	for i := range record.ToolCalls {
+		record.ToolCalls[i].Arguments = l.text(record.ToolCalls[i].Arguments, names)
+	}
+}
+
+func (l *Logger) text(text string, names *strings.Replacer) string {
+	if l.cfg.RedactText && text != "" {
+		return fmt.Sprintf("[redacted %d chars]", len([]rune(text)))
+	}
+	if l.cfg.RedactUsernames {
+		text = redactNames(text, names)
+	}
+
+	return l.crop(text)
+}
+
+func (l *Logger) crop(text string) string {
+	if l.cfg.MaxContentLength <= 0 {
+		return text
+	}
+	if runes := []rune(text); len(runes) > l.cfg.MaxContentLength {
+		return string(runes[:l.cfg.MaxContentLength]) + "…"
+	}
+
+	return text
+}
+
+// redactNames replaces usernames and the provided names with pseudonyms
+func redactNames(text string, names *strings.Replacer) string {
+	text = usernamePattern.ReplaceAllStringFunc(text, func(username string) string {
+		return "@" + pseudonym(username[1:])
+	})
+
+	return names.Replace(text)
+}
+
+// namesReplacer replaces the names with pseudonyms preferring longer ones, so "John Smith" isn't split into two
+// pseudonyms. Single characters are kept, since they aren't identifying while replacing them breaks the text.
+func namesReplacer(names []string) *strings.Replacer {
+	names = slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+		return len([]rune(strings.TrimSpace(name))) < 2
+	})
+	slices.SortFunc(names, func(a, b string) int {
+		if diff := len(b) - len(a); diff != 0 {
+			return diff
+		}
+
+		return strings.Compare(a, b)
+	})
+
+	pairs := make([]string, 0, len(names)*2)
+	for _, name := range slices.Compact(names) {
+		pairs = append(pairs, name, pseudonym(name))
+	}
+
+	return strings.NewReplacer(pairs...)
+}
+
+func (l *Logger) redactName(name string) string {
+	if !l.cfg.RedactUsernames || name == "" {
+		return name
+	}
+
+	return pseudonym(name)
+}
+
+// pseudonym is the same for the same username, so the conversation can still be followed
+func pseudonym(username string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(username)))
+
+	return "user_" + hex.EncodeToString(hash[:])[:8]
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+)
+
+func TestLogger_RotatesFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewLogger(config.AuditConfig{Path: path, MaxFileSize: 300, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		err := l.Write(Record{
+			Time:     time.Now(),
+			Task:     "chat",
+			ChatID:   int64(i + 1),
+			Messages: []Message{{Role: "user", Content: strings.Repeat("x", 100)}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 rotated files, got error %v", err)
+	}
+	for _, file := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Size() > 300 {
+			t.Fatalf("file %s is bigger than the limit: %d", file, info.Size())
+		}
+	}
+
+	records, err := ReadRecords(path, Filter{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) < 2 || records[len(records)-1].ChatID != 10 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].ChatID != records[i-1].ChatID+1 {
+			t.Fatalf("records are out of order: %d after %d", records[i].ChatID, records[i-1].ChatID)
+		}
+	}
+
+	records, err = ReadRecords(path, Filter{ChatID: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record for the chat, got %d", len(records))
+	}
+}
+
+func TestLogger_Redacts(t *testing.T) {
+	l := &Logger{cfg: config.AuditConfig{RedactUsernames: true, MaxContentLength: 40}}
+
+	record := Record{
+		Messages: []Message{
+			{Role: "system", Content: "Username: @someone_else."},
+			{Role: "user", Content: "Alex (@SomeOne_Else): " + strings.Repeat("long ", 20)},
+		},
+		Response: "Hi @someone_else",
+	}
+	l.prepare(&record)
+
+	alias := "@" + pseudonym("someone_else")
+	if record.Messages[0].Content != "Username: "+alias+"." {
+		t.Fatalf("unexpected system prompt: %q", record.Messages[0].Content)
+	}
+	if !strings.HasPrefix(record.Messages[1].Content, "Alex ("+alias+"): ") || !strings.HasSuffix(record.Messages[1].Content, "…") {
+		t.Fatalf("unexpected message: %q", record.Messages[1].Content)
+	}
+	if record.Response != "Hi "+alias {
+		t.Fatalf("unexpected response: %q", record.Response)
+	}
+
+	l.cfg.RedactText = true
+	record = Record{
+		Messages: []Message{
+			{Role: "system", Content: "You're a bot"},
+			{Role: "system", Content: "[Earlier conversation summary: secret]"},
+			{Role: "user", Content: "secret"},
+		},
+		Response: "answer",
+	}
+	l.prepare(&record)
+
+	if record.Messages[0].Content != "You're a bot" {
+		t.Fatalf("main system prompt must be kept, got %q", record.Messages[0].Content)
+	}
+	if record.Messages[1].Content != "[redacted 38 chars]" || record.Messages[2].Content != "[redacted 6 chars]" {
+		t.Fatalf("unexpected redacted messages: %+v", record.Messages)
+	}
+	if record.Response != "[redacted 6 chars]" {
+		t.Fatalf("unexpected redacted response: %q", record.Response)
+	}
+}
+
+func TestLogger_RedactsNamesOfUsersAndChat(t *testing.T) {
+	newRecord := func() Record {
+		return Record{
+			Messages: []Message{
+				{Role: "system", Content: "You're a bot. Chat is called \"Secret Club\". First name: \"Alexandra\"\nUsername: @alexandra_k."},
+				{Role: "user", Content: "Alexandra (@alexandra_k): hi\nBoris: hello"},
+			},
+			Response: "Hi Alexandra and Boris!",
+			Names:    []string{"Alexandra", "", "Secret Club", "Boris", "Alexandra", "B"},
+		}
+	}
+
+	for _, cfg := range []config.AuditConfig{{RedactText: true}, {RedactUsernames: true}} {
+		l := &Logger{cfg: cfg}
+		record := newRecord()
+		l.prepare(&record)
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, secret := range []string{"Alexandra", "alexandra_k", "Secret Club", "Boris"} {
+			if strings.Contains(string(data), secret) {
+				t.Fatalf("%+v: %q must be redacted, got %s", cfg, secret, data)
+			}
+		}
+		if !strings.HasPrefix(record.Messages[0].Content, "You're a bot. Chat is called \""+pseudonym("Secret Club")+"\"") {
+			t.Fatalf("%+v: the system prompt must be kept, got %q", cfg, record.Messages[0].Content)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Texts are cropped to this length when printed without the -full flag
+const shortTextLength = 300
+
+var ErrNoLogPath = errors.New("audit log path is not set")
+
+// Filter selects the records to print
+type Filter struct {
+	Task       string
+	ChatID     int64
+	Model      string
+	OnlyErrors bool
+	Since      time.Time
+}
+
+func (f Filter) Match(record Record) bool {
+	switch {
+	case f.Task != "" && record.Task != f.Task:
+		return false
+	case f.ChatID != 0 && record.ChatID != f.ChatID:
+		return false
+	case f.Model != "" && !strings.Contains(record.Model, f.Model):
+		return false
+	case f.OnlyErrors && record.Error == "":
+		return false
+	case !f.Since.IsZero() && record.Time.Before(f.Since):
+		return false
+	default:
+		return true
+	}
+}
+
+// RunCommand implements the "audit" command which pretty-prints or filters the audit log including its rotated files
+func RunCommand(args []string, defaultPath string, out io.Writer) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.SetOutput(out)
+
+	path := flags.String("file", defaultPath, "audit log file")
+	task := flags.String("task", "", "show only records of the task: chat, summarize, image_recognition, history_summary, embeddings")
+	chatID := flags.Int64("chat", 0, "show only records of the chat")
+	model := flags.String("model", "", "show only records of models containing the text")
+	onlyErrors := flags.Bool("errors", false, "show only failed requests")
+	since := flags.Duration("since", 0, "show only records newer than the duration, e.g. 2h")
+	limit := flags.Int("limit", 0, "show only the last N matching records")
+	asJson := flags.Bool("json", false, "print matching records as JSONL instead of the human readable form")
+	full := flags.Bool("full", false, "don't crop long texts")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return ErrNoLogPath
+	}
+
+	filter := Filter{Task: *task, ChatID: *chatID, Model: *model, OnlyErrors: *onlyErrors}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+
+	records, err := ReadRecords(*path, filter)
+	if err != nil {
+		return err
+	}
+	if *limit > 0 && len(records) > *limit {
+		records = records[len(records)-*limit:]
+	}
+
+	for _, record := range records {
+		if *asJson {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(out, string(data)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if _, err := io.WriteString(out, FormatRecord(record, *full)+"\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadRecords reads the matching records from the log and its rotated files from the oldest to the newest.
+// Malformed lines, e.g. the one cut by a crash, are skipped.
+func ReadRecords(path string, filter Filter) ([]Record, error) {
+	var records []Record
+	for _, file := range logFiles(path) {
+		fileRecords, err := readFile(file, filter)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, fileRecords...)
+	}
+
+	return records, nil
+}
+
+// logFiles lists the rotated files from the oldest to the newest and then the current one
+func logFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+
+	type rotated struct {
+		path  string
+		index int
+	}
+	var files []rotated
+	for _, match := range matches {
+		if index, err := strconv.Atoi(strings.TrimPrefix(match, path+".")); err == nil {
+			files = append(files, rotated{path: match, index: index})
+		}
+	}
+	slices.SortFunc(files, func(a, b rotated) int {
+		return b.index - a.index
+	})
+
+	result := make([]string, 0, len(files)+1)
+	for _, file := range files {
+		result = append(result, file.path)
+	}
+
+	return append(result, path)
+}
+
+func readFile(path string, filter Filter) ([]Record, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record Record
+			if json.Unmarshal(line, &record) == nil && filter.Match(record) {
+				records = append(records, record)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// FormatRecord presents the record in a human readable form
+func FormatRecord(record Record, full bool) string {
+	short := func(text string) string {
+		if runes := []rune(text); !full && len(runes) > shortTextLength {
+			return string(runes[:shortTextLength]) + "…"
+		}
+
+		return text
+	}
+	indent := func(text string) string {
+		return strings.ReplaceAll(short(text), "\n", "\n    ")
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s model=%s@%s latency=%dms",
+		record.Time.Local().Format("2006-01-02 15:04:05"), record.Task, record.Model, record.Endpoint, record.LatencyMs)
+	if record.ChatID != 0 {
+		fmt.Fprintf(&sb, " chat=%d", record.ChatID)
+	}
+	if record.Stream {
+		sb.WriteString(" stream")
+	}
+	if record.Usage != nil {
+		fmt.Fprintf(&sb, " tokens=%d+%d", record.Usage.PromptTokens, record.Usage.CompletionTokens)
+		if record.Usage.Cost > 0 {
+			fmt.Fprintf(&sb, " cost=%.6f", record.Usage.Cost)
+		}
+	}
+	if record.Truncated {
+		sb.WriteString(" truncated")
+	}
+	sb.WriteString("\n")
+
+	if params, err := json.Marshal(record.Params); err == nil && string(params) != "{}" {
+		fmt.Fprintf(&sb, "  params: %s\n", params)
+	}
+
+	for _, msg := range record.Messages {
+		role := msg.Role
+		if msg.Name != "" {
+			role += " " + msg.Name
+		}
+		if msg.Images > 0 {
+			role += fmt.Sprintf(" +%d images", msg.Images)
+		}
+		fmt.Fprintf(&sb, "  [%s] %s\n", role, indent(msg.Content))
+		for _, call := range msg.ToolCalls {
+			fmt.Fprintf(&sb, "    -> %s(%s)\n", call.Name, short(call.Arguments))
+		}
+	}
+
+	if record.Reasoning != "" {
+		fmt.Fprintf(&sb, "  reasoning: %s\n", indent(record.Reasoning))
+	}
+	for _, call := range record.ToolCalls {
+		fmt.Fprintf(&sb, "  => %s(%s)\n", call.Name, short(call.Arguments))
+	}
+	if record.Response != "" {
+		fmt.Fprintf(&sb, "  => %s\n", indent(record.Response))
+	}
+	if record.Error != "" {
+		fmt.Fprintf(&sb, "  error: %s\n", record.Error)
+	}
+
+	return sb.String()
+}
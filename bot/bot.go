@@ -27,19 +27,29 @@ var (
 	ErrHandlerStart   = errors.New("cannot start bot handler")
 )
 
-const TelegramCharLimit = 4000
+const (
+	TelegramCharLimit = 4000
+
+	llmUnavailableMessage = "LLM back-end is temporarily unavailable. Try again in a few minutes."
+)
 
 type Bot struct {
 	api        *t.Bot
 	llm        *llm.LlmConnector
 	extractor  extractor.Extractor
 	sanitizer  markdown.Sanitizer
+	renderer   markdown.EntitiesRenderer
 	stats      *stats.Stats
-	history    map[int64]*MessageHistory
+	history    HistoryStore
+	sequencer  *chatSequencer
+	queue      *requestQueue
+	memory     *memoryWriter
+	compacting chatSet // chats whose history is being summarized
 	me         botInfo
 	cfg        config.BotConfig
 	ctx        context.Context
 	imageCache *ImageCache
+	imageData  *imageDataCache
 }
 
 func NewBot(
@@ -47,26 +57,40 @@ func NewBot(
 	llm *llm.LlmConnector,
 	extractor extractor.Extractor,
 	sanitizer markdown.Sanitizer,
+	renderer markdown.EntitiesRenderer,
 	imageCache *ImageCache,
+	history HistoryStore,
 	cfg config.BotConfig,
 	ctx context.Context,
 ) *Bot {
 	if imageCache == nil {
 		panic("image cache is required")
 	}
+	if history == nil {
+		panic("history store is required")
+	}
 
-	return &Bot{
+	b := &Bot{
 		api:        api,
 		llm:        llm,
 		extractor:  extractor,
 		sanitizer:  sanitizer,
+		renderer:   renderer,
 		stats:      stats.NewStats(),
-		history:    make(map[int64]*MessageHistory),
+		history:    history,
+		sequencer:  newChatSequencer(),
+		queue:      newRequestQueue(cfg.QueueConcurrency),
+		memory:     newMemoryWriter(memoryQueueSize),
 		me:         botInfo{},
 		cfg:        cfg,
 		ctx:        ctx,
 		imageCache: imageCache,
+		imageData:  newImageDataCache(imageDataCacheSize),
 	}
+
+	llm.RegisterTool(b.searchHistoryTool())
+
+	return b
 }
 
 func (b *Bot) Run() error {
@@ -103,7 +127,7 @@ func (b *Bot) Run() error {
 		return ErrUpdatesChannel
 	}
 
-	bh, err := th.NewBotHandler(b.api, updates)
+	bh, err := th.NewBotHandler(b.api, b.sequencer.track(updates))
 	if err != nil {
 		slog.Error("bot: Cannot initialize bot handler", "error", err)
 		sentry.CaptureException(err)
@@ -111,6 +135,8 @@ func (b *Bot) Run() error {
 		return ErrHandlerInit
 	}
 
+	b.memory.start(memoryWorkers, b.rememberMessage)
+
 	defer func() {
 		slog.Info("bot: Stopping bot handler")
 		err := bh.Stop()
@@ -118,17 +144,18 @@ func (b *Bot) Run() error {
 			slog.Error("bot: Cannot stop bot handler", "error", err)
 			sentry.CaptureException(err)
 		}
+
+		slog.Info("bot: Waiting for queued memories to be saved")
+		b.memory.close()
 	}()
 
-	// Middlewares
-	bh.Use(b.chatHistory)
-	bh.Use(b.chatTypeStatsCounter)
+	b.useMiddlewares(bh)
 
 	// Command handlers
 	slog.Debug("bot: Registering message handlers")
 	commandForMe := b.commandForThisBot()
 	bh.HandleMessage(b.startHandler, th.And(commandForMe, th.CommandEqual("start")))
-	bh.HandleMessage(b.summarizeHandler, th.And(commandForMe, th.Or(th.CommandEqual("summarize"), th.CommandEqual("s"))))
+	bh.HandleMessage(b.summarizeHandler, th.And(commandForMe, th.Or(CommandInTextOrCaptionEqual("summarize"), CommandInTextOrCaptionEqual("s"))))
 	bh.HandleMessage(b.statsHandler, th.And(commandForMe, th.CommandEqual("stats")))
 	bh.HandleMessage(b.helpHandler, th.And(commandForMe, th.CommandEqual("help")))
 	bh.HandleMessage(b.resetHandler, th.And(commandForMe, th.CommandEqual("reset")))
@@ -175,32 +202,62 @@ func (b *Bot) processMention(reqCtx *th.Context, message t.Message) {
 
 	chatID := tu.ID(message.Chat.ID)
 
-	b.maybeSummarizeHistory(message.Chat.ID)
+	baseCtx := llm.WithChatID(b.handlerContext(reqCtx), message.Chat.ID)
+
+	release, err := b.waitForLlm(baseCtx, message)
+	if err != nil {
+		slog.Info("bot: Request left the queue", "chat", message.Chat.ID, "error", err)
+
+		return
+	}
+	defer release()
 
-	baseCtx := b.handlerContext(reqCtx)
+	b.maybeSummarizeHistory(message.Chat.ID)
 
 	// Get MessageData from the request context if available, otherwise create it on the fly
 	userMessageData := b.getMessageDataFromRequestContextOrCreate(reqCtx, message, true)
 
 	var llmReply string
 	var usage *llm.TokenUsage
-	var err error
+	var stream *streamingReply
 
 	err = b.runWithTimeout(baseCtx, chatID, func(ctx context.Context) error {
 		requestContext := b.createLlmRequestContextFromMessage(ctx, message)
+		llmMessage := messageDataToLlmMessage(userMessageData)
+		b.attachImages(ctx, message.Chat.ID, &llmMessage, userMessageData, b.currentImageKeys(userMessageData))
 
 		llmCtx, cancel := b.withProcessingDeadline(ctx)
 		defer cancel()
 
 		var llmErr error
+		if b.cfg.StreamingReplies {
+			stream, llmErr = b.startStreamingReply(baseCtx, message)
+			if llmErr != nil {
+				slog.Error("bot: Cannot send streaming reply placeholder", "error", llmErr)
+				sentry.CaptureException(llmErr)
+			} else {
+				llmReply, usage, llmErr = b.llm.StreamChatMessage(
+					llmCtx,
+					llmMessage,
+					requestContext,
+					stream.Update,
+				)
+				return llmErr
+			}
+		}
+
 		llmReply, usage, llmErr = b.llm.HandleChatMessage(
 			llmCtx,
-			messageDataToLlmMessage(userMessageData),
+			llmMessage,
 			requestContext,
 		)
 		return llmErr
 	})
 	if err != nil {
+		if stream != nil {
+			stream.Discard(baseCtx)
+		}
+
 		if errors.Is(err, ErrRequestTimeout) {
 			slog.Error("bot: LLM request timed out", "chat", message.Chat.ID, "error", err)
 			timeout := b.cfg.ProcessingTimeout
@@ -212,6 +269,13 @@ func (b *Bot) processMention(reqCtx *th.Context, message t.Message) {
 			return
 		}
 
+		if errors.Is(err, llm.ErrLlmBackendUnavailable) {
+			slog.Warn("bot: LLM back-end is unavailable", "chat", message.Chat.ID, "error", err)
+			_, _ = b.api.SendMessage(baseCtx, b.reply(message, tu.Message(chatID, llmUnavailableMessage)))
+
+			return
+		}
+
 		slog.Error("bot: Cannot get reply from LLM connector", "error", err)
 		sentry.CaptureException(err)
 
@@ -223,46 +287,90 @@ func (b *Bot) processMention(reqCtx *th.Context, message t.Message) {
 		return
 	}
 
-	if usage != nil {
-		b.stats.AddUsage(usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens, usage.Cost)
-	}
-
-	slog.Debug("bot: Got completion. Going to send.", "llm-completion", llmReply)
+	b.recordUsage(usage)
 
-	sanitizedReply := b.sanitizer.Sanitize(llmReply)
+	slog.Debug("bot: Got completion. Going to send.", "model", usage.Model, "llm-completion", llmReply)
 
-	reply := tu.Message(
-		chatID,
-		sanitizedReply,
-	).WithParseMode(t.ModeMarkdownV2)
+	replyParts := b.formatReply(llmReply, usage.Reasoning)
 
-	_, err = b.api.SendMessage(baseCtx, b.reply(message, reply))
+	var sentIDs []int
+	if stream != nil {
+		sentIDs, err = stream.Finish(baseCtx, llmReply, replyParts)
+	} else {
+		sentIDs, err = b.deliverReply(baseCtx, message, llmReply, replyParts, nil)
+	}
 	if err != nil {
-		slog.Error("bot: Can't send reply message", "error", err, "sanitized_reply", sanitizedReply)
+		slog.Error("bot: Can't send reply message", "error", err, "reply_parts", replyParts)
 		sentry.CaptureException(err)
 
 		b.trySendReplyError(baseCtx, message)
-
-		return
 	}
 
-	b.saveBotReplyToHistory(message, llmReply)
+	// The reply is saved even if it wasn't delivered, so the conversation context stays consistent with the LLM side
+	b.saveBotReplyToHistory(message, sentIDs, llmReply)
+}
+
+// useMiddlewares registers middlewares which run before every handler. The chat serializer goes first, so the history
+// is saved in the order of updates.
+func (b *Bot) useMiddlewares(bh *th.BotHandler) {
+	bh.Use(b.chatSerializer)
+	bh.Use(b.chatHistory)
+	bh.Use(b.chatTypeStatsCounter)
 }
 
 func (b *Bot) summarizeHandler(ctx *th.Context, message t.Message) error {
-	slog.Info("bot: /summarize", "message-text", message.Text)
+	commandText, _ := messageText(message)
+	slog.Info("bot: /summarize", "message-text", commandText)
 
 	b.stats.SummarizeRequest()
 
 	chatID := tu.ID(message.Chat.ID)
 
-	args := strings.SplitN(message.Text, " ", 3)
+	args := strings.SplitN(commandText, " ", 3)
 	argsCount := len(args)
+	replyTo := message.ReplyToMessage
+
+	// Everything after the command is an instruction when the source isn't a link from the command
+	restInstructions := ""
+	if _, rest, found := strings.Cut(commandText, " "); found {
+		restInstructions = strings.TrimSpace(rest)
+	}
 
-	if argsCount < 2 {
+	var url, text, additionalInstructions string
+	var document *t.Document
+	switch {
+	case message.Document != nil:
+		document = message.Document
+		additionalInstructions = restInstructions
+	// The link in the command wins over the replied message unless the argument is just an instruction
+	case argsCount >= 2 && (replyTo == nil || strings.Contains(args[1], "://")):
+		url = strings.TrimSpace(args[1])
+		if argsCount == 3 {
+			additionalInstructions = strings.TrimSpace(args[2])
+		}
+	case replyTo != nil && replyTo.Document != nil:
+		document = replyTo.Document
+		additionalInstructions = restInstructions
+	case replyTo != nil:
+		additionalInstructions = restInstructions
+		url = firstLink(*replyTo)
+		if url == "" {
+			text, _ = messageText(*replyTo)
+		}
+		if url == "" && strings.TrimSpace(text) == "" {
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+				chatID,
+				"The replied message has neither text nor links to summarize.",
+			)))
+
+			return nil
+		}
+	default:
 		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(
 			tu.ID(message.Chat.ID),
-			"Usage: /summarize <link>\r\n\r\n"+
+			"Usage: /summarize <link> [extra notes]\r\n"+
+				"Or reply with /summarize [extra notes] to a message with a link, a long text or a document.\r\n"+
+				"Documents (PDF, HTML, text, Markdown) can also be sent with /summarize in the caption.\r\n\r\n"+
 				"Example:\r\n"+
 				"/summarize https://kernel.org/get-notifications-for-your-patches.html",
 		))
@@ -270,12 +378,107 @@ func (b *Bot) summarizeHandler(ctx *th.Context, message t.Message) error {
 		return nil
 	}
 
-	url := strings.TrimSpace(args[1])
-	additionalInstructions := ""
-	if argsCount == 3 {
-		additionalInstructions = strings.TrimSpace(args[2])
+	var source summarySource
+	switch {
+	case document != nil:
+		article, ok := b.extractDocument(ctx, message, document)
+		if !ok {
+			return nil
+		}
+		text, source.FileName = article.Text, article.Title
+	case url != "":
+		article, ok := b.extractArticle(ctx, message, url)
+		if !ok {
+			return nil
+		}
+		text, source.URL = article.Text, article.Url
+	}
+
+	var summarizeReply string
+	var summarizeUsage *llm.TokenUsage
+
+	release, err := b.waitForLlm(ctx.Context(), message)
+	if err != nil {
+		slog.Info("bot: Request left the queue", "chat", message.Chat.ID, "error", err)
+
+		return nil
+	}
+	defer release()
+
+	// Long texts are summarized in several LLM requests, so the processing timeout limits each of them
+	err = b.runWithTyping(ctx.Context(), chatID, func(ctx context.Context) error {
+		llmCtx := llm.WithSummarizeRequestTimeout(llm.WithChatID(ctx, message.Chat.ID), b.cfg.ProcessingTimeout)
+
+		var llmErr error
+		summarizeReply, summarizeUsage, llmErr = b.llm.Summarize(llmCtx, text, additionalInstructions)
+		return llmErr
+	})
+	if err != nil {
+		if errors.Is(err, llm.ErrTextTooLong) {
+			slog.Info("bot: Text is too long to summarize", "chat", message.Chat.ID, "error", err)
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+				chatID,
+				"The text is too long to summarize.",
+			)))
+
+			return nil
+		}
+
+		if errors.Is(err, ErrRequestTimeout) {
+			slog.Error("bot: Summarize request timed out", "chat", message.Chat.ID, "error", err)
+			timeout := b.cfg.ProcessingTimeout
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+				chatID,
+				fmt.Sprintf("LLM request timed out after %s. Try again later.", timeout),
+			)))
+
+			return nil
+		}
+
+		if errors.Is(err, llm.ErrLlmBackendUnavailable) {
+			slog.Warn("bot: LLM back-end is unavailable", "chat", message.Chat.ID, "error", err)
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(chatID, llmUnavailableMessage)))
+
+			return nil
+		}
+
+		slog.Error("bot: Cannot get reply from LLM connector", "error", err)
+		sentry.CaptureException(err)
+
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+			chatID,
+			"LLM request error. Try again later.",
+		)))
+
+		return nil
+	}
+
+	b.recordUsage(summarizeUsage)
+
+	slog.Debug("bot: Got completion. Going to send reply.", "model", summarizeUsage.Model, "llm-completion", summarizeReply)
+
+	reply := b.formatSummary(summarizeReply, source)
+
+	plainReply := summarizeReply
+	if footer := source.plainText(); footer != "" {
+		plainReply += "\n\n" + footer
+	}
+	sentIDs, err := b.deliverReply(ctx.Context(), message, plainReply, []formattedText{reply}, nil)
+	if err != nil {
+		slog.Error("bot: Can't send reply message", "error", err, "reply", reply)
+		sentry.CaptureException(err)
+
+		b.trySendReplyError(ctx.Context(), message)
 	}
 
+	b.saveBotReplyToHistory(message, sentIDs, reply.Text)
+	return nil
+}
+
+// extractArticle downloads the article for summarization. Errors are reported to the user.
+func (b *Bot) extractArticle(ctx *th.Context, message t.Message, url string) (extractor.Article, bool) {
+	chatID := tu.ID(message.Chat.ID)
+
 	if !isValidAndAllowedUrl(url) {
 		slog.Error("bot: Provided text is not a valid URL", "text", url)
 
@@ -284,11 +487,22 @@ func (b *Bot) summarizeHandler(ctx *th.Context, message t.Message) error {
 			"URL is not valid.",
 		)))
 
-		return nil
+		return extractor.Article{}, false
 	}
 
-	var err error
-	article, err := b.extractor.GetArticleFromUrl(url)
+	extractCtx, cancel := b.withProcessingDeadline(ctx.Context())
+	article, err := b.extractor.GetArticleFromUrl(extractCtx, url)
+	cancel()
+	if errors.Is(err, extractor.ErrForbiddenAddress) {
+		slog.Warn("bot: Summarization of an internal address is denied", "url", url, "chat", message.Chat.ID, "error", err)
+
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+			chatID,
+			"This address is not allowed.",
+		)))
+
+		return extractor.Article{}, false
+	}
 	if err != nil {
 		slog.Error("bot: Cannot retrieve an article using extractor", "error", err)
 		sentry.CaptureException(err)
@@ -298,7 +512,7 @@ func (b *Bot) summarizeHandler(ctx *th.Context, message t.Message) error {
 			"Failed to extract article content. Please check if the URL is correct.",
 		)))
 
-		return nil
+		return extractor.Article{}, false
 	}
 
 	if article.Text == "" {
@@ -310,74 +524,100 @@ func (b *Bot) summarizeHandler(ctx *th.Context, message t.Message) error {
 			"No text extracted from the article. This resource is not supported at the moment.",
 		)))
 
-		return nil
+		return extractor.Article{}, false
 	}
 
-	var summarizeReply string
-	var summarizeUsage *llm.TokenUsage
+	return article, true
+}
 
-	err = b.runWithTimeout(ctx.Context(), chatID, func(ctx context.Context) error {
-		llmCtx, cancel := b.withProcessingDeadline(ctx)
-		defer cancel()
+// extractDocument downloads the document for summarization and extracts its text. Errors are reported to the user.
+func (b *Bot) extractDocument(ctx *th.Context, message t.Message, document *t.Document) (extractor.Article, bool) {
+	chatID := tu.ID(message.Chat.ID)
 
-		var llmErr error
-		summarizeReply, summarizeUsage, llmErr = b.llm.Summarize(llmCtx, article.Text, additionalInstructions)
-		return llmErr
-	})
-	if err != nil {
-		if errors.Is(err, ErrRequestTimeout) {
-			slog.Error("bot: Summarize request timed out", "chat", message.Chat.ID, "error", err)
-			timeout := b.cfg.ProcessingTimeout
-			_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
-				chatID,
-				fmt.Sprintf("LLM request timed out after %s. Try again later.", timeout),
-			)))
+	tooLarge := func(err error) (extractor.Article, bool) {
+		slog.Info("bot: Document is too large", "file", document.FileName, "error", err)
 
-			return nil
-		}
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+			chatID,
+			fmt.Sprintf("The file is too large. Maximum size is %d MB.", b.cfg.MaxDocumentSize>>20),
+		)))
 
-		slog.Error("bot: Cannot get reply from LLM connector", "error", err)
+		return extractor.Article{}, false
+	}
+
+	if b.cfg.MaxDocumentSize > 0 && document.FileSize > b.cfg.MaxDocumentSize {
+		return tooLarge(fmt.Errorf("%w: %d bytes", ErrFileTooLarge, document.FileSize))
+	}
+
+	// Both the download and the text extraction are limited by the processing timeout
+	fileCtx, cancel := b.withProcessingDeadline(ctx.Context())
+	defer cancel()
+
+	file, err := b.api.GetFile(fileCtx, &t.GetFileParams{FileID: document.FileID})
+	if err == nil && b.cfg.MaxDocumentSize > 0 && file.FileSize > b.cfg.MaxDocumentSize {
+		err = fmt.Errorf("%w: %d bytes", ErrFileTooLarge, file.FileSize)
+	}
+	var data []byte
+	if err == nil {
+		// Telegram may not report the size, so the download is limited too
+		data, err = downloadFileWithContext(fileCtx, b.api.FileDownloadURL(file.FilePath), b.cfg.MaxDocumentSize)
+	}
+	if errors.Is(err, ErrFileTooLarge) {
+		return tooLarge(err)
+	}
+	if err != nil {
+		slog.Error("bot: Cannot download the document", "file", document.FileName, "error", err)
 		sentry.CaptureException(err)
 
 		_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
 			chatID,
-			"LLM request error. Try again later.",
+			"Failed to download the file.",
 		)))
 
-		return nil
+		return extractor.Article{}, false
 	}
 
-	if summarizeUsage != nil {
-		b.stats.AddUsage(summarizeUsage.PromptTokens, summarizeUsage.CompletionTokens, summarizeUsage.TotalTokens, summarizeUsage.Cost)
+	fileName := document.FileName
+	if fileName == "" {
+		fileName = "document"
 	}
+	article, err := extractor.ArticleFromDocument(fileCtx, data, document.MimeType, fileName)
+	if errors.Is(err, extractor.ErrUnsupportedDocument) {
+		slog.Info("bot: Document type is not supported", "file", fileName, "mime-type", document.MimeType)
 
-	slog.Debug("bot: Got completion. Going to send reply.", "llm-completion", summarizeReply)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+			chatID,
+			"This file type is not supported. Send a PDF, HTML, text or Markdown file.",
+		)))
 
-	footerURL := b.sanitizer.EscapeURL(article.Url)
-	footer := "\n\n[src](" + footerURL + ")"
-	body := b.sanitizer.Sanitize(summarizeReply)
-	cropped, changed := cropToMaxLengthMarkdownV2(body, TelegramCharLimit-len(footer))
-	if changed {
-		cropped = b.sanitizer.Sanitize(cropped)
+		return extractor.Article{}, false
 	}
-	replyMarkdown := cropped + footer
+	if err != nil {
+		slog.Error("bot: Cannot extract text from the document", "file", fileName, "error", err)
+		sentry.CaptureException(err)
 
-	replyMessage := tu.Message(
-		chatID,
-		replyMarkdown,
-	).WithParseMode(t.ModeMarkdownV2)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+			chatID,
+			"Failed to extract text from the file.",
+		)))
 
-	_, err = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, replyMessage))
+		return extractor.Article{}, false
+	}
 
-	if err != nil {
-		slog.Error("bot: Can't send reply message", "error", err, "sanitized_reply", replyMarkdown)
-		sentry.CaptureException(err)
+	if article.Text == "" {
+		slog.Info("bot: Document text is empty", "file", fileName)
 
-		b.trySendReplyError(ctx.Context(), message)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
+			chatID,
+			"No text found in the file. Scanned documents without a text layer are not supported.",
+		)))
+
+		return extractor.Article{}, false
 	}
+	// The footer shows the name of the file rather than the title of an HTML page
+	article.Title = fileName
 
-	b.saveBotReplyToHistory(message, replyMarkdown)
-	return nil
+	return article, true
 }
 
 func (b *Bot) helpHandler(ctx *th.Context, message t.Message) error {
@@ -392,7 +632,7 @@ func (b *Bot) helpHandler(ctx *th.Context, message t.Message) error {
 		`Instructions:
 Mention the bot, reply to it to chat; text and photos are supported.
 
-- /summarize <link> [extra notes] - Summarize a page (alias: /s)
+- /summarize <link> [extra notes] - Summarize a page, the replied message or a document (alias: /s)
 - /reset - Clear conversation history (admins only)
 - /stats - Show usage stats (admins only)
 - /help - Show this help`,
@@ -443,6 +683,11 @@ func (b *Bot) statsHandler(ctx *th.Context, message t.Message) error {
 
 	b.sendTyping(ctx.Context(), chatID)
 
+	for _, backend := range b.llm.BackendStatus() {
+		b.stats.SetLlmBackendStatus(backend.Endpoint, backend.BreakerState, backend.ConsecutiveFailures)
+	}
+	b.stats.SetLlmRetries(b.llm.Retries())
+
 	statsJSON := "```json\n" + b.stats.String() + "\n```"
 	replyText := b.sanitizer.Sanitize("Current bot stats:\n" + statsJSON)
 	_, err := ctx.Bot().SendMessage(ctx.Context(), b.reply(message, tu.Message(
@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"context"
+	"sync"
+
+	t "github.com/mymmrac/telego"
+)
+
+// chatSequencer serializes update processing per chat. Updates of the same chat are processed one by one in the
+// order they were received from Telegram while updates of different chats are still processed concurrently.
+type chatSequencer struct {
+	mu    sync.Mutex
+	chats map[int64][]*chatTurn
+	turns map[int]*chatTurn
+}
+
+// chatTurn is a place of a single update in the chat queue
+type chatTurn struct {
+	chatID int64
+	ready  chan struct{}
+}
+
+func newChatSequencer() *chatSequencer {
+	return &chatSequencer{
+		chats: make(map[int64][]*chatTurn),
+		turns: make(map[int]*chatTurn),
+	}
+}
+
+// track puts every update from the channel in its chat queue before passing it further. It must be applied to the
+// updates channel before the updates are dispatched concurrently to keep their original order.
+func (s *chatSequencer) track(updates <-chan t.Update) <-chan t.Update {
+	tracked := make(chan t.Update, cap(updates))
+
+	go func() {
+		defer close(tracked)
+
+		for update := range updates {
+			if chatID, ok := updateChatID(update); ok {
+				s.enqueue(update.UpdateID, chatID)
+			}
+			tracked <- update
+		}
+	}()
+
+	return tracked
+}
+
+func (s *chatSequencer) enqueue(updateID int, chatID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	turn := &chatTurn{
+		chatID: chatID,
+		ready:  make(chan struct{}),
+	}
+
+	queue := s.chats[chatID]
+	if len(queue) == 0 {
+		close(turn.ready)
+	}
+
+	s.chats[chatID] = append(queue, turn)
+	s.turns[updateID] = turn
+}
+
+// wait blocks until it's the turn of the update to be processed. The returned function must be called when
+// processing is finished. Untracked updates are not waited for.
+func (s *chatSequencer) wait(ctx context.Context, updateID int) (func(), error) {
+	s.mu.Lock()
+	turn, ok := s.turns[updateID]
+	delete(s.turns, updateID)
+	s.mu.Unlock()
+
+	if !ok {
+		return func() {}, nil
+	}
+
+	release := func() {
+		s.release(turn)
+	}
+
+	select {
+	case <-turn.ready:
+		return release, nil
+	case <-ctx.Done():
+		release()
+
+		return nil, ctx.Err()
+	}
+}
+
+func (s *chatSequencer) release(turn *chatTurn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.chats[turn.chatID]
+	for i, queued := range queue {
+		if queued != turn {
+			continue
+		}
+
+		queue = append(queue[:i], queue[i+1:]...)
+		if i == 0 && len(queue) > 0 {
+			close(queue[0].ready)
+		}
+		break
+	}
+
+	if len(queue) == 0 {
+		delete(s.chats, turn.chatID)
+	} else {
+		s.chats[turn.chatID] = queue
+	}
+}
+
+func updateChatID(update t.Update) (int64, bool) {
+	if update.Message == nil {
+		return 0, false
+	}
+
+	return update.Message.Chat.ID, true
+}
@@ -0,0 +1,374 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+	"telegram-ollama-reply-bot/llm"
+	"telegram-ollama-reply-bot/markdown"
+	"telegram-ollama-reply-bot/stats"
+
+	tg "github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestChatSequencer_ProcessesChatUpdatesInOrder(t *testing.T) {
+	const (
+		chats          = 5
+		updatesPerChat = 100
+	)
+
+	seq := newChatSequencer()
+	store := NewMemoryHistoryStore(updatesPerChat, 0)
+
+	updates := make(chan tg.Update, chats*updatesPerChat)
+	for i := 0; i < chats*updatesPerChat; i++ {
+		updates <- tg.Update{
+			UpdateID: i,
+			Message: &tg.Message{
+				Chat: tg.Chat{ID: int64(i % chats)},
+				Text: strconv.Itoa(i),
+			},
+		}
+	}
+	close(updates)
+
+	// Dispatch every update in its own goroutine the same way telego's bot handler does
+	var wg sync.WaitGroup
+	for update := range seq.track(updates) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			release, err := seq.wait(context.Background(), update.UpdateID)
+			if err != nil {
+				t.Errorf("unexpected wait error: %v", err)
+				return
+			}
+			defer release()
+
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+			_ = store.Push(update.Message.Chat.ID, MessageData{Text: update.Message.Text})
+			_, _ = store.Messages(update.Message.Chat.ID)
+		}()
+	}
+	wg.Wait()
+
+	for chatID := int64(0); chatID < chats; chatID++ {
+		messages, _ := store.Messages(chatID)
+		if len(messages) != updatesPerChat {
+			t.Fatalf("chat %d: expected %d messages, got %d", chatID, updatesPerChat, len(messages))
+		}
+		for i, msg := range messages {
+			expected := strconv.Itoa(i*chats + int(chatID))
+			if msg.Text != expected {
+				t.Fatalf("chat %d: message %d is out of order: expected %q got %q", chatID, i, expected, msg.Text)
+			}
+		}
+	}
+
+	if len(seq.chats) != 0 || len(seq.turns) != 0 {
+		t.Fatalf("sequencer has leftover state: %d chats, %d turns", len(seq.chats), len(seq.turns))
+	}
+}
+
+func TestChatSequencer_CancelledWaitReleasesTurn(t *testing.T) {
+	seq := newChatSequencer()
+	seq.enqueue(1, 10)
+	seq.enqueue(2, 10)
+	seq.enqueue(3, 10)
+
+	release1, err := seq.wait(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("unexpected wait error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := seq.wait(ctx, 2); err == nil {
+		t.Fatalf("expected cancelled wait to fail")
+	}
+
+	release1()
+
+	done := make(chan struct{})
+	go func() {
+		release3, err := seq.wait(context.Background(), 3)
+		if err == nil {
+			release3()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("third update was blocked by the cancelled one")
+	}
+}
+
+func TestBot_MiddlewaresProcessChatUpdatesInOrder(t *testing.T) {
+	const (
+		chats          = 5
+		updatesPerChat = 50
+	)
+
+	api, err := tg.NewBot("123456:"+strings.Repeat("a", 35), tg.WithDiscardLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b := &Bot{
+		api:       api,
+		history:   NewMemoryHistoryStore(updatesPerChat, 0),
+		sequencer: newChatSequencer(),
+		stats:     stats.NewStats(),
+		cfg:       config.BotConfig{},
+		ctx:       context.Background(),
+	}
+
+	updates := make(chan tg.Update, chats*updatesPerChat)
+	for i := 0; i < chats*updatesPerChat; i++ {
+		updates <- tg.Update{
+			UpdateID: i,
+			Message: &tg.Message{
+				MessageID: i,
+				Chat:      tg.Chat{ID: int64(i % chats), Type: tg.ChatTypeGroup},
+				From:      &tg.User{ID: 1, FirstName: "User"},
+				Text:      strconv.Itoa(i),
+			},
+		}
+	}
+	close(updates)
+
+	bh, err := th.NewBotHandler(api, b.sequencer.track(updates))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.useMiddlewares(bh)
+
+	var mu sync.Mutex
+	handled := make(map[int64][]string)
+	var wg sync.WaitGroup
+	wg.Add(chats * updatesPerChat)
+	bh.HandleMessage(func(_ *th.Context, message tg.Message) error {
+		defer wg.Done()
+
+		// Handlers of later updates would overtake this one without the serializer
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+		mu.Lock()
+		handled[message.Chat.ID] = append(handled[message.Chat.ID], message.Text)
+		mu.Unlock()
+
+		return nil
+	})
+
+	go func() { _ = bh.Start() }()
+	defer func() { _ = bh.Stop() }()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("updates were not processed in time")
+	}
+
+	for chatID := int64(0); chatID < chats; chatID++ {
+		messages, _ := b.history.Messages(chatID)
+		if len(messages) != updatesPerChat || len(handled[chatID]) != updatesPerChat {
+			t.Fatalf("chat %d: expected %d messages, got %d saved and %d handled", chatID, updatesPerChat, len(messages), len(handled[chatID]))
+		}
+		for i := range messages {
+			expected := strconv.Itoa(i*chats + int(chatID))
+			if messages[i].Text != expected || handled[chatID][i] != expected {
+				t.Fatalf("chat %d: message %d is out of order: expected %q, saved %q, handled %q",
+					chatID, i, expected, messages[i].Text, handled[chatID][i])
+			}
+		}
+	}
+}
+
+// runTwoMentions sends two mentions to the same chat through the middlewares and the handler and returns the chat
+// history and the messages of each LLM request
+func runTwoMentions(t *testing.T, queue *requestQueue, beforeStart func(), afterQueued func()) ([]MessageData, [][]openai.ChatCompletionMessage) {
+	t.Helper()
+
+	var mu sync.Mutex
+	sent := 0
+	api := newFakeApi(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			var params tg.SendMessageParams
+			_ = json.NewDecoder(r.Body).Decode(&params)
+			if strings.HasPrefix(params.Text, "Reply") {
+				sent++
+			}
+			_, _ = fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"chat":{"id":1,"type":"private"},"date":0}}`, 100+sent)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	})
+
+	var requests [][]openai.ChatCompletionMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		question := req.Messages[len(req.Messages)-1].Content
+		if strings.Contains(question, "first") {
+			// The second request would overtake the slow first one if they ran at once
+			time.Sleep(100 * time.Millisecond)
+		}
+		mu.Lock()
+		requests = append(requests, req.Messages)
+		mu.Unlock()
+
+		reply := "Reply to the second"
+		if strings.Contains(question, "first") {
+			reply = "Reply to the first"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": reply}, "finish_reason": "stop"}},
+			"usage":   map[string]int{"total_tokens": 1},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	tp, err := llm.NewTemplateProcessor(config.PromptConfig{ChatSystemPrompt: "system"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b := &Bot{
+		api: api,
+		llm: llm.NewConnector(config.LLMConfig{
+			APIBaseURL: server.URL,
+			Models:     config.ModelSelection{TextRequestModel: config.ParseModelChain("model")},
+			Retry:      config.RetryConfig{MaxAttempts: 1},
+		}, tp),
+		renderer:  markdown.NewTgEntitiesRenderer(),
+		history:   NewMemoryHistoryStore(10, 0),
+		sequencer: newChatSequencer(),
+		queue:     queue,
+		stats:     stats.NewStats(),
+		cfg:       config.BotConfig{ProcessingTimeout: 5 * time.Second, ReplyFormat: config.ReplyFormatEntities},
+		ctx:       context.Background(),
+	}
+
+	updates := make(chan tg.Update, 2)
+	for i, text := range []string{"The first question", "The second question"} {
+		updates <- tg.Update{
+			UpdateID: i,
+			Message: &tg.Message{
+				MessageID: i + 1,
+				Chat:      tg.Chat{ID: 1, Type: tg.ChatTypePrivate},
+				From:      &tg.User{ID: 1, FirstName: "User"},
+				Text:      text,
+			},
+		}
+	}
+	close(updates)
+
+	bh, err := th.NewBotHandler(api, b.sequencer.track(updates))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.useMiddlewares(bh)
+	bh.Handle(b.textMessageHandler, th.AnyMessageWithText())
+
+	beforeStart()
+	go func() { _ = bh.Start() }()
+	afterQueued()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := len(requests) == 2 && sent == 2
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mentions were not processed in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_ = bh.Stop()
+
+	history, _ := b.history.Messages(1)
+
+	return history, requests
+}
+
+func TestBot_MentionsOfChatAreProcessedInOrder(t *testing.T) {
+	history, requests := runTwoMentions(t, newRequestQueue(0), func() {}, func() {})
+
+	var texts []string
+	for _, msg := range history {
+		texts = append(texts, msg.Text)
+	}
+	expected := []string{"The first question", "Reply to the first", "The second question", "Reply to the second"}
+	if !slices.Equal(texts, expected) {
+		t.Fatalf("expected history %q, got %q", expected, texts)
+	}
+	if !slices.ContainsFunc(requests[1], func(m openai.ChatCompletionMessage) bool { return strings.Contains(m.Content, "Reply to the first") }) {
+		t.Fatalf("the second request must see the first reply, got %+v", requests[1])
+	}
+}
+
+func TestBot_QueuedMentionsOfChatAreProcessedInOrder(t *testing.T) {
+	// Other chats hold both slots, so the mentions wait in the queue and release the chat turn
+	queue := newRequestQueue(2)
+	var releases []func()
+	history, requests := runTwoMentions(t, queue, func() {
+		for chatID := int64(100); chatID < 102; chatID++ {
+			release, err := queue.acquire(context.Background(), chatID, false, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			releases = append(releases, release)
+		}
+	}, func() {
+		// The second mention is queued only if the first one gave its chat turn away
+		deadline := time.Now().Add(time.Second)
+		for queuedCount(queue) != 2 {
+			if time.Now().After(deadline) {
+				t.Fatal("mentions were not queued")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		for _, release := range releases {
+			release()
+		}
+	})
+
+	var replies []string
+	for _, msg := range history {
+		if msg.IsMe {
+			replies = append(replies, msg.Text)
+		}
+	}
+	if !slices.Equal(replies, []string{"Reply to the first", "Reply to the second"}) {
+		t.Fatalf("replies are saved out of order: %q", replies)
+	}
+	if !slices.ContainsFunc(requests[1], func(m openai.ChatCompletionMessage) bool { return strings.Contains(m.Content, "Reply to the first") }) {
+		t.Fatalf("the second request must see the first reply, got %+v", requests[1])
+	}
+}
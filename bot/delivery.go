@@ -0,0 +1,147 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	t "github.com/mymmrac/telego"
+	ta "github.com/mymmrac/telego/telegoapi"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const replyDocumentName = "reply.md"
+
+// partSender delivers a single part of the reply and returns the resulting message
+type partSender func(ctx context.Context, replyTo t.Message, part formattedText) (*t.Message, error)
+
+// isParseEntitiesError checks if Telegram rejected the message because of invalid formatting
+func isParseEntitiesError(err error) bool {
+	var apiErr *ta.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	description := strings.ToLower(apiErr.Description)
+
+	return strings.Contains(description, "can't parse entities") ||
+		strings.Contains(description, "can't find end of") ||
+		strings.Contains(description, "entity_text_invalid")
+}
+
+// isRejectedContentError checks if Telegram rejected the message because of its content rather than a delivery
+// problem, so sending the same text once again won't help
+func isRejectedContentError(err error) bool {
+	if isParseEntitiesError(err) {
+		return true
+	}
+
+	var apiErr *ta.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	description := strings.ToLower(apiErr.Description)
+
+	return strings.Contains(description, "too long") || strings.Contains(description, "message_too_long")
+}
+
+// deliverReply sends the reply parts as a chain of messages. If Telegram rejects the formatting of a part, it is
+// sent once again as plain text. If the content of the part is still rejected, the rest of the reply is sent as a
+// Markdown document, so the LLM answer is not lost. Other errors, e.g. network ones, are returned as is.
+// sendFirst allows to deliver the first part differently, e.g. by editing a placeholder message. Returns IDs of the
+// delivered messages in order.
+func (b *Bot) deliverReply(
+	ctx context.Context,
+	replyTo t.Message,
+	text string,
+	parts []formattedText,
+	sendFirst partSender,
+) ([]int, error) {
+	if sendFirst == nil {
+		sendFirst = b.sendPart
+	}
+
+	var delivered []int
+	plainTextUsed := false
+	for i, part := range parts {
+		send := b.sendPart
+		if i == 0 {
+			send = sendFirst
+		}
+
+		sent, err := send(ctx, replyTo, part)
+		if err != nil && isParseEntitiesError(err) {
+			slog.Error("bot: Telegram can't parse reply formatting, sending as plain text", "error", err, "part", part)
+			sentry.CaptureException(err)
+
+			sent, err = send(ctx, replyTo, b.stripFormatting(part))
+			if err == nil && !plainTextUsed {
+				plainTextUsed = true
+				b.stats.ReplyPlainTextFallback()
+			}
+		}
+		if err != nil && !isRejectedContentError(err) {
+			return delivered, err
+		}
+		if err != nil {
+			slog.Error("bot: Telegram rejected reply part, sending the rest as a document", "error", err, "part", i)
+			sentry.CaptureException(err)
+
+			// Parts which were already delivered are not repeated
+			remainder := text
+			if i > 0 {
+				texts := make([]string, 0, len(parts)-i)
+				for _, rest := range parts[i:] {
+					texts = append(texts, b.stripFormatting(rest).Text)
+				}
+				remainder = strings.Join(texts, "\n\n")
+			}
+
+			document, docErr := b.sendReplyDocument(ctx, replyTo, remainder)
+			if document != nil {
+				delivered = append(delivered, document.MessageID)
+			}
+
+			return delivered, docErr
+		}
+
+		delivered = append(delivered, sent.MessageID)
+		replyTo = *sent
+	}
+
+	return delivered, nil
+}
+
+func (b *Bot) sendPart(ctx context.Context, replyTo t.Message, part formattedText) (*t.Message, error) {
+	return b.api.SendMessage(ctx, b.reply(replyTo, part.message(tu.ID(replyTo.Chat.ID))))
+}
+
+// stripFormatting returns the same text without any formatting
+func (b *Bot) stripFormatting(part formattedText) formattedText {
+	if part.ParseMode == t.ModeMarkdownV2 {
+		// Markdown V2 is close enough to Markdown to get rid of escaping and formatting markers with the renderer
+		return formattedText{Text: b.renderer.Render(part.Text).Text}
+	}
+
+	return formattedText{Text: part.Text}
+}
+
+func (b *Bot) sendReplyDocument(ctx context.Context, replyTo t.Message, text string) (*t.Message, error) {
+	document, err := b.api.SendDocument(ctx, tu.Document(
+		tu.ID(replyTo.Chat.ID),
+		tu.File(tu.NameReader(bytes.NewReader([]byte(text)), replyDocumentName)),
+	).WithReplyParameters(&t.ReplyParameters{
+		MessageID: replyTo.MessageID,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	b.stats.ReplyDocumentFallback()
+
+	return document, nil
+}
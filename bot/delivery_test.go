@@ -0,0 +1,154 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"telegram-ollama-reply-bot/config"
+	"telegram-ollama-reply-bot/markdown"
+	"telegram-ollama-reply-bot/stats"
+
+	tg "github.com/mymmrac/telego"
+	ta "github.com/mymmrac/telego/telegoapi"
+)
+
+func TestIsParseEntitiesError(t *testing.T) {
+	parseErr := fmt.Errorf("telego: sendMessage: api: %w", &ta.Error{
+		ErrorCode:   400,
+		Description: "Bad Request: can't parse entities: Character '.' is reserved and must be escaped",
+	})
+	if !isParseEntitiesError(parseErr) {
+		t.Fatalf("expected parse entities error to be detected")
+	}
+
+	otherErr := fmt.Errorf("telego: sendMessage: api: %w", &ta.Error{
+		ErrorCode:   403,
+		Description: "Forbidden: bot was blocked by the user",
+	})
+	if isParseEntitiesError(otherErr) {
+		t.Fatalf("unexpected parse entities error detection for %v", otherErr)
+	}
+	if isParseEntitiesError(errors.New("can't parse entities")) {
+		t.Fatalf("non-API errors must not be treated as parse errors")
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	b := &Bot{renderer: markdown.NewTgEntitiesRenderer()}
+
+	plain := b.stripFormatting(formattedText{Text: "*bold* and \\. dot", ParseMode: tg.ModeMarkdownV2})
+	if plain.Text != "bold and . dot" || plain.ParseMode != "" || len(plain.Entities) != 0 {
+		t.Fatalf("unexpected plain text: %+v", plain)
+	}
+
+	plain = b.stripFormatting(formattedText{
+		Text:     "bold",
+		Entities: []tg.MessageEntity{{Type: tg.EntityTypeBold, Length: 4}},
+	})
+	if plain.Text != "bold" || len(plain.Entities) != 0 {
+		t.Fatalf("unexpected plain text: %+v", plain)
+	}
+}
+
+func TestFormatReply_Reasoning(t *testing.T) {
+	b := &Bot{
+		cfg:       config.BotConfig{ReplyFormat: config.ReplyFormatEntities, ReasoningDisplay: config.ReasoningDisplayBlockquote},
+		renderer:  markdown.NewTgEntitiesRenderer(),
+		sanitizer: markdown.NewTgMarkdownV2Sanitizer(),
+	}
+
+	parts := b.formatReply("**Answer**", "Thinking.")
+	if len(parts) != 1 || parts[0].Text != "Thinking.\n\nAnswer" {
+		t.Fatalf("unexpected parts: %+v", parts)
+	}
+	if e := parts[0].Entities[0]; e.Type != tg.EntityTypeExpandableBlockquote || e.Offset != 0 || e.Length != 9 {
+		t.Fatalf("unexpected reasoning entity: %+v", e)
+	}
+
+	b.cfg.ReplyFormat = config.ReplyFormatMarkdownV2
+	b.cfg.ReasoningDisplay = config.ReasoningDisplaySpoiler
+	if parts = b.formatReply("Answer", "Thinking."); parts[0].Text != "||Thinking\\.||\n\nAnswer" {
+		t.Fatalf("unexpected markdown parts: %+v", parts)
+	}
+
+	b.cfg.ReasoningDisplay = config.ReasoningDisplayHidden
+	if parts = b.formatReply("Answer", "Thinking."); parts[0].Text != "Answer" {
+		t.Fatalf("reasoning must be hidden: %+v", parts)
+	}
+}
+
+// newFakeApi returns the bot API client sending requests to the handler instead of Telegram
+func newFakeApi(t *testing.T, handler http.HandlerFunc) *tg.Bot {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	api, err := tg.NewBot("123456:"+strings.Repeat("a", 35), tg.WithAPIServer(server.URL), tg.WithDiscardLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return api
+}
+
+func TestDeliverReply_Fallbacks(t *testing.T) {
+	const okMessage = `{"ok":true,"result":{"message_id":%d,"chat":{"id":1,"type":"private"},"date":0}}`
+
+	var mu sync.Mutex
+	var sentTexts []string
+	var document string
+	failure := ""
+	api := newFakeApi(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+			var params tg.SendMessageParams
+			_ = json.NewDecoder(r.Body).Decode(&params)
+			if strings.Contains(params.Text, "second") && failure != "" {
+				_, _ = w.Write([]byte(failure))
+				return
+			}
+			sentTexts = append(sentTexts, params.Text)
+			_, _ = fmt.Fprintf(w, okMessage, len(sentTexts))
+		case strings.HasSuffix(r.URL.Path, "/sendDocument"):
+			file, _, _ := r.FormFile("document")
+			data, _ := io.ReadAll(file)
+			document = string(data)
+			_, _ = fmt.Fprintf(w, okMessage, 100)
+		}
+	})
+
+	b := &Bot{api: api, stats: stats.NewStats(), renderer: markdown.NewTgEntitiesRenderer()}
+	replyTo := tg.Message{MessageID: 1, Chat: tg.Chat{ID: 1, Type: tg.ChatTypePrivate}}
+	parts := []formattedText{{Text: "first"}, {Text: "second"}, {Text: "third"}}
+
+	failure = `{"ok":false,"error_code":400,"description":"Bad Request: message is too long"}`
+	delivered, err := b.deliverReply(context.Background(), replyTo, "first second third", parts, nil)
+	if err != nil || len(delivered) != 2 || delivered[0] != 1 || delivered[1] != 100 {
+		t.Fatalf("unexpected result: %v, %v", delivered, err)
+	}
+	if len(sentTexts) != 1 || document != "second\n\nthird" {
+		t.Fatalf("only the undelivered parts must be sent as a document, got messages %q and document %q", sentTexts, document)
+	}
+
+	sentTexts, document = nil, ""
+	failure = `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5","parameters":{"retry_after":5}}`
+	if _, err := b.deliverReply(context.Background(), replyTo, "first second third", parts, nil); err == nil {
+		t.Fatal("delivery errors must be returned")
+	}
+	if document != "" {
+		t.Fatalf("delivery errors must not be sent as a document, got %q", document)
+	}
+}
@@ -0,0 +1,150 @@
+package bot
+
+import (
+	"strings"
+
+	"telegram-ollama-reply-bot/config"
+	"telegram-ollama-reply-bot/markdown"
+
+	t "github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Reasoning longer than this is cropped, so it leaves enough space for the reply in the first message
+const maxShownReasoningLength = 1000
+
+// formattedText is a message text ready to be sent either with a parse mode or with message entities
+type formattedText struct {
+	Text      string
+	ParseMode string
+	Entities  []t.MessageEntity
+}
+
+func (f formattedText) message(chatID t.ChatID) *t.SendMessageParams {
+	msg := tu.Message(chatID, f.Text)
+	if f.ParseMode != "" {
+		msg = msg.WithParseMode(f.ParseMode)
+	}
+	if len(f.Entities) > 0 {
+		msg = msg.WithEntities(f.Entities...)
+	}
+
+	return msg
+}
+
+func (f formattedText) edit(chatID t.ChatID, messageID int) *t.EditMessageTextParams {
+	return &t.EditMessageTextParams{
+		ChatID:    chatID,
+		MessageID: messageID,
+		Text:      f.Text,
+		ParseMode: f.ParseMode,
+		Entities:  f.Entities,
+	}
+}
+
+// formatReply converts LLM output into messages according to the configured reply format. Replies which don't fit
+// into one Telegram message are split into several parts. The reasoning is added collapsed to the first part if
+// it's enabled in the config.
+func (b *Bot) formatReply(text string, reasoning string) []formattedText {
+	if b.cfg.ReasoningDisplay == config.ReasoningDisplayHidden || b.cfg.ReasoningDisplay == "" {
+		reasoning = ""
+	}
+	if runes := []rune(reasoning); len(runes) > maxShownReasoningLength {
+		reasoning = string(runes[:maxShownReasoningLength]) + "…"
+	}
+	// The reasoning with the separator takes a part of the limit of the first message
+	limit := TelegramCharLimit
+	if reasoning != "" {
+		limit -= len([]rune(reasoning)) + 2
+	}
+
+	if b.cfg.ReplyFormat == config.ReplyFormatEntities {
+		var parts []formattedText
+		for i, part := range b.renderer.Render(text).Split(limit) {
+			if i == 0 && reasoning != "" {
+				part = b.renderReasoning(reasoning).Append(markdown.Rendered{Text: "\n\n"}).Append(part)
+			}
+			parts = append(parts, formattedText{Text: part.Text, Entities: part.Entities})
+		}
+
+		return parts
+	}
+
+	var parts []formattedText
+	for i, part := range markdown.SplitMarkdownV2(b.sanitizer.Sanitize(text), limit) {
+		if i == 0 && reasoning != "" {
+			part = b.reasoningMarkdownV2(reasoning) + "\n\n" + part
+		}
+		parts = append(parts, formattedText{Text: part, ParseMode: t.ModeMarkdownV2})
+	}
+
+	return parts
+}
+
+func (b *Bot) renderReasoning(reasoning string) markdown.Rendered {
+	if b.cfg.ReasoningDisplay == config.ReasoningDisplaySpoiler {
+		return markdown.Wrapped(reasoning, t.EntityTypeSpoiler)
+	}
+
+	return markdown.Wrapped(reasoning, t.EntityTypeExpandableBlockquote)
+}
+
+func (b *Bot) reasoningMarkdownV2(reasoning string) string {
+	escaped := b.sanitizer.EscapeText(reasoning)
+	if b.cfg.ReasoningDisplay == config.ReasoningDisplaySpoiler {
+		return "||" + escaped + "||"
+	}
+
+	return "**>" + strings.ReplaceAll(escaped, "\n", "\n>") + "||"
+}
+
+// summarySource is shown in the footer of a summary: the link to the article or the name of the summarized file.
+// Summaries of messages have no source.
+type summarySource struct {
+	URL      string
+	FileName string
+}
+
+func (s summarySource) plainText() string {
+	if s.URL != "" {
+		return s.URL
+	}
+
+	return s.FileName
+}
+
+// formatSummary converts the summary into a single message with the source in the footer. Summaries which don't fit
+// into one message are cropped.
+func (b *Bot) formatSummary(summary string, source summarySource) formattedText {
+	if b.cfg.ReplyFormat == config.ReplyFormatEntities {
+		var footer markdown.Rendered
+		switch {
+		case source.URL != "":
+			footer = markdown.Rendered{
+				Text:     "\n\nsrc",
+				Entities: []t.MessageEntity{{Type: t.EntityTypeTextLink, Offset: 2, Length: 3, URL: source.URL}},
+			}
+		case source.FileName != "":
+			footer = markdown.Rendered{Text: "\n\n"}.Append(markdown.Wrapped(source.FileName, t.EntityTypeItalic))
+		}
+		body, _ := b.renderer.Render(summary).Crop(TelegramCharLimit - len(footer.Text))
+		rendered := body.Append(footer)
+
+		return formattedText{Text: rendered.Text, Entities: rendered.Entities}
+	}
+
+	footer := ""
+	switch {
+	case source.URL != "":
+		footer = "\n\n[src](" + b.sanitizer.EscapeURL(source.URL) + ")"
+	case source.FileName != "":
+		footer = "\n\n_" + b.sanitizer.EscapeText(source.FileName) + "_"
+	}
+	body := b.sanitizer.Sanitize(summary)
+	cropped, changed := cropToMaxLengthMarkdownV2(body, TelegramCharLimit-len(footer))
+	if changed {
+		cropped = b.sanitizer.Sanitize(cropped)
+	}
+
+	return formattedText{Text: cropped + footer, ParseMode: t.ModeMarkdownV2}
+}
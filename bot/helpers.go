@@ -12,17 +12,23 @@ import (
 	"strings"
 	"time"
 
+	"telegram-ollama-reply-bot/llm"
+
 	"github.com/getsentry/sentry-go"
 	t "github.com/mymmrac/telego"
 	th "github.com/mymmrac/telego/telegohandler"
 	tu "github.com/mymmrac/telego/telegoutil"
 )
 
+// Longer questions about images are cropped to keep recognition requests and cache keys small
+const maxImageQuestionLength = 1000
+
 var (
 	allowedUrlSchemes = []string{"http", "https"}
 
 	ErrImageRecognition = errors.New("image recognition error")
 	ErrRequestTimeout   = errors.New("request timed out")
+	ErrFileTooLarge     = errors.New("file is too large")
 )
 
 func (b *Bot) reply(originalMessage t.Message, newMessage *t.SendMessageParams) *t.SendMessageParams {
@@ -73,6 +79,14 @@ func (b *Bot) runWithTimeout(baseCtx context.Context, chatId t.ChatID, work func
 	ctx, cancel := b.withProcessingDeadline(baseCtx)
 	defer cancel()
 
+	return b.runWithTyping(ctx, chatId, work)
+}
+
+// runWithTyping wraps handler work with typing feedback. Deadlines set by the work itself are reported as timeouts too.
+func (b *Bot) runWithTyping(baseCtx context.Context, chatId t.ChatID, work func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(baseCtx)
+	defer cancel()
+
 	go b.sendTypingUntil(ctx, chatId)
 
 	err := work(ctx)
@@ -115,40 +129,86 @@ func (b *Bot) withProcessingDeadline(baseCtx context.Context) (context.Context,
 	return context.WithCancel(baseCtx)
 }
 
-func (b *Bot) ensureHistoryMessagesImageDescriptions(ctx context.Context, chatID int64) {
-	mh, ok := b.history[chatID]
-	if !ok {
+// ensureMessagesImageDescriptions fills missing image descriptions. Images with keys from skip are not described
+// since they're sent to the chat model as is.
+func (b *Bot) ensureMessagesImageDescriptions(ctx context.Context, chatID int64, messages []MessageData, skip map[string]bool) {
+	for i := range messages {
+		b.ensureMessageImageDescription(ctx, chatID, &messages[i], skip)
+	}
+}
+
+// ensureMessageImageDescription fills missing image descriptions of the message and the message it replies to.
+// Texts of both messages are used as the question about the images.
+func (b *Bot) ensureMessageImageDescription(ctx context.Context, chatID int64, msg *MessageData, skip map[string]bool) {
+	if msg == nil {
 		return
 	}
 
-	for i := range mh.messages {
-		b.ensureMessageImageDescription(ctx, &mh.messages[i])
+	var replyToText string
+	if msg.ReplyTo != nil {
+		replyToText = msg.ReplyTo.Text
+	}
+	b.ensureImageDescription(ctx, chatID, msg, imageQuestion(replyToText, msg.Text), skip)
+
+	if msg.ReplyTo != nil {
+		// ReplyTo may be shared with the history storage, so we work on a copy
+		replyTo := *msg.ReplyTo
+		b.ensureImageDescription(ctx, chatID, &replyTo, imageQuestion(replyTo.Text, msg.Text), skip)
+		msg.ReplyTo = &replyTo
 	}
 }
 
-func (b *Bot) ensureMessageImageDescription(ctx context.Context, msg *MessageData) {
-	if msg == nil {
+func (b *Bot) ensureImageDescription(ctx context.Context, chatID int64, msg *MessageData, question string, skip map[string]bool) {
+	if !msg.HasImage || msg.ImageMeta == nil || msg.Image != "" || skip[msg.ImageMeta.cacheKey()] {
 		return
 	}
 
-	if msg.HasImage && msg.ImageMeta != nil && msg.Image == "" {
-		if desc, ok := b.imageCache.Get(msg.ImageMeta); ok {
-			msg.Image = desc
-		} else {
-			description, err := b.describeImage(ctx, msg.ImageMeta)
-			if err != nil {
-				slog.Error("bot: Failed to describe image", "error", err, "file_id", msg.ImageMeta.FileID)
-				sentry.CaptureException(err)
-			} else {
-				b.imageCache.Set(msg.ImageMeta, description)
-				msg.Image = description
-				slog.Debug("bot: Image described", "file_id", msg.ImageMeta.FileID, "description", description)
-			}
+	if desc, ok := b.imageCache.Get(msg.ImageMeta, question); ok {
+		msg.Image = desc
+		b.saveImageDescriptionToHistory(chatID, msg.ImageMeta, question, desc)
+		return
+	}
+
+	description, err := b.describeImage(llm.WithChatID(ctx, chatID), msg.ImageMeta, question)
+	if err != nil {
+		reportLlmError("bot: Failed to describe image", err, "file_id", msg.ImageMeta.FileID)
+		return
+	}
+
+	b.imageCache.Set(msg.ImageMeta, question, description)
+	msg.Image = description
+	b.saveImageDescriptionToHistory(chatID, msg.ImageMeta, question, description)
+	slog.Debug("bot: Image described", "file_id", msg.ImageMeta.FileID, "question", question, "description", description)
+}
+
+// imageQuestion joins the caption and the reply chain texts which tell what the user wants to know about the image
+func imageQuestion(texts ...string) string {
+	parts := make([]string, 0, len(texts))
+	for _, text := range texts {
+		if text = strings.TrimSpace(text); text != "" {
+			parts = append(parts, text)
 		}
 	}
 
-	if msg.ReplyTo != nil {
-		b.ensureMessageImageDescription(ctx, msg.ReplyTo)
+	question := strings.Join(parts, "\n")
+	if runes := []rune(question); len(runes) > maxImageQuestionLength {
+		question = string(runes[:maxImageQuestionLength]) + "…"
+	}
+
+	return question
+}
+
+// saveImageDescriptionToHistory saves only general descriptions. Answers to a particular question stay in the image
+// cache, since they may miss what later messages ask about.
+func (b *Bot) saveImageDescriptionToHistory(chatID int64, imageMeta *ImageMeta, question string, description string) {
+	if question != "" {
+		return
+	}
+
+	err := b.history.SetImageDescription(chatID, imageMeta.cacheKey(), description)
+	if err != nil {
+		slog.Error("bot:history: cannot save image description", "error", err, "chat", chatID)
+		sentry.CaptureException(err)
 	}
 }
 
@@ -199,6 +259,40 @@ func entityText(text string, entity t.MessageEntity) string {
 	return string(r[start:end])
 }
 
+// messageText returns the text of the message or the caption of its media
+func messageText(message t.Message) (string, []t.MessageEntity) {
+	if message.Text == "" {
+		return message.Caption, message.CaptionEntities
+	}
+
+	return message.Text, message.Entities
+}
+
+// firstLink returns the first link of the message with an allowed scheme. Links without a scheme get HTTPS.
+func firstLink(message t.Message) string {
+	text, entities := messageText(message)
+	for _, e := range entities {
+		var link string
+		switch e.Type {
+		case t.EntityTypeURL:
+			link = entityText(text, e)
+		case t.EntityTypeTextLink:
+			link = e.URL
+		default:
+			continue
+		}
+
+		if !strings.Contains(link, "://") {
+			link = "https://" + link
+		}
+		if u, err := url.ParseRequestURI(link); err == nil && slices.Contains(allowedUrlSchemes, strings.ToLower(u.Scheme)) {
+			return link
+		}
+	}
+
+	return ""
+}
+
 func utf16Index(runes []rune, utf16Pos int) int {
 	count := 0
 	for i, r := range runes {
@@ -310,7 +404,8 @@ func (b *Bot) isFromAdmin(message *t.Message) bool {
 	return slices.Contains(b.cfg.AdminIDs, message.From.ID)
 }
 
-func (b *Bot) describeImage(ctx context.Context, imageMeta *ImageMeta) (string, error) {
+// describeImage recognizes the image focusing on the details needed to answer the question if it's not empty
+func (b *Bot) describeImage(ctx context.Context, imageMeta *ImageMeta, question string) (string, error) {
 	if imageMeta == nil {
 		return "", ErrImageRecognition
 	}
@@ -319,31 +414,53 @@ func (b *Bot) describeImage(ctx context.Context, imageMeta *ImageMeta) (string,
 		ctx = b.ctx
 	}
 
-	file, err := b.api.GetFile(ctx, &t.GetFileParams{FileID: imageMeta.FileID})
+	fileBytes, err := b.downloadImage(ctx, imageMeta)
 	if err != nil {
 		return "", errors.Join(ErrImageRecognition, err)
 	}
 
-	fileBytes, err := downloadFileWithContext(ctx, b.api.FileDownloadURL(file.FilePath))
+	description, usage, err := b.llm.RecognizeImage(ctx, fileBytes, question)
 	if err != nil {
 		return "", errors.Join(ErrImageRecognition, err)
 	}
 
-	description, usage, err := b.llm.RecognizeImage(ctx, fileBytes)
-	if err != nil {
-		return "", errors.Join(ErrImageRecognition, err)
-	}
-
-	if usage != nil {
-		b.stats.AddUsage(usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens, usage.Cost)
-	}
+	b.recordUsage(usage)
 
 	slog.Debug("bot: Image recognized", "file_id", imageMeta.FileID, "description", description)
 
 	return description, nil
 }
 
-func downloadFileWithContext(ctx context.Context, url string) ([]byte, error) {
+// reportLlmError logs the failed LLM request. The unavailable back-end is reported by the LLM connector once when
+// its circuit breaker opens, so such errors are not sent to Sentry for every message.
+func reportLlmError(message string, err error, args ...any) {
+	if errors.Is(err, llm.ErrLlmBackendUnavailable) {
+		slog.Warn(message, append([]any{"error", err}, args...)...)
+
+		return
+	}
+
+	slog.Error(message, append([]any{"error", err}, args...)...)
+	sentry.CaptureException(err)
+}
+
+// recordUsage adds the token usage of an LLM request to the stats
+func (b *Bot) recordUsage(usage *llm.TokenUsage) {
+	if usage == nil {
+		return
+	}
+
+	b.stats.AddUsage(usage.Task, usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens, usage.Cost)
+	if usage.Model != "" {
+		b.stats.ModelRequest(usage.Model)
+	}
+	for _, call := range usage.ToolCalls {
+		b.stats.ToolCall(call.Name, call.Failed)
+	}
+}
+
+// downloadFileWithContext downloads the file reading not more than maxSize bytes. maxSize 0 means no limit.
+func downloadFileWithContext(ctx context.Context, url string, maxSize int64) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
@@ -361,10 +478,18 @@ func downloadFileWithContext(ctx context.Context, url string) ([]byte, error) {
 		return nil, fmt.Errorf("http request failed: %s", resp.Status)
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	var body io.Reader = resp.Body
+	if maxSize > 0 {
+		// One byte over the limit tells the file of exactly the limit size from a bigger one
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+	data, err := io.ReadAll(body)
 	if err != nil {
 		return nil, err
 	}
+	if maxSize > 0 && int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrFileTooLarge, maxSize)
+	}
 
 	return data, nil
 }
@@ -373,13 +498,13 @@ func downloadFileWithContext(ctx context.Context, url string) ([]byte, error) {
 func (b *Bot) getMessageDataFromRequestContextOrCreate(ctx *th.Context, message t.Message, isUserRequest bool) MessageData {
 	if msgData, ok := ctx.Value(requestContextMessageDataKey).(MessageData); ok {
 		msgData.IsUserRequest = isUserRequest
-		b.ensureMessageImageDescription(b.handlerContext(ctx), &msgData)
+		b.ensureMessageImageDescription(b.handlerContext(ctx), message.Chat.ID, &msgData, b.currentImageKeys(msgData))
 		slog.Debug("bot: Message data retrieved from context", "message_data", msgData)
 		return msgData
 	}
 
 	msgData := b.tgUserMessageToMessageData(message, isUserRequest)
-	b.ensureMessageImageDescription(b.handlerContext(ctx), &msgData)
+	b.ensureMessageImageDescription(b.handlerContext(ctx), message.Chat.ID, &msgData, b.currentImageKeys(msgData))
 	slog.Debug("bot: Message data created from message on the fly", "message_data", msgData)
 	return msgData
 }
@@ -1,10 +1,16 @@
 package bot
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"telegram-ollama-reply-bot/markdown"
+
+	tg "github.com/mymmrac/telego"
 )
 
 func TestCropToMaxLengthMarkdownV2_SanitizesAfterCrop(t *testing.T) {
@@ -92,3 +98,82 @@ func TestSanitizeAndCrop_UnclosedFencedCode(t *testing.T) {
 		}
 	}
 }
+
+func TestImageQuestion(t *testing.T) {
+	if question := imageQuestion(" ", ""); question != "" {
+		t.Fatalf("expected empty question, got %q", question)
+	}
+	if question := imageQuestion("Screenshot", "what's the error here?"); question != "Screenshot\nwhat's the error here?" {
+		t.Fatalf("unexpected question: %q", question)
+	}
+	if question := imageQuestion(strings.Repeat("a", maxImageQuestionLength*2)); len([]rune(question)) != maxImageQuestionLength+1 {
+		t.Fatalf("expected question to be cropped, got %d runes", len([]rune(question)))
+	}
+}
+
+func TestImageCache_KeysByQuestion(t *testing.T) {
+	cache := NewImageCache()
+	meta := &ImageMeta{FileID: "file", FileUniqueID: "unique"}
+
+	cache.Set(meta, "", "generic")
+	cache.Set(meta, "what's the error?", "error details")
+
+	if desc, _ := cache.Get(meta, ""); desc != "generic" {
+		t.Fatalf("unexpected generic description: %q", desc)
+	}
+	if desc, _ := cache.Get(meta, "what's the error?"); desc != "error details" {
+		t.Fatalf("unexpected description for the question: %q", desc)
+	}
+	if _, found := cache.Get(meta, "who is this?"); found {
+		t.Fatalf("expected no description for another question")
+	}
+}
+
+func TestFirstLink(t *testing.T) {
+	tests := map[string]struct {
+		message tg.Message
+		want    string
+	}{
+		"url entity after emoji": {
+			message: tg.Message{
+				Text:     "🔥 Read kernel.org/doc now",
+				Entities: []tg.MessageEntity{{Type: tg.EntityTypeURL, Offset: 8, Length: 14}},
+			},
+			want: "https://kernel.org/doc",
+		},
+		"text link in caption": {
+			message: tg.Message{
+				Caption: "Channel post",
+				CaptionEntities: []tg.MessageEntity{
+					{Type: tg.EntityTypeTextLink, Offset: 0, Length: 7, URL: "tg://user?id=1"},
+					{Type: tg.EntityTypeTextLink, Offset: 8, Length: 4, URL: "http://example.com/post"},
+				},
+			},
+			want: "http://example.com/post",
+		},
+		"no links": {
+			message: tg.Message{Text: "Just a long text"},
+			want:    "",
+		},
+	}
+	for name, test := range tests {
+		if got := firstLink(test.message); got != test.want {
+			t.Errorf("%s: expected %q, got %q", name, test.want, got)
+		}
+	}
+}
+
+func TestDownloadFileWithContext_LimitsSize(t *testing.T) {
+	// Telegram may report no file size, so the body itself must be limited
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("a", 100)))
+	}))
+	defer server.Close()
+
+	if data, err := downloadFileWithContext(context.Background(), server.URL, 100); err != nil || len(data) != 100 {
+		t.Fatalf("expected the file of exactly the limit size, got %d bytes and %v", len(data), err)
+	}
+	if _, err := downloadFileWithContext(context.Background(), server.URL, 99); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package bot
+
+import (
+	"errors"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrHistoryStorage = errors.New("history storage error")
+)
+
+// HistoryStore keeps per-chat message history together with the earlier conversation summary.
+type HistoryStore interface {
+	// Push appends a message to the chat history dropping the oldest one when capacity is reached.
+	Push(chatID int64, msg MessageData) error
+	// Messages returns a copy of the chat history from the oldest to the newest message.
+	Messages(chatID int64) ([]MessageData, error)
+	EarlierSummary(chatID int64) (EarlierSummary, error)
+	SetEarlierSummary(chatID int64, summary EarlierSummary) error
+	// SetEarlierSummaryUntil saves the summary of the messages up to the last one inclusive wherever it is now.
+	SetEarlierSummaryUntil(chatID int64, text string, last MessageData) error
+	// SetImageDescription stores the description for every message image with the provided cache key.
+	SetImageDescription(chatID int64, imageKey string, description string) error
+	// AddMemory saves the message embedding dropping the oldest memory of the chat when the limit is reached.
+	AddMemory(chatID int64, memory Memory) error
+	// SearchMemories returns up to limit chat memories most similar to the vector, the most similar first.
+	SearchMemories(chatID int64, vector []float32, limit int) ([]ScoredMemory, error)
+	// Reset removes both the chat history and the memories.
+	Reset(chatID int64) error
+	Close() error
+}
+
+// MemoryHistoryStore is a HistoryStore which keeps everything in memory and loses it on restart.
+type MemoryHistoryStore struct {
+	mu          sync.Mutex
+	capacity    int
+	memoryLimit int
+	chats       map[int64]*MessageHistory
+	memories    map[int64][]Memory
+}
+
+func NewMemoryHistoryStore(capacity int, memoryLimit int) *MemoryHistoryStore {
+	return &MemoryHistoryStore{
+		capacity:    capacity,
+		memoryLimit: memoryLimit,
+		chats:       make(map[int64]*MessageHistory),
+		memories:    make(map[int64][]Memory),
+	}
+}
+
+func (s *MemoryHistoryStore) Push(chatID int64, msg MessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mh, ok := s.chats[chatID]
+	if !ok {
+		mh = NewMessageHistory(s.capacity)
+		s.chats[chatID] = mh
+	}
+
+	mh.Push(msg)
+
+	return nil
+}
+
+func (s *MemoryHistoryStore) Messages(chatID int64) ([]MessageData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mh, ok := s.chats[chatID]
+	if !ok {
+		return make([]MessageData, 0), nil
+	}
+
+	return mh.GetAll(), nil
+}
+
+func (s *MemoryHistoryStore) EarlierSummary(chatID int64) (EarlierSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mh, ok := s.chats[chatID]
+	if !ok {
+		return EarlierSummary{}, nil
+	}
+
+	return mh.EarlierSummary(), nil
+}
+
+func (s *MemoryHistoryStore) SetEarlierSummary(chatID int64, summary EarlierSummary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mh, ok := s.chats[chatID]
+	if !ok {
+		return nil
+	}
+
+	mh.SetEarlierSummary(summary)
+
+	return nil
+}
+
+func (s *MemoryHistoryStore) SetEarlierSummaryUntil(chatID int64, text string, last MessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mh, ok := s.chats[chatID]
+	if !ok {
+		return nil
+	}
+
+	mh.setEarlierSummaryUntil(text, last)
+
+	return nil
+}
+
+func (s *MemoryHistoryStore) SetImageDescription(chatID int64, imageKey string, description string) error {
+	if imageKey == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mh, ok := s.chats[chatID]
+	if !ok {
+		return nil
+	}
+
+	mh.setImageDescription(imageKey, description)
+
+	return nil
+}
+
+func (s *MemoryHistoryStore) AddMemory(chatID int64, memory Memory) error {
+	if s.memoryLimit <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	memories := append(s.memories[chatID], memory)
+	if len(memories) > s.memoryLimit {
+		memories = slices.Delete(memories, 0, len(memories)-s.memoryLimit)
+	}
+	s.memories[chatID] = memories
+
+	return nil
+}
+
+func (s *MemoryHistoryStore) SearchMemories(chatID int64, vector []float32, limit int) ([]ScoredMemory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	top := newTopMemories(vector, limit)
+	for _, memory := range s.memories[chatID] {
+		top.add(memory)
+	}
+
+	return top.result(), nil
+}
+
+func (s *MemoryHistoryStore) Reset(chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chats, chatID)
+	delete(s.memories, chatID)
+
+	return nil
+}
+
+func (s *MemoryHistoryStore) Close() error {
+	return nil
+}
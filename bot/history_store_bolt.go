@@ -0,0 +1,308 @@
+package bot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	historyBucket = []byte("chat_history")
+	// memoryBucket contains a nested bucket of memories for each chat ordered by the time they were added
+	memoryBucket = []byte("chat_memory")
+)
+
+// historyRecord is the serialized form of a chat history in the database
+type historyRecord struct {
+	Messages       []MessageData
+	EarlierSummary EarlierSummary
+}
+
+// BoltHistoryStore is a HistoryStore which persists chat history in a bbolt database file.
+type BoltHistoryStore struct {
+	db          *bolt.DB
+	capacity    int
+	memoryLimit int
+}
+
+func NewBoltHistoryStore(path string, capacity int, memoryLimit int) (*BoltHistoryStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Join(ErrHistoryStorage, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(memoryBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+
+		return nil, errors.Join(ErrHistoryStorage, err)
+	}
+
+	return &BoltHistoryStore{
+		db:          db,
+		capacity:    capacity,
+		memoryLimit: memoryLimit,
+	}, nil
+}
+
+func (s *BoltHistoryStore) Push(chatID int64, msg MessageData) error {
+	return s.update(chatID, func(mh *MessageHistory) {
+		mh.Push(msg)
+	})
+}
+
+func (s *BoltHistoryStore) Messages(chatID int64) ([]MessageData, error) {
+	mh, err := s.view(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	return mh.GetAll(), nil
+}
+
+func (s *BoltHistoryStore) EarlierSummary(chatID int64) (EarlierSummary, error) {
+	mh, err := s.view(chatID)
+	if err != nil {
+		return EarlierSummary{}, err
+	}
+
+	return mh.EarlierSummary(), nil
+}
+
+func (s *BoltHistoryStore) SetEarlierSummary(chatID int64, summary EarlierSummary) error {
+	return s.update(chatID, func(mh *MessageHistory) {
+		mh.SetEarlierSummary(summary)
+	})
+}
+
+func (s *BoltHistoryStore) SetEarlierSummaryUntil(chatID int64, text string, last MessageData) error {
+	return s.update(chatID, func(mh *MessageHistory) {
+		mh.setEarlierSummaryUntil(text, last)
+	})
+}
+
+func (s *BoltHistoryStore) SetImageDescription(chatID int64, imageKey string, description string) error {
+	if imageKey == "" {
+		return nil
+	}
+
+	return s.update(chatID, func(mh *MessageHistory) {
+		mh.setImageDescription(imageKey, description)
+	})
+}
+
+func (s *BoltHistoryStore) AddMemory(chatID int64, memory Memory) error {
+	if s.memoryLimit <= 0 {
+		return nil
+	}
+
+	data, err := encodeMemory(memory)
+	if err != nil {
+		return errors.Join(ErrHistoryStorage, fmt.Errorf("cannot encode memory of chat %d: %w", chatID, err))
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		memories, err := tx.Bucket(memoryBucket).CreateBucketIfNotExists(chatKey(chatID))
+		if err != nil {
+			return err
+		}
+
+		seq, err := memories.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := memories.Put(binary.BigEndian.AppendUint64(nil, seq), data); err != nil {
+			return err
+		}
+
+		// Sequences have no gaps and keys are ordered by them, so the oldest memories are the first ones
+		if seq <= uint64(s.memoryLimit) {
+			return nil
+		}
+		oldest := seq - uint64(s.memoryLimit)
+		var expired [][]byte
+		c := memories.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= oldest; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := memories.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Join(ErrHistoryStorage, err)
+	}
+
+	return nil
+}
+
+func (s *BoltHistoryStore) SearchMemories(chatID int64, vector []float32, limit int) ([]ScoredMemory, error) {
+	top := newTopMemories(vector, limit)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		memories := tx.Bucket(memoryBucket).Bucket(chatKey(chatID))
+		if memories == nil {
+			return nil
+		}
+
+		return memories.ForEach(func(_, data []byte) error {
+			memory, err := decodeMemory(data)
+			if err != nil {
+				return fmt.Errorf("cannot decode memory of chat %d: %w", chatID, err)
+			}
+			top.add(memory)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Join(ErrHistoryStorage, err)
+	}
+
+	return top.result(), nil
+}
+
+func (s *BoltHistoryStore) Reset(chatID int64) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(memoryBucket).DeleteBucket(chatKey(chatID)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+
+		return tx.Bucket(historyBucket).Delete(chatKey(chatID))
+	})
+	if err != nil {
+		return errors.Join(ErrHistoryStorage, err)
+	}
+
+	return nil
+}
+
+func (s *BoltHistoryStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltHistoryStore) view(chatID int64) (*MessageHistory, error) {
+	var mh *MessageHistory
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		mh, err = s.load(tx, chatID)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Join(ErrHistoryStorage, err)
+	}
+
+	return mh, nil
+}
+
+func (s *BoltHistoryStore) update(chatID int64, fn func(mh *MessageHistory)) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		mh, err := s.load(tx, chatID)
+		if err != nil {
+			return err
+		}
+
+		fn(mh)
+
+		data, err := json.Marshal(historyRecord{
+			Messages:       mh.messages,
+			EarlierSummary: mh.earlierSummary,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot encode history of chat %d: %w", chatID, err)
+		}
+
+		return tx.Bucket(historyBucket).Put(chatKey(chatID), data)
+	})
+	if err != nil {
+		return errors.Join(ErrHistoryStorage, err)
+	}
+
+	return nil
+}
+
+func (s *BoltHistoryStore) load(tx *bolt.Tx, chatID int64) (*MessageHistory, error) {
+	mh := NewMessageHistory(s.capacity)
+
+	data := tx.Bucket(historyBucket).Get(chatKey(chatID))
+	if data == nil {
+		return mh, nil
+	}
+
+	var record historyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("cannot decode history of chat %d: %w", chatID, err)
+	}
+
+	mh.earlierSummary = record.EarlierSummary
+	// Pushing one by one keeps the history within capacity if it was lowered since the last run
+	for _, msg := range record.Messages {
+		msg.chatID = chatID
+		mh.Push(msg)
+	}
+
+	return mh, nil
+}
+
+func chatKey(chatID int64) []byte {
+	return []byte(strconv.FormatInt(chatID, 10))
+}
+
+// encodeMemory stores the vector as raw float32 values after the JSON encoded message, so the search doesn't spend
+// time on parsing numbers
+func encodeMemory(memory Memory) ([]byte, error) {
+	message, err := json.Marshal(memory.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, 4+len(message)+4*len(memory.Vector))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(message)))
+	data = append(data, message...)
+	for _, value := range memory.Vector {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(value))
+	}
+
+	return data, nil
+}
+
+func decodeMemory(data []byte) (Memory, error) {
+	if len(data) < 4 {
+		return Memory{}, errors.New("memory record is too short")
+	}
+	messageLen := int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if len(data) < messageLen || (len(data)-messageLen)%4 != 0 {
+		return Memory{}, errors.New("memory record is corrupted")
+	}
+
+	var memory Memory
+	if err := json.Unmarshal(data[:messageLen], &memory.Message); err != nil {
+		return Memory{}, err
+	}
+
+	vectorData := data[messageLen:]
+	memory.Vector = make([]float32, len(vectorData)/4)
+	for i := range memory.Vector {
+		memory.Vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(vectorData[i*4:]))
+	}
+
+	return memory, nil
+}
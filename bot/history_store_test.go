@@ -0,0 +1,135 @@
+package bot
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func testHistoryStore(t *testing.T, s HistoryStore) {
+	const chatID = int64(42)
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err := s.Push(chatID, MessageData{Name: "Alice", Text: text}); err != nil {
+			t.Fatalf("unexpected push error: %v", err)
+		}
+	}
+	if err := s.SetEarlierSummary(chatID, EarlierSummary{Text: "summary", SummarizedUntil: 2}); err != nil {
+		t.Fatalf("unexpected summary error: %v", err)
+	}
+	if err := s.Push(chatID, MessageData{
+		Name:      "Bob",
+		Text:      "look",
+		HasImage:  true,
+		ImageMeta: &ImageMeta{FileID: "file", FileUniqueID: "unique"},
+	}); err != nil {
+		t.Fatalf("unexpected push error: %v", err)
+	}
+
+	messages, err := s.Messages(chatID)
+	if err != nil {
+		t.Fatalf("unexpected messages error: %v", err)
+	}
+	if len(messages) != 3 || messages[0].Text != "two" || messages[2].Text != "look" {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+
+	summary, err := s.EarlierSummary(chatID)
+	if err != nil {
+		t.Fatalf("unexpected summary error: %v", err)
+	}
+	if summary.Text != "summary" || summary.SummarizedUntil != 1 {
+		t.Fatalf("unexpected summary after overflow: %+v", summary)
+	}
+
+	// The summarized part is resolved by the last summarized message, since messages may be pushed meanwhile
+	if err := s.SetEarlierSummaryUntil(chatID, "until three", messages[1]); err != nil {
+		t.Fatalf("unexpected summary error: %v", err)
+	}
+	if summary, _ = s.EarlierSummary(chatID); summary.Text != "until three" || summary.SummarizedUntil != 2 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+	if err := s.SetEarlierSummaryUntil(chatID, "until one", MessageData{Name: "Alice", Text: "one"}); err != nil {
+		t.Fatalf("unexpected summary error: %v", err)
+	}
+	if summary, _ = s.EarlierSummary(chatID); summary.SummarizedUntil != 0 {
+		t.Fatalf("messages pushed out of the history must not be counted: %+v", summary)
+	}
+	_ = s.SetEarlierSummary(chatID, EarlierSummary{Text: "summary", SummarizedUntil: 1})
+
+	if err := s.SetImageDescription(chatID, "unique", "a cat"); err != nil {
+		t.Fatalf("unexpected image description error: %v", err)
+	}
+	messages, _ = s.Messages(chatID)
+	if messages[2].Image != "a cat" {
+		t.Fatalf("image description not saved: %+v", messages[2])
+	}
+
+	for i, vector := range [][]float32{{1, 0}, {0, 1}, {1, 1}} {
+		memory := Memory{Message: MessageData{MessageID: i + 1, Text: "memory"}, Vector: vector}
+		if err := s.AddMemory(chatID, memory); err != nil {
+			t.Fatalf("unexpected memory error: %v", err)
+		}
+	}
+	// The oldest memory is dropped since the limit is 2
+	found, err := s.SearchMemories(chatID, []float32{1, 0}, 5)
+	if err != nil {
+		t.Fatalf("unexpected search error: %v", err)
+	}
+	if len(found) != 2 || found[0].Message.MessageID != 3 || found[1].Message.MessageID != 2 {
+		t.Fatalf("unexpected memories: %+v", found)
+	}
+
+	if err := s.Reset(chatID); err != nil {
+		t.Fatalf("unexpected reset error: %v", err)
+	}
+	messages, _ = s.Messages(chatID)
+	if len(messages) != 0 {
+		t.Fatalf("expected empty history after reset, got %+v", messages)
+	}
+	if found, _ = s.SearchMemories(chatID, []float32{1, 0}, 5); len(found) != 0 {
+		t.Fatalf("expected no memories after reset, got %+v", found)
+	}
+}
+
+func TestMemoryHistoryStore(t *testing.T) {
+	testHistoryStore(t, NewMemoryHistoryStore(3, 2))
+}
+
+func TestBoltHistoryStore(t *testing.T) {
+	s, err := NewBoltHistoryStore(filepath.Join(t.TempDir(), "history.db"), 3, 2)
+	if err != nil {
+		t.Fatalf("cannot open store: %v", err)
+	}
+	defer s.Close()
+
+	testHistoryStore(t, s)
+}
+
+func TestBoltHistoryStore_PersistsBetweenRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+
+	s, err := NewBoltHistoryStore(path, 3, 2)
+	if err != nil {
+		t.Fatalf("cannot open store: %v", err)
+	}
+	_ = s.Push(1, MessageData{Name: "Alice", Text: "hello", ReplyTo: &MessageData{Name: "Bob", Text: "hi"}})
+	_ = s.SetEarlierSummary(1, EarlierSummary{Text: "earlier", SummarizedUntil: 1})
+	if err := s.Close(); err != nil {
+		t.Fatalf("cannot close store: %v", err)
+	}
+
+	s, err = NewBoltHistoryStore(path, 3, 2)
+	if err != nil {
+		t.Fatalf("cannot reopen store: %v", err)
+	}
+	defer s.Close()
+
+	messages, _ := s.Messages(1)
+	if len(messages) != 1 || messages[0].Text != "hello" || messages[0].ReplyTo == nil || messages[0].ReplyTo.Text != "hi" {
+		t.Fatalf("unexpected messages after reopen: %+v", messages)
+	}
+	summary, _ := s.EarlierSummary(1)
+	if summary.Text != "earlier" || summary.SummarizedUntil != 1 {
+		t.Fatalf("unexpected summary after reopen: %+v", summary)
+	}
+}
@@ -1,7 +1,12 @@
 package bot
 
-import "sync"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
 
+// ImageCache keeps image descriptions. The same image asked about with different questions is described separately.
 type ImageCache struct {
 	mu    sync.RWMutex
 	items map[string]string
@@ -11,12 +16,8 @@ func NewImageCache() *ImageCache {
 	return &ImageCache{items: make(map[string]string)}
 }
 
-func (c *ImageCache) Get(imageMeta *ImageMeta) (string, bool) {
-	if imageMeta == nil {
-		return "", false
-	}
-
-	key := imageMeta.cacheKey()
+func (c *ImageCache) Get(imageMeta *ImageMeta, question string) (string, bool) {
+	key := imageDescriptionKey(imageMeta, question)
 	if key == "" {
 		return "", false
 	}
@@ -28,17 +29,72 @@ func (c *ImageCache) Get(imageMeta *ImageMeta) (string, bool) {
 	return desc, ok
 }
 
-func (c *ImageCache) Set(imageMeta *ImageMeta, description string) {
-	if imageMeta == nil {
+func (c *ImageCache) Set(imageMeta *ImageMeta, question, description string) {
+	key := imageDescriptionKey(imageMeta, question)
+	if key == "" {
 		return
 	}
 
+	c.mu.Lock()
+	c.items[key] = description
+	c.mu.Unlock()
+}
+
+func imageDescriptionKey(imageMeta *ImageMeta, question string) string {
 	key := imageMeta.cacheKey()
+	if key == "" || question == "" {
+		return key
+	}
+
+	hash := sha256.Sum256([]byte(question))
+
+	return key + ":" + hex.EncodeToString(hash[:8])
+}
+
+// Telegram photos are up to a few hundred kilobytes, so the cache takes up to a few dozen megabytes
+const imageDataCacheSize = 64
+
+// imageDataCache keeps contents of recently used images. The oldest images are evicted first.
+type imageDataCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string][]byte
+	order    []string
+}
+
+func newImageDataCache(capacity int) *imageDataCache {
+	return &imageDataCache{
+		capacity: capacity,
+		items:    make(map[string][]byte, capacity),
+	}
+}
+
+func (c *imageDataCache) get(key string) ([]byte, bool) {
 	if key == "" {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.items[key]
+	return data, ok
+}
+
+func (c *imageDataCache) set(key string, data []byte) {
+	if key == "" || c.capacity <= 0 {
 		return
 	}
 
 	c.mu.Lock()
-	c.items[key] = description
-	c.mu.Unlock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.items[key]; !ok {
+		if len(c.order) >= c.capacity {
+			delete(c.items, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.items[key] = data
 }
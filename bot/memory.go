@@ -0,0 +1,187 @@
+package bot
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+
+	"telegram-ollama-reply-bot/llm"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Messages shorter than this carry too little meaning to be found by the semantic search
+const minMemoryTextLength = 10
+
+// Memory is a chat message with the embedding vector of its text
+type Memory struct {
+	Message MessageData
+	Vector  []float32
+}
+
+// ScoredMemory is a memory found by the semantic search with its cosine similarity to the query
+type ScoredMemory struct {
+	Memory
+	Similarity float32
+}
+
+// topMemories keeps the memories most similar to the query
+type topMemories struct {
+	query  []float32
+	limit  int
+	scored []ScoredMemory
+}
+
+func newTopMemories(query []float32, limit int) *topMemories {
+	return &topMemories{query: query, limit: limit}
+}
+
+func (t *topMemories) add(memory Memory) {
+	if t.limit <= 0 {
+		return
+	}
+
+	t.scored = append(t.scored, ScoredMemory{Memory: memory, Similarity: cosineSimilarity(t.query, memory.Vector)})
+	if len(t.scored) > t.limit*2 {
+		t.trim()
+	}
+}
+
+func (t *topMemories) trim() {
+	slices.SortStableFunc(t.scored, func(a, b ScoredMemory) int {
+		switch {
+		case a.Similarity > b.Similarity:
+			return -1
+		case a.Similarity < b.Similarity:
+			return 1
+		default:
+			return 0
+		}
+	})
+	if len(t.scored) > t.limit {
+		t.scored = t.scored[:t.limit]
+	}
+}
+
+// result returns the most similar memories, the most similar first
+func (t *topMemories) result() []ScoredMemory {
+	t.trim()
+
+	return t.scored
+}
+
+// cosineSimilarity returns 0 for vectors of different dimensions, e.g. produced by another model
+func cosineSimilarity(a, b []float32) float32 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return float32(dot / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
+
+func (b *Bot) memoryEnabled() bool {
+	return b.cfg.MemoryTopK > 0 && b.llm.HasEmbeddings()
+}
+
+// rememberMessage saves the message embedding for the semantic search over the whole chat history. Messages of chats
+// reset after the message was queued are skipped.
+func (b *Bot) rememberMessage(job memoryJob) {
+	msg := job.msg
+	if !b.memory.isCurrent(job) {
+		return
+	}
+
+	text := presentMessage(msg)
+	if len([]rune(strings.TrimSpace(msg.Text+msg.Image))) < minMemoryTextLength {
+		return
+	}
+
+	ctx, cancel := b.withProcessingDeadline(llm.WithChatID(b.ctx, msg.chatID))
+	defer cancel()
+
+	vectors, usage, err := b.llm.Embed(ctx, []string{text})
+	if err != nil {
+		reportLlmError("bot:memory: cannot embed message", err, "chat", msg.chatID)
+
+		return
+	}
+	b.recordUsage(usage)
+
+	// The quoted message is remembered on its own, so only its ID is kept
+	if msg.ReplyTo != nil {
+		msg.ReplyTo = &MessageData{MessageID: msg.ReplyTo.MessageID}
+	}
+
+	err = b.memory.save(job, func() error {
+		return b.history.AddMemory(msg.chatID, Memory{Message: msg, Vector: vectors[0]})
+	})
+	if err != nil {
+		slog.Error("bot:memory: cannot save memory", "error", err, "chat", msg.chatID)
+		sentry.CaptureException(err)
+	}
+}
+
+// recallMemories returns older messages of the chat which are semantically close to the request. Messages which are
+// still in the history are skipped. The result is in chronological order.
+func (b *Bot) recallMemories(ctx context.Context, chatID int64, current MessageData, history []MessageData) []MessageData {
+	query := current.Text
+	if current.ReplyTo != nil {
+		query = current.ReplyTo.Text + "\n" + query
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil
+	}
+
+	vectors, usage, err := b.llm.Embed(llm.WithChatID(ctx, chatID), []string{query})
+	if err != nil {
+		reportLlmError("bot:memory: cannot embed request", err, "chat", chatID)
+
+		return nil
+	}
+	b.recordUsage(usage)
+
+	inHistory := make(map[int]bool, len(history))
+	for _, msg := range history {
+		inHistory[msg.MessageID] = true
+	}
+
+	// Recent messages are likely to be found too, so more candidates are requested
+	found, err := b.history.SearchMemories(chatID, vectors[0], b.cfg.MemoryTopK+len(history))
+	if err != nil {
+		slog.Error("bot:memory: cannot search memories", "error", err, "chat", chatID)
+		sentry.CaptureException(err)
+
+		return nil
+	}
+
+	var memories []MessageData
+	for _, memory := range found {
+		if len(memories) >= b.cfg.MemoryTopK || memory.Similarity < b.cfg.MemoryMinSimilarity {
+			break
+		}
+		if memory.Message.MessageID != 0 && inHistory[memory.Message.MessageID] {
+			continue
+		}
+		memories = append(memories, memory.Message)
+	}
+
+	slices.SortStableFunc(memories, func(a, b MessageData) int {
+		return a.Date.Compare(b.Date)
+	})
+
+	slog.Debug("bot:memory: relevant memories recalled", "chat", chatID, "count", len(memories))
+
+	return memories
+}
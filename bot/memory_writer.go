@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"log/slog"
+	"sync"
+)
+
+const (
+	memoryWorkers   = 2
+	memoryQueueSize = 256
+)
+
+// memoryWriter embeds and saves chat messages in the background with a bounded number of workers. Each chat has an
+// epoch which is increased on reset, so messages queued before the reset are not saved after it. Embedding requests
+// don't take places in the LLM request queue, the number of workers limits their load instead.
+type memoryWriter struct {
+	mu     sync.Mutex
+	jobs   chan memoryJob
+	epochs map[int64]uint64
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type memoryJob struct {
+	msg   MessageData
+	epoch uint64
+}
+
+func newMemoryWriter(queueSize int) *memoryWriter {
+	return &memoryWriter{
+		jobs:   make(chan memoryJob, queueSize),
+		epochs: make(map[int64]uint64),
+	}
+}
+
+// start runs workers which call remember for each queued message
+func (w *memoryWriter) start(workers int, remember func(job memoryJob)) {
+	for range workers {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for job := range w.jobs {
+				remember(job)
+			}
+		}()
+	}
+}
+
+// enqueue queues the message without blocking. The message is dropped when the queue is full or closed.
+func (w *memoryWriter) enqueue(msg MessageData) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.jobs <- memoryJob{msg: msg, epoch: w.epochs[msg.chatID]}:
+	default:
+		slog.Warn("bot:memory: Queue is full, message is not remembered", "chat", msg.chatID, "message_id", msg.MessageID)
+	}
+}
+
+// isCurrent reports whether the chat wasn't reset since the job was queued
+func (w *memoryWriter) isCurrent(job memoryJob) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.epochs[job.msg.chatID] == job.epoch
+}
+
+// save calls save if the chat wasn't reset since the job was queued. Resets wait for it to finish.
+func (w *memoryWriter) save(job memoryJob, save func() error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.epochs[job.msg.chatID] != job.epoch {
+		return nil
+	}
+
+	return save()
+}
+
+// reset invalidates queued messages of the chat and calls reset
+func (w *memoryWriter) reset(chatID int64, reset func() error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.epochs[chatID]++
+
+	return reset()
+}
+
+// close stops accepting messages and waits for the queued ones to be saved
+func (w *memoryWriter) close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.jobs)
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
@@ -0,0 +1,36 @@
+package bot
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMemoryWriter_ResetInvalidatesQueuedMessages(t *testing.T) {
+	w := newMemoryWriter(10)
+	w.enqueue(MessageData{MessageID: 1, chatID: 1})
+	w.enqueue(MessageData{MessageID: 2, chatID: 2})
+	if err := w.reset(1, func() error { return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.enqueue(MessageData{MessageID: 3, chatID: 1})
+
+	var mu sync.Mutex
+	var saved []int
+	w.start(memoryWorkers, func(job memoryJob) {
+		_ = w.save(job, func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			saved = append(saved, job.msg.MessageID)
+
+			return nil
+		})
+	})
+	w.close()
+
+	if len(saved) != 2 || saved[0] == 1 || saved[1] == 1 {
+		t.Fatalf("expected messages 2 and 3 to be saved, got %v", saved)
+	}
+
+	// Messages queued after the shutdown are dropped
+	w.enqueue(MessageData{MessageID: 4, chatID: 1})
+}
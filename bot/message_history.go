@@ -3,12 +3,19 @@ package bot
 import (
 	"log/slog"
 	"strings"
+	"sync"
+	"time"
+
+	"telegram-ollama-reply-bot/llm"
 
 	"github.com/getsentry/sentry-go"
 	t "github.com/mymmrac/telego"
 )
 
 type MessageData struct {
+	MessageID int
+	// PartIDs are IDs of the following messages of a reply split into several parts
+	PartIDs       []int
 	Name          string
 	Username      string
 	Text          string
@@ -18,7 +25,9 @@ type MessageData struct {
 	HasImage      bool
 	Image         string
 	ImageMeta     *ImageMeta
-	chatID        int64
+	// Date is the time the message was sent
+	Date   time.Time
+	chatID int64
 }
 
 type ImageMeta struct {
@@ -71,30 +80,75 @@ func (b *MessageHistory) Push(element MessageData) {
 	b.messages = append(b.messages, element)
 }
 
+// GetAll returns a copy of the stored messages so callers can't mutate the history.
 func (b *MessageHistory) GetAll() []MessageData {
-	return b.messages
+	result := make([]MessageData, len(b.messages))
+	copy(result, b.messages)
+
+	return result
 }
 
-func (b *MessageHistory) EarlierSummary() string {
-	return b.earlierSummary.Text
+func (b *MessageHistory) EarlierSummary() EarlierSummary {
+	return b.earlierSummary
 }
 
-func (b *MessageHistory) SetEarlierSummary(sum string) {
-	b.earlierSummary.Text = sum
+func (b *MessageHistory) SetEarlierSummary(sum EarlierSummary) {
+	b.earlierSummary = sum
 }
 
-func (b *Bot) saveChatMessageToHistory(msgData MessageData) {
-	chatId := msgData.chatID
+// setEarlierSummaryUntil saves the summary of the messages up to the last one inclusive. Messages may be pushed while
+// the summary is made, so the last message is looked up in the current history. If it's gone, all messages left are
+// newer than the summary.
+func (b *MessageHistory) setEarlierSummaryUntil(text string, last MessageData) {
+	until := 0
+	for i := len(b.messages) - 1; i >= 0; i-- {
+		msg := b.messages[i]
+		if msg.MessageID == last.MessageID && msg.IsMe == last.IsMe && msg.Date.Equal(last.Date) && msg.Text == last.Text {
+			until = i + 1
+			break
+		}
+	}
+
+	b.earlierSummary = EarlierSummary{Text: text, SummarizedUntil: until}
+}
 
-	_, ok := b.history[chatId]
-	if !ok {
-		b.history[chatId] = NewMessageHistory(b.cfg.HistoryLength)
+// setImageDescription fills the description of every not yet described image with
+// the provided cache key including images in replied-to messages.
+func (b *MessageHistory) setImageDescription(imageKey string, description string) {
+	for i := range b.messages {
+		setMessageImageDescription(&b.messages[i], imageKey, description)
+	}
+}
+
+func setMessageImageDescription(msg *MessageData, imageKey string, description string) {
+	if msg.HasImage && msg.Image == "" && msg.ImageMeta.cacheKey() == imageKey {
+		msg.Image = description
 	}
 
-	b.history[chatId].Push(msgData)
+	if msg.ReplyTo != nil {
+		// ReplyTo may be shared with a copy returned earlier, so we replace it instead of mutating
+		replyTo := *msg.ReplyTo
+		setMessageImageDescription(&replyTo, imageKey, description)
+		msg.ReplyTo = &replyTo
+	}
 }
 
-func (b *Bot) saveBotReplyToHistory(replyTo t.Message, text string) {
+func (b *Bot) saveChatMessageToHistory(msgData MessageData) {
+	err := b.history.Push(msgData.chatID, msgData)
+	if err != nil {
+		slog.Error("bot:history: cannot save message", "error", err, "chat", msgData.chatID)
+		sentry.CaptureException(err)
+	}
+
+	if b.memoryEnabled() {
+		// Embedding takes time, so the handler doesn't wait for it
+		b.memory.enqueue(msgData)
+	}
+}
+
+// saveBotReplyToHistory saves the bot reply. messageIDs are IDs of the delivered messages of the reply, empty if the
+// reply wasn't delivered.
+func (b *Bot) saveBotReplyToHistory(replyTo t.Message, messageIDs []int, text string) {
 	chatId := replyTo.Chat.ID
 
 	slog.Info(
@@ -105,11 +159,6 @@ func (b *Bot) saveBotReplyToHistory(replyTo t.Message, text string) {
 		"text", text,
 	)
 
-	_, ok := b.history[chatId]
-	if !ok {
-		b.history[chatId] = NewMessageHistory(b.cfg.HistoryLength)
-	}
-
 	botName := strings.TrimSpace(b.me.FirstName + " " + b.me.LastName)
 	if botName == "" {
 		botName = b.me.Username
@@ -121,25 +170,33 @@ func (b *Bot) saveBotReplyToHistory(replyTo t.Message, text string) {
 		Username: botUsername,
 		Text:     text,
 		IsMe:     true,
+		Date:     time.Now(),
+		chatID:   chatId,
+	}
+	if len(messageIDs) > 0 {
+		msgData.MessageID = messageIDs[0]
+		msgData.PartIDs = messageIDs[1:]
 	}
 
 	if replyTo.ReplyToMessage != nil {
 		replyMessage := replyTo.ReplyToMessage
 
 		msgData.ReplyTo = &MessageData{
-			Name:     replyMessage.From.FirstName,
-			Username: replyMessage.From.Username,
-			Text:     replyMessage.Text,
-			IsMe:     false,
-			ReplyTo:  nil,
+			MessageID: replyMessage.MessageID,
+			Name:      replyMessage.From.FirstName,
+			Username:  replyMessage.From.Username,
+			Text:      replyMessage.Text,
+			IsMe:      false,
+			ReplyTo:   nil,
 		}
 	}
 
-	b.history[chatId].Push(msgData)
+	b.saveChatMessageToHistory(msgData)
 }
 
 func (b *Bot) tgUserMessageToMessageData(message t.Message, isUserRequest bool) MessageData {
 	msgData := MessageData{
+		MessageID:     message.MessageID,
 		Name:          message.From.FirstName,
 		Username:      message.From.Username,
 		Text:          message.Text,
@@ -147,6 +204,7 @@ func (b *Bot) tgUserMessageToMessageData(message t.Message, isUserRequest bool)
 		IsUserRequest: isUserRequest,
 		HasImage:      false,
 		Image:         "",
+		Date:          time.Unix(message.Date, 0),
 		chatID:        message.Chat.ID,
 	}
 
@@ -173,100 +231,130 @@ func (b *Bot) tgUserMessageToMessageData(message t.Message, isUserRequest bool)
 }
 
 func (b *Bot) getChatHistory(chatId int64) []MessageData {
-	_, ok := b.history[chatId]
-	if !ok {
-		slog.Debug("bot: Chat ID not found in history", "chat_id", chatId)
+	messages, err := b.history.Messages(chatId)
+	if err != nil {
+		slog.Error("bot:history: cannot load chat history", "error", err, "chat", chatId)
+		sentry.CaptureException(err)
 
 		return make([]MessageData, 0)
 	}
 
-	return b.history[chatId].GetAll()
+	return messages
 }
 
-func (b *Bot) ResetChatHistory(chatId int64) {
-	_, ok := b.history[chatId]
-	if !ok {
-		slog.Debug("bot: Chat ID not found in history", "chat_id", chatId)
-		return
+func (b *Bot) getEarlierSummary(chatId int64) EarlierSummary {
+	summary, err := b.history.EarlierSummary(chatId)
+	if err != nil {
+		slog.Error("bot:history: cannot load earlier summary", "error", err, "chat", chatId)
+		sentry.CaptureException(err)
+
+		return EarlierSummary{}
 	}
 
-	slog.Info("bot: Resetting chat history", "chat_id", chatId)
-	b.history[chatId] = NewMessageHistory(b.cfg.HistoryLength)
+	return summary
 }
 
-func (b *Bot) maybeSummarizeHistory(chatId int64) {
-	mh, ok := b.history[chatId]
-	if !ok {
-		return
+func (b *Bot) ResetChatHistory(chatId int64) {
+	slog.Info("bot: Resetting chat history", "chat_id", chatId)
+
+	// Memories of messages queued before the reset must not reappear after it
+	err := b.memory.reset(chatId, func() error {
+		return b.history.Reset(chatId)
+	})
+	if err != nil {
+		slog.Error("bot:history: cannot reset chat history", "error", err, "chat", chatId)
+		sentry.CaptureException(err)
 	}
+}
 
+// maybeSummarizeHistory merges older messages into the earlier summary. It may run while new messages are pushed, so
+// only one summarization of the chat runs at a time and the summarized part is resolved when the summary is saved.
+func (b *Bot) maybeSummarizeHistory(chatId int64) {
 	limit := b.cfg.UncompressedHistoryLimit
 	threshold := b.cfg.HistorySummaryThreshold
 	if limit <= 0 {
 		return
 	}
 
-	historyLen := len(mh.messages)
-	unsummarized := historyLen - mh.earlierSummary.SummarizedUntil
+	if !b.compacting.add(chatId) {
+		return
+	}
+	defer b.compacting.remove(chatId)
+
+	messages := b.getChatHistory(chatId)
+	earlierSummary := b.getEarlierSummary(chatId)
+
+	historyLen := len(messages)
+	unsummarized := historyLen - earlierSummary.SummarizedUntil
 	if unsummarized <= limit+threshold {
 		return
 	}
 
 	end := historyLen - limit
-	start := mh.earlierSummary.SummarizedUntil
+	start := earlierSummary.SummarizedUntil
 	if start >= end {
 		return
 	}
-	slice := mh.messages[start:end]
+	slice := messages[start:end]
 	if len(slice) == 0 {
-		mh.earlierSummary.SummarizedUntil = end
+		b.setEarlierSummary(chatId, EarlierSummary{Text: earlierSummary.Text, SummarizedUntil: end})
 		return
 	}
 
-	ctx, cancel := b.withProcessingDeadline(b.ctx)
+	ctx, cancel := b.withProcessingDeadline(llm.WithChatID(b.ctx, chatId))
 	defer cancel()
 
-	b.ensureHistoryMessagesImageDescriptions(ctx, chatId)
-
-	text := historyToPlainText(slice)
+	b.ensureMessagesImageDescriptions(ctx, chatId, slice, nil)
 
-	if mh.earlierSummary.Text != "" {
-		// TODO: introduce a dedicated llm method for history summarization
-		// that provides a consistent presentation for earlier and recent messages
-		text = "Earlier conversation summary:\n" + mh.earlierSummary.Text + "\n\nRecent messages:\n" + text
+	summary, usage, err := b.llm.SummarizeHistory(ctx, earlierSummary.Text, historyToLlmMessages(slice))
+	if err != nil {
+		reportLlmError("bot: failed to summarize history", err, "chat", chatId)
+		return
 	}
+	b.recordUsage(usage)
 
-	summary, usage, err := b.llm.Summarize(ctx, text, "")
+	err = b.history.SetEarlierSummaryUntil(chatId, summary, slice[len(slice)-1])
 	if err != nil {
-		slog.Error("bot: failed to summarize history", "error", err, "chat", chatId)
+		slog.Error("bot:history: cannot save earlier summary", "error", err, "chat", chatId)
 		sentry.CaptureException(err)
-		return
-	}
-	if usage != nil {
-		b.stats.AddUsage(usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens, usage.Cost)
 	}
-	mh.SetEarlierSummary(summary)
-	mh.earlierSummary.SummarizedUntil = end
 }
 
-func historyToPlainText(history []MessageData) string {
-	var sb strings.Builder
-	for _, msg := range history {
-		sb.WriteString(messageDataToPlainText(msg))
-		sb.WriteString("\n")
+// chatSet is a set of chats safe for concurrent use
+type chatSet struct {
+	mu    sync.Mutex
+	chats map[int64]bool
+}
+
+// add returns false if the chat is already in the set
+func (s *chatSet) add(chatID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chats[chatID] {
+		return false
+	}
+	if s.chats == nil {
+		s.chats = make(map[int64]bool)
 	}
-	return sb.String()
+	s.chats[chatID] = true
+
+	return true
 }
 
-func messageDataToPlainText(msg MessageData) string {
-	var sb strings.Builder
-	if msg.ReplyTo != nil {
-		sb.WriteString("> ")
-		sb.WriteString(messageDataToPlainText(*msg.ReplyTo))
-		sb.WriteString("\n")
+func (s *chatSet) remove(chatID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chats, chatID)
+}
+
+func (b *Bot) setEarlierSummary(chatId int64, summary EarlierSummary) {
+	err := b.history.SetEarlierSummary(chatId, summary)
+	if err != nil {
+		slog.Error("bot:history: cannot save earlier summary", "error", err, "chat", chatId)
+		sentry.CaptureException(err)
 	}
-	sb.WriteString(presentMessage(msg))
-	return sb.String()
 }
 
 func presentMessage(msg MessageData) string {
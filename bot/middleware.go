@@ -1,7 +1,9 @@
 package bot
 
 import (
+	"context"
 	"log/slog"
+	"sync"
 
 	t "github.com/mymmrac/telego"
 	th "github.com/mymmrac/telego/telegohandler"
@@ -10,6 +12,31 @@ import (
 // requestContextMessageDataKey is the context key for storing processed message data in request context
 const requestContextMessageDataKey = "message_data"
 
+// requestContextChatTurnKey is the context key for the function which gives the chat turn to the next update
+const requestContextChatTurnKey = "chat_turn_release"
+
+// chatSerializer makes updates of the same chat to be processed one at a time in the order they were received.
+// Handlers may give the turn to the next update earlier with releaseChatTurn.
+func (b *Bot) chatSerializer(ctx *th.Context, update t.Update) error {
+	release, err := b.sequencer.wait(ctx, update.UpdateID)
+	if err != nil {
+		slog.Error("bot:middleware:sequencer: update dropped while waiting for its turn", "update_id", update.UpdateID, "error", err)
+		return nil
+	}
+	release = sync.OnceFunc(release)
+	defer release()
+
+	return ctx.WithValue(requestContextChatTurnKey, release).Next(update)
+}
+
+// releaseChatTurn lets the next update of the chat be processed while the current one is still running. It must be
+// called only after the message is saved to the history.
+func releaseChatTurn(ctx context.Context) {
+	if release, ok := ctx.Value(requestContextChatTurnKey).(func()); ok {
+		release()
+	}
+}
+
 func (b *Bot) chatTypeStatsCounter(ctx *th.Context, update t.Update) error {
 	message := update.Message
 
@@ -14,7 +14,9 @@ func (b *Bot) commandForThisBot() th.Predicate {
 			return false
 		}
 
-		matches := th.CommandRegexp.FindStringSubmatch(update.Message.Text)
+		// Commands may be sent in captions of media
+		text, _ := messageText(*update.Message)
+		matches := th.CommandRegexp.FindStringSubmatch(text)
 		if len(matches) != th.CommandMatchGroupsLen {
 			return false
 		}
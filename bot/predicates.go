@@ -2,6 +2,7 @@ package bot
 
 import (
 	"context"
+	"strings"
 
 	t "github.com/mymmrac/telego"
 	th "github.com/mymmrac/telego/telegohandler"
@@ -17,3 +18,21 @@ func AnyMessageWithPhoto() th.Predicate {
 		return len(update.Message.Photo) > 0
 	}
 }
+
+// CommandInTextOrCaptionEqual returns a predicate that matches the command in the message text or in the caption of
+// its media, e.g. a document sent with the command
+func CommandInTextOrCaptionEqual(command string) th.Predicate {
+	return func(ctx context.Context, update t.Update) bool {
+		if update.Message == nil {
+			return false
+		}
+
+		text, _ := messageText(*update.Message)
+		matches := th.CommandRegexp.FindStringSubmatch(text)
+		if len(matches) != th.CommandMatchGroupsLen {
+			return false
+		}
+
+		return strings.EqualFold(matches[th.CommandMatchCmdGroup], command)
+	}
+}
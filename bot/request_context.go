@@ -19,8 +19,6 @@ func (b *Bot) createLlmRequestContextFromMessage(ctx context.Context, message t.
 		ctx = b.ctx
 	}
 
-	b.ensureHistoryMessagesImageDescriptions(ctx, message.Chat.ID)
-
 	user := message.From
 
 	if user != nil {
@@ -36,18 +34,36 @@ func (b *Bot) createLlmRequestContextFromMessage(ctx context.Context, message t.
 	chat := message.Chat
 
 	history := b.getChatHistory(chat.ID)
-	earlierSummary := ""
-	if mh, ok := b.history[chat.ID]; ok {
-		earlierSummary = mh.EarlierSummary()
+	current := b.tgUserMessageToMessageData(message, true)
+	historyImageKeys := b.historyImageKeys(current, history)
+	// Images sent as is don't need descriptions, including the request ones which are in the history too.
+	// If such an image can't be downloaded, attachImages describes it instead.
+	skipDescription := b.currentImageKeys(current)
+	for key := range historyImageKeys {
+		skipDescription[key] = true
+	}
+	b.ensureMessagesImageDescriptions(ctx, chat.ID, history, skipDescription)
+	earlierSummary := b.getEarlierSummary(chat.ID).Text
+
+	llmHistory := historyToLlmMessages(history)
+	for i := range history {
+		b.attachImages(ctx, chat.ID, &llmHistory[i], history[i], historyImageKeys)
+	}
+
+	var memories []llm.ChatMessage
+	if b.memoryEnabled() {
+		memories = historyToLlmMessages(b.recallMemories(ctx, chat.ID, current, history))
 	}
 
 	rc.Chat = llm.ChatContext{
+		ID:    chat.ID,
 		Title: chat.Title,
 		// TODO: fill when ChatFullInfo retrieved
 		//Description: chat.Description,
-		Type:           chat.Type,
-		History:        historyToLlmMessages(history),
-		EarlierSummary: earlierSummary,
+		Type:             chat.Type,
+		History:          llmHistory,
+		EarlierSummary:   earlierSummary,
+		RelevantMemories: memories,
 	}
 
 	slog.Debug("bot: request context created", "request-context", rc)
@@ -73,6 +89,8 @@ func historyToLlmMessages(history []MessageData) []llm.ChatMessage {
 
 func messageDataToLlmMessage(data MessageData) llm.ChatMessage {
 	llmMessage := llm.ChatMessage{
+		MessageID:     data.MessageID,
+		PartIDs:       data.PartIDs,
 		Name:          data.Name,
 		Username:      data.Username,
 		Text:          data.Text,
@@ -80,6 +98,7 @@ func messageDataToLlmMessage(data MessageData) llm.ChatMessage {
 		IsUserRequest: data.IsUserRequest,
 		HasImage:      data.HasImage,
 		Image:         data.Image,
+		Date:          data.Date,
 	}
 
 	if data.ReplyTo != nil {
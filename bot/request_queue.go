@@ -0,0 +1,270 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	t "github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const queuePositionMessage = "The bot is busy with other requests. You're #%d in line."
+
+// requestQueue limits the number of concurrent LLM requests. Waiting requests are served round robin across chats,
+// so one busy chat can't hold the back-end for everyone. Priority requests are served before the rest. Requests of
+// the same chat run one at a time in the order they were queued, so each of them sees the replies to the earlier ones.
+type requestQueue struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	// active contains chats with a running request
+	active map[int64]bool
+	// waiting contains requests of each chat in the order they were queued
+	waiting map[queueKey][]*queuedRequest
+	// order contains chats with waiting requests in the round robin order for each priority class
+	order map[bool][]queueKey
+}
+
+type queueKey struct {
+	chatID   int64
+	priority bool
+}
+
+type queuedRequest struct {
+	key   queueKey
+	ready chan struct{}
+	// position receives the latest place of the request in the queue starting from 1
+	position chan int
+	lastSent int
+}
+
+func newRequestQueue(limit int) *requestQueue {
+	return &requestQueue{
+		limit:   limit,
+		active:  make(map[int64]bool),
+		waiting: make(map[queueKey][]*queuedRequest),
+		order:   make(map[bool][]queueKey),
+	}
+}
+
+// acquire waits for a free slot and returns the function which frees it. onPosition is called from the calling
+// goroutine each time the place of the request in the queue changes. The queue is disabled when the limit is not
+// positive.
+func (q *requestQueue) acquire(ctx context.Context, chatID int64, priority bool, onPosition func(position int)) (func(), error) {
+	if q.limit <= 0 {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 && !q.active[chatID] {
+		q.running++
+		q.active[chatID] = true
+		q.mu.Unlock()
+
+		return q.releaseFunc(chatID), nil
+	}
+
+	key := queueKey{chatID: chatID, priority: priority}
+	// A request joins the line of the chat whatever its priority is, so the chat order is kept
+	if other := (queueKey{chatID: chatID, priority: !priority}); len(q.waiting[other]) > 0 {
+		key = other
+	}
+	req := &queuedRequest{
+		key:      key,
+		ready:    make(chan struct{}),
+		position: make(chan int, 1),
+	}
+	if len(q.waiting[req.key]) == 0 {
+		q.order[priority] = append(q.order[priority], req.key)
+	}
+	q.waiting[req.key] = append(q.waiting[req.key], req)
+	q.notifyPositions()
+	q.mu.Unlock()
+
+	for {
+		select {
+		case <-req.ready:
+			return q.releaseFunc(chatID), nil
+		case position := <-req.position:
+			if onPosition != nil {
+				onPosition(position)
+			}
+		case <-ctx.Done():
+			q.mu.Lock()
+			select {
+			case <-req.ready:
+				// The slot was given to the request at the same time, so it's passed to the next one
+				q.mu.Unlock()
+				q.releaseFunc(chatID)()
+			default:
+				q.remove(req)
+				q.notifyPositions()
+				q.mu.Unlock()
+			}
+
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *requestQueue) releaseFunc(chatID int64) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			q.running--
+			delete(q.active, chatID)
+			q.dispatch()
+		})
+	}
+}
+
+// dispatch starts waiting requests while there are free slots. Chats with a running request are skipped.
+func (q *requestQueue) dispatch() {
+	for q.running < q.limit {
+		key, ok := q.next()
+		if !ok {
+			break
+		}
+
+		requests := q.waiting[key]
+		req := requests[0]
+		if len(requests) > 1 {
+			q.waiting[key] = requests[1:]
+			// The chat goes to the end of the line with the rest of its requests
+			q.order[key.priority] = append(q.order[key.priority], key)
+		} else {
+			delete(q.waiting, key)
+		}
+
+		q.running++
+		q.active[key.chatID] = true
+		close(req.ready)
+	}
+
+	q.notifyPositions()
+}
+
+// next removes the first chat without a running request from the round robin order
+func (q *requestQueue) next() (queueKey, bool) {
+	for _, priority := range []bool{true, false} {
+		for i, key := range q.order[priority] {
+			if q.active[key.chatID] {
+				continue
+			}
+			q.order[priority] = slices.Delete(q.order[priority], i, i+1)
+
+			return key, true
+		}
+	}
+
+	return queueKey{}, false
+}
+
+func (q *requestQueue) remove(req *queuedRequest) {
+	requests := slices.DeleteFunc(q.waiting[req.key], func(r *queuedRequest) bool {
+		return r == req
+	})
+	if len(requests) > 0 {
+		q.waiting[req.key] = requests
+
+		return
+	}
+
+	delete(q.waiting, req.key)
+	q.order[req.key.priority] = slices.DeleteFunc(q.order[req.key.priority], func(key queueKey) bool {
+		return key == req.key
+	})
+}
+
+// notifyPositions sends new places in the queue to the waiting requests. Places are calculated as if no more
+// requests arrive: priority chats go first, then the rest, one request of each chat per round.
+func (q *requestQueue) notifyPositions() {
+	position := 0
+	for _, priority := range []bool{true, false} {
+		for round := 0; ; round++ {
+			served := false
+			for _, key := range q.order[priority] {
+				requests := q.waiting[key]
+				if round >= len(requests) {
+					continue
+				}
+				served = true
+				position++
+
+				req := requests[round]
+				if req.lastSent == position {
+					continue
+				}
+				req.lastSent = position
+				// Only the latest position matters, so the outdated one is dropped
+				select {
+				case <-req.position:
+				default:
+				}
+				req.position <- position
+			}
+			if !served {
+				break
+			}
+		}
+	}
+}
+
+// waitForLlm takes a place in the LLM request queue. While the request waits, the user sees its place in line.
+func (b *Bot) waitForLlm(ctx context.Context, message t.Message) (func(), error) {
+	priority := (b.cfg.QueuePriorityPrivate && b.isPrivateWithMe(message)) ||
+		(b.cfg.QueuePriorityAdmins && b.isFromAdmin(&message))
+
+	var notice *t.Message
+	release, err := b.queue.acquire(ctx, message.Chat.ID, priority, func(position int) {
+		text := fmt.Sprintf(queuePositionMessage, position)
+
+		if notice == nil {
+			// The message is already in the history and the queue keeps requests of the chat in order, so later
+			// updates of the chat don't have to wait for this one
+			releaseChatTurn(ctx)
+
+			b.stats.RequestQueued()
+			slog.Info("bot: Request is queued", "chat", message.Chat.ID, "position", position, "priority", priority)
+
+			sent, err := b.api.SendMessage(ctx, b.reply(message, tu.Message(tu.ID(message.Chat.ID), text)))
+			if err != nil {
+				slog.Error("bot: Cannot send queue position", "error", err)
+				sentry.CaptureException(err)
+
+				return
+			}
+			notice = sent
+
+			return
+		}
+
+		_, err := b.api.EditMessageText(ctx, &t.EditMessageTextParams{
+			ChatID:    tu.ID(message.Chat.ID),
+			MessageID: notice.MessageID,
+			Text:      text,
+		})
+		if err != nil {
+			slog.Debug("bot: Cannot update queue position", "error", err)
+		}
+	})
+
+	if notice != nil {
+		// The request may be cancelled, so the root context is used to clean up
+		err := b.api.DeleteMessage(b.ctx, tu.Delete(tu.ID(message.Chat.ID), notice.MessageID))
+		if err != nil {
+			slog.Error("bot: Cannot delete queue position message", "error", err)
+			sentry.CaptureException(err)
+		}
+	}
+
+	return release, err
+}
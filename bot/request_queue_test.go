@@ -0,0 +1,125 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func queuedCount(q *requestQueue) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued := 0
+	for _, requests := range q.waiting {
+		queued += len(requests)
+	}
+
+	return queued
+}
+
+// enqueue starts waiting for the queue in the background and returns only when the request is in line
+func enqueue(t *testing.T, q *requestQueue, served chan<- string, name string, chatID int64, priority bool) {
+	t.Helper()
+
+	expected := queuedCount(q) + 1
+	go func() {
+		release, err := q.acquire(context.Background(), chatID, priority, nil)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", name, err)
+			return
+		}
+		served <- name
+		release()
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for queuedCount(q) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Request %s is not queued", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequestQueue_RoundRobinAndPriority(t *testing.T) {
+	q := newRequestQueue(1)
+
+	release, err := q.acquire(context.Background(), 1, false, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The served request holds the only slot until the next one is read, so the order is strict
+	served := make(chan string)
+	enqueue(t, q, served, "a1", 1, false)
+	enqueue(t, q, served, "a2", 1, false)
+	enqueue(t, q, served, "a3", 1, false)
+	enqueue(t, q, served, "b1", 2, false)
+	enqueue(t, q, served, "c1", 3, false)
+	enqueue(t, q, served, "p1", 4, true)
+
+	release()
+
+	expected := []string{"p1", "a1", "b1", "c1", "a2", "a3"}
+	for i, name := range expected {
+		select {
+		case got := <-served:
+			if got != name {
+				t.Fatalf("Request #%d: expected %s, got %s", i+1, name, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Request %s is not served", name)
+		}
+	}
+}
+
+func TestRequestQueue_Positions(t *testing.T) {
+	q := newRequestQueue(1)
+
+	release, err := q.acquire(context.Background(), 1, false, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer release()
+
+	served := make(chan string, 2)
+	enqueue(t, q, served, "a1", 1, false)
+	enqueue(t, q, served, "a2", 1, false)
+
+	positions := make(chan int, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := q.acquire(ctx, 2, false, func(position int) {
+			positions <- position
+		})
+		done <- err
+	}()
+
+	// The new chat is served before the second request of the busy one
+	if position := <-positions; position != 2 {
+		t.Fatalf("Expected position 2, got %d", position)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if queued := queuedCount(q); queued != 2 {
+		t.Fatalf("Expected cancelled request to leave the queue, %d requests are waiting", queued)
+	}
+}
+
+func TestRequestQueue_Disabled(t *testing.T) {
+	q := newRequestQueue(0)
+
+	for i := 0; i < 10; i++ {
+		if _, err := q.acquire(context.Background(), 1, false, func(int) {
+			t.Fatalf("Disabled queue must not report positions")
+		}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package bot
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	t "github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	streamingPlaceholder = "…"
+	// Telegram starts to throttle edits of the same message if they're more frequent than about one per second
+	minStreamingEditInterval = time.Second
+)
+
+// streamingReply is a placeholder reply message which is progressively edited while the LLM completion is streamed.
+type streamingReply struct {
+	bot         *Bot
+	placeholder *t.Message
+
+	mu       sync.Mutex
+	text     string
+	lastSent string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startStreamingReply sends the placeholder reply and starts periodical edits of it with the text passed to Update.
+func (b *Bot) startStreamingReply(ctx context.Context, message t.Message) (*streamingReply, error) {
+	placeholder, err := b.api.SendMessage(ctx, b.reply(message, tu.Message(
+		tu.ID(message.Chat.ID),
+		streamingPlaceholder,
+	)))
+	if err != nil {
+		return nil, err
+	}
+
+	editCtx, cancel := context.WithCancel(ctx)
+
+	r := &streamingReply{
+		bot:         b,
+		placeholder: placeholder,
+		lastSent:    streamingPlaceholder,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+
+	interval := b.cfg.StreamingEditInterval
+	if interval < minStreamingEditInterval {
+		interval = minStreamingEditInterval
+	}
+
+	go r.run(editCtx, interval)
+
+	return r, nil
+}
+
+// Update sets the accumulated reply text to be shown on the next edit.
+func (r *streamingReply) Update(text string) {
+	r.mu.Lock()
+	r.text = text
+	r.mu.Unlock()
+}
+
+func (r *streamingReply) run(ctx context.Context, interval time.Duration) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			text := r.text
+			r.mu.Unlock()
+
+			if text == "" {
+				continue
+			}
+
+			// Only the first message is updated while streaming, the rest is sent when the reply is complete
+			preview := r.bot.formatReply(text+" "+streamingPlaceholder, "")[0]
+			if preview.Text == r.lastSent {
+				continue
+			}
+
+			// Partial markdown may be rejected, so failures here are not critical: the next edit may succeed
+			if err := r.edit(ctx, preview); err != nil {
+				slog.Debug("bot: Cannot edit streaming reply", "error", err)
+				continue
+			}
+			r.lastSent = preview.Text
+		}
+	}
+}
+
+// stop ends periodical edits and waits for an edit in progress to complete.
+func (r *streamingReply) stop() {
+	r.cancel()
+	<-r.done
+}
+
+// Finish stops the progressive edits and replaces the placeholder with the first part of the final formatted text.
+// The rest of the parts are sent as a chain of replies to the placeholder.
+func (r *streamingReply) Finish(ctx context.Context, text string, parts []formattedText) ([]int, error) {
+	r.stop()
+
+	if len(parts) == 0 {
+		return []int{r.placeholder.MessageID}, nil
+	}
+
+	return r.bot.deliverReply(ctx, *r.placeholder, text, parts, r.editPart)
+}
+
+// editPart is a partSender replacing the placeholder text with the part instead of sending a new message
+func (r *streamingReply) editPart(ctx context.Context, _ t.Message, part formattedText) (*t.Message, error) {
+	if part.Text != r.lastSent {
+		if err := r.edit(ctx, part); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.placeholder, nil
+}
+
+// Discard stops the progressive edits and removes the placeholder message.
+func (r *streamingReply) Discard(ctx context.Context) {
+	r.stop()
+
+	err := r.bot.api.DeleteMessage(ctx, tu.Delete(tu.ID(r.placeholder.Chat.ID), r.placeholder.MessageID))
+	if err != nil {
+		slog.Error("bot: Cannot delete streaming reply placeholder", "error", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func (r *streamingReply) edit(ctx context.Context, text formattedText) error {
+	_, err := r.bot.api.EditMessageText(ctx, text.edit(tu.ID(r.placeholder.Chat.ID), r.placeholder.MessageID))
+
+	return err
+}
@@ -0,0 +1,67 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"telegram-ollama-reply-bot/llm"
+)
+
+const maxHistorySearchResults = 10
+
+// searchHistoryTool lets the chat model find older messages of the current chat which may be missing in its context
+func (b *Bot) searchHistoryTool() llm.Tool {
+	return llm.Tool{
+		Name:        "search_chat_history",
+		Description: "Search messages of the current chat by a word or a phrase. Returns the most recent matches.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"query": map[string]any{
+					"type":        "string",
+					"description": "Case-insensitive text to look for in message texts and author names.",
+				},
+			},
+			"required": []string{"query"},
+		},
+		Call: func(_ context.Context, rc llm.RequestContext, arguments string) (string, error) {
+			var args struct {
+				Query string `json:"query"`
+			}
+			if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+				return "", errors.Join(llm.ErrInvalidToolArguments, err)
+			}
+
+			query := strings.ToLower(strings.TrimSpace(args.Query))
+			if query == "" {
+				return "", errors.Join(llm.ErrInvalidToolArguments, errors.New("query is empty"))
+			}
+
+			return searchHistory(b.getChatHistory(rc.Chat.ID), query), nil
+		},
+	}
+}
+
+func searchHistory(history []MessageData, query string) string {
+	var matches []string
+	for i := len(history) - 1; i >= 0 && len(matches) < maxHistorySearchResults; i-- {
+		msg := history[i]
+		text := strings.ToLower(msg.Name + " " + msg.Username + " " + msg.Text + " " + msg.Image)
+		if strings.Contains(text, query) {
+			matches = append(matches, presentMessage(msg))
+		}
+	}
+
+	if len(matches) == 0 {
+		return "No messages found."
+	}
+
+	// Chronological order is easier to follow
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+
+	return strings.Join(matches, "\n")
+}
@@ -0,0 +1,24 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchHistory(t *testing.T) {
+	history := []MessageData{
+		{Name: "Alice", Text: "Let's meet on Friday"},
+		{Name: "Bob", Text: "ok"},
+		{Name: "Carol", Text: "friday works for me"},
+	}
+
+	result := searchHistory(history, "friday")
+	lines := strings.Split(result, "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "Alice") || !strings.HasPrefix(lines[1], "Carol") {
+		t.Fatalf("unexpected search result: %q", result)
+	}
+
+	if result = searchHistory(history, "sunday"); result != "No messages found." {
+		t.Fatalf("unexpected search result: %q", result)
+	}
+}
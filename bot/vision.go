@@ -0,0 +1,100 @@
+package bot
+
+import (
+	"context"
+	"log/slog"
+
+	"telegram-ollama-reply-bot/llm"
+
+	"github.com/getsentry/sentry-go"
+	t "github.com/mymmrac/telego"
+)
+
+// Telegram doesn't let bots download bigger files anyway
+const maxImageDownloadSize = 20 << 20
+
+// currentImageKeys returns keys of the images of the request message and the message it replies to which are sent
+// to the chat model as is. Returns nil when vision chat is disabled.
+func (b *Bot) currentImageKeys(current MessageData) map[string]bool {
+	if !b.cfg.VisionChat {
+		return nil
+	}
+
+	keys := map[string]bool{}
+	for msg := &current; msg != nil; msg = msg.ReplyTo {
+		if msg.HasImage && msg.ImageMeta.cacheKey() != "" {
+			keys[msg.ImageMeta.cacheKey()] = true
+		}
+	}
+
+	return keys
+}
+
+// historyImageKeys returns keys of the most recent history images which are sent to the chat model as is. Images of
+// the request message are excluded since they're attached to the request message itself.
+func (b *Bot) historyImageKeys(current MessageData, history []MessageData) map[string]bool {
+	if !b.cfg.VisionChat || b.cfg.VisionHistoryImages <= 0 {
+		return nil
+	}
+
+	currentKeys := b.currentImageKeys(current)
+	keys := map[string]bool{}
+	for i := len(history) - 1; i >= 0 && len(keys) < b.cfg.VisionHistoryImages; i-- {
+		msg := history[i]
+		if msg.IsMe || !msg.HasImage {
+			continue
+		}
+		if key := msg.ImageMeta.cacheKey(); key != "" && !currentKeys[key] {
+			keys[key] = true
+		}
+	}
+
+	return keys
+}
+
+// attachImages adds data of the images with the provided keys to the LLM message and the message it replies to.
+// Descriptions of these images are skipped beforehand, so images which can't be downloaded are described instead.
+func (b *Bot) attachImages(ctx context.Context, chatID int64, msg *llm.ChatMessage, data MessageData, keys map[string]bool) {
+	if len(keys) == 0 {
+		return
+	}
+
+	if data.HasImage && keys[data.ImageMeta.cacheKey()] {
+		imageData, err := b.downloadImage(ctx, data.ImageMeta)
+		if err != nil {
+			slog.Error("bot: Cannot download image for the chat model", "error", err, "file_id", data.ImageMeta.FileID)
+			sentry.CaptureException(err)
+			b.ensureImageDescription(ctx, chatID, &data, imageQuestion(data.Text), nil)
+			msg.Image = data.Image
+		} else {
+			msg.ImageData = imageData
+		}
+	}
+
+	if data.ReplyTo != nil && msg.ReplyTo != nil {
+		replyTo := *msg.ReplyTo
+		b.attachImages(ctx, chatID, &replyTo, *data.ReplyTo, keys)
+		msg.ReplyTo = &replyTo
+	}
+}
+
+// downloadImage returns the image file contents from the cache or from Telegram
+func (b *Bot) downloadImage(ctx context.Context, imageMeta *ImageMeta) ([]byte, error) {
+	if data, ok := b.imageData.get(imageMeta.cacheKey()); ok {
+		return data, nil
+	}
+
+	file, err := b.api.GetFile(ctx, &t.GetFileParams{FileID: imageMeta.FileID})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := downloadFileWithContext(ctx, b.api.FileDownloadURL(file.FilePath), maxImageDownloadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	b.imageData.set(imageMeta.cacheKey(), data)
+
+	return data, nil
+}
@@ -1,25 +1,234 @@
 package config
 
 import (
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// Reply formats supported by the bot
+const (
+	// ReplyFormatMarkdownV2 sends replies as Telegram Markdown V2 escaped from the LLM output
+	ReplyFormatMarkdownV2 = "markdownv2"
+	// ReplyFormatEntities sends replies as plain text with message entities parsed from the LLM output
+	ReplyFormatEntities = "entities"
+)
+
+// Ways to show the reasoning of thinking models
+const (
+	// ReasoningDisplayHidden doesn't show the reasoning
+	ReasoningDisplayHidden = "hidden"
+	// ReasoningDisplayBlockquote shows the reasoning above the reply as a collapsed expandable block quote
+	ReasoningDisplayBlockquote = "blockquote"
+	// ReasoningDisplaySpoiler shows the reasoning above the reply under a spoiler
+	ReasoningDisplaySpoiler = "spoiler"
+)
+
 // Config represents the root configuration structure
 type Config struct {
-	LLM    LLMConfig
-	Sentry SentryConfig
-	Bot    BotConfig
+	LLM       LLMConfig
+	Sentry    SentryConfig
+	Bot       BotConfig
+	Audit     AuditConfig
+	Extractor ExtractorConfig
 }
 
 // LLMConfig contains configuration for the LLM connector
 type LLMConfig struct {
 	APIBaseURL string
 	APIToken   string
+	// APIBackend is the API of the default endpoint, one of Backend* constants
+	APIBackend string
+	Ollama     OllamaConfig
 	Prompts    PromptConfig
 	Models     ModelSelection
+	Retry      RetryConfig
+	Breaker    BreakerConfig
+	// Endpoints contains additional OpenAI compatible APIs referenced by models as "model@alias"
+	Endpoints map[string]EndpointConfig
+	// ModelTimeout limits a single model attempt, so the next model in the chain still has time to reply
+	ModelTimeout time.Duration
+	Context      ContextConfig
+	// Pricing contains prices by "model" or "model@endpoint". Costs reported by the provider take precedence.
+	Pricing    map[string]ModelPrice
+	Tools      ToolsConfig
+	Generation GenerationConfig
+	// Summarization contains settings of summarizing texts longer than the model context
+	Summarization SummarizationConfig
+	// PromptActualModel makes {{.Model}} in the chat prompt show the model which is actually used instead of the primary
+	PromptActualModel bool
+}
+
+// SummarizationConfig contains settings of the chunked summarization. Texts which don't fit into the context of the
+// summarize model are split into chunks which are summarized separately, then partial summaries are merged.
+type SummarizationConfig struct {
+	// ChunkTokens is the size of a chunk. 0 derives it from the context size of the summarize model.
+	ChunkTokens int
+	// Parallelism limits the number of chunks summarized at once. It's 1 when the request queue is enabled.
+	Parallelism int
+	// MaxChunks limits the number of chunks, so a single summary can't take the back-end for too long
+	MaxChunks int
+}
+
+// ToolsConfig contains configuration for tools available to the chat model
+type ToolsConfig struct {
+	Enabled bool
+	// MaxSteps limits the number of completions with tool calls before the model has to reply
+	MaxSteps int
+}
+
+// Some sites block requests without a User-Agent or with the default one of the Go HTTP client
+const defaultExtractorUserAgent = "Mozilla/5.0 (compatible; TelegramLLMBot/1.0)"
+
+// Telegram messages are limited to 4096 characters which is about 1000 tokens of English text. Longer summaries are
+// cut anyway when sent.
+const telegramMessageTokens = 1000
+
+// GenerationParams contains sampling parameters and limits of LLM requests. Zero values are not sent, so the back-end
+// defaults are used for them.
+type GenerationParams struct {
+	Temperature      float32
+	TopP             float32
+	MaxTokens        int
+	Seed             *int
+	Stop             []string
+	PresencePenalty  float32
+	FrequencyPenalty float32
+}
+
+// GenerationConfig contains generation parameters for each kind of LLM requests
+type GenerationConfig struct {
+	Chat             GenerationParams
+	Summarize        GenerationParams
+	ImageRecognition GenerationParams
+	HistorySummary   GenerationParams
+}
+
+// ParseGenerationParams parses parameters in the "temperature=0.7,top_p=0.9,max_tokens=512,seed=42,stop=END|###,
+// presence_penalty=0.5,frequency_penalty=0.5" format over the defaults. Unknown and invalid parameters are ignored.
+func ParseGenerationParams(value string, defaults GenerationParams) GenerationParams {
+	params := defaults
+	for _, item := range strings.Split(value, ",") {
+		name, paramValue, found := strings.Cut(item, "=")
+		if !found {
+			continue
+		}
+		name, paramValue = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(paramValue)
+
+		switch name {
+		case "temperature", "top_p", "presence_penalty", "frequency_penalty":
+			number, err := strconv.ParseFloat(paramValue, 32)
+			if err != nil {
+				continue
+			}
+			switch name {
+			case "temperature":
+				params.Temperature = float32(number)
+			case "top_p":
+				params.TopP = float32(number)
+			case "presence_penalty":
+				params.PresencePenalty = float32(number)
+			case "frequency_penalty":
+				params.FrequencyPenalty = float32(number)
+			}
+		case "max_tokens":
+			if maxTokens, err := strconv.Atoi(paramValue); err == nil && maxTokens >= 0 {
+				params.MaxTokens = maxTokens
+			}
+		case "seed":
+			if seed, err := strconv.Atoi(paramValue); err == nil {
+				params.Seed = &seed
+			}
+		case "stop":
+			params.Stop = nil
+			for _, stop := range strings.Split(paramValue, "|") {
+				if stop != "" {
+					params.Stop = append(params.Stop, stop)
+				}
+			}
+		}
+	}
+
+	return params
+}
+
+// ModelPrice contains prices in USD per 1M prompt and completion tokens and per input image
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+	Image      float64
+}
+
+// ContextConfig contains configuration for fitting chat requests into the model context window
+type ContextConfig struct {
+	// DefaultSize is the context size in tokens for models without an explicit size. 0 disables the limit.
+	DefaultSize int
+	// ModelSizes contains context sizes of specific models by model name
+	ModelSizes map[string]int
+	// ReservedCompletionTokens is the part of the context window left for the reply
+	ReservedCompletionTokens int
+}
+
+// SizeFor returns the context size of the model
+func (c ContextConfig) SizeFor(model string) int {
+	if size, ok := c.ModelSizes[model]; ok {
+		return size
+	}
+
+	return c.DefaultSize
+}
+
+// LLM back-end APIs
+const (
+	// BackendOpenAI is an OpenAI compatible API
+	BackendOpenAI = "openai"
+	// BackendOllama is the native Ollama API
+	BackendOllama = "ollama"
+)
+
+// ParseBackend returns the back-end API by its name. OpenAI compatible API is used by default.
+func ParseBackend(value string) string {
+	if strings.EqualFold(strings.TrimSpace(value), BackendOllama) {
+		return BackendOllama
+	}
+
+	return BackendOpenAI
+}
+
+// OllamaConfig contains settings used only by the native Ollama back-end
+type OllamaConfig struct {
+	// KeepAlive is how long the model stays loaded after a request, e.g. "10m" or "-1" to keep it forever.
+	// Empty value leaves the server default.
+	KeepAlive string
+	// PullMissingModels makes the bot download configured models which are missing on the server on startup
+	PullMissingModels bool
+	// PullTimeout limits downloading of a single missing model
+	PullTimeout time.Duration
+}
+
+// EndpointConfig contains connection settings for an additional LLM API
+type EndpointConfig struct {
+	BaseURL string
+	Token   string
+	// Backend is the API of the endpoint, one of Backend* constants
+	Backend string
+}
+
+// RetryConfig contains configuration for retries of failed LLM back-end requests
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts including the first one
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// BreakerConfig contains configuration for the LLM back-end circuit breaker
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures which opens the breaker. 0 disables the breaker.
+	FailureThreshold int
+	Cooldown         time.Duration
 }
 
 // PromptConfig contains configuration for prompts
@@ -27,6 +236,7 @@ type PromptConfig struct {
 	ChatSystemPrompt       string
 	SummarizePrompt        string
 	ImageRecognitionPrompt string
+	HistorySummaryPrompt   string
 	Language               string
 	Gender                 string
 	MaxSummaryLength       int
@@ -37,6 +247,99 @@ type SentryConfig struct {
 	DSN string
 }
 
+// ExtractorConfig contains configuration for downloading web pages
+type ExtractorConfig struct {
+	UserAgent string
+	// ProxyURL is used for all page requests. Proxy environment variables are used when it's empty.
+	ProxyURL string
+	// MaxBodySize limits the size of the downloaded page in bytes
+	MaxBodySize int64
+	// MaxRedirects limits the number of redirects followed for a page
+	MaxRedirects int
+	// Timeout limits the whole page request including the body
+	Timeout time.Duration
+	// DeniedNetworks are blocked in addition to loopback, link-local, private and other non-public addresses
+	DeniedNetworks []netip.Prefix
+	// AllowedNetworks may be accessed even if they are denied
+	AllowedNetworks []netip.Prefix
+}
+
+// ParseNetworks parses a comma-separated list of CIDRs. Single addresses are treated as networks of one address.
+// Invalid items are skipped.
+func ParseNetworks(value string) []netip.Prefix {
+	var networks []netip.Prefix
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			networks = append(networks, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(item); err == nil {
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return networks
+}
+
+// AuditConfig contains configuration for the log of LLM requests and responses
+type AuditConfig struct {
+	// Path is the JSONL file of the log. Empty path disables the log.
+	Path string
+	// MaxFileSize is the size in bytes after which the file is rotated
+	MaxFileSize int64
+	// MaxFiles is the number of rotated files kept in addition to the current one
+	MaxFiles int
+	// MaxContentLength limits each text in the record in characters. 0 disables the limit.
+	MaxContentLength int
+	// RedactUsernames replaces Telegram usernames, names of users and chat titles with pseudonyms
+	RedactUsernames bool
+	// RedactText replaces message texts and replies with their lengths. Only the main system prompt is kept, with
+	// usernames and names replaced by pseudonyms.
+	RedactText bool
+}
+
+// LoadAudit reads the audit log configuration from the environment
+func LoadAudit() AuditConfig {
+	cfg := AuditConfig{
+		Path:             os.Getenv("LLM_AUDIT_LOG_PATH"),
+		MaxFileSize:      100 << 20,
+		MaxFiles:         5,
+		MaxContentLength: 20000,
+	}
+
+	if sizeStr := os.Getenv("LLM_AUDIT_MAX_FILE_SIZE_MB"); sizeStr != "" {
+		if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil && size > 0 {
+			cfg.MaxFileSize = size << 20
+		}
+	}
+
+	if filesStr := os.Getenv("LLM_AUDIT_MAX_FILES"); filesStr != "" {
+		if files, err := strconv.Atoi(filesStr); err == nil && files >= 0 {
+			cfg.MaxFiles = files
+		}
+	}
+
+	if lengthStr := os.Getenv("LLM_AUDIT_MAX_CONTENT_LENGTH"); lengthStr != "" {
+		if length, err := strconv.Atoi(lengthStr); err == nil && length >= 0 {
+			cfg.MaxContentLength = length
+		}
+	}
+
+	for _, item := range strings.Split(os.Getenv("LLM_AUDIT_REDACT"), ",") {
+		switch strings.ToLower(strings.TrimSpace(item)) {
+		case "usernames":
+			cfg.RedactUsernames = true
+		case "text":
+			cfg.RedactText = true
+		}
+	}
+
+	return cfg
+}
+
 // BotConfig contains configuration for bot settings
 type BotConfig struct {
 	HistoryLength            int
@@ -45,13 +348,97 @@ type BotConfig struct {
 	UncompressedHistoryLimit int
 	HistorySummaryThreshold  int
 	ProcessingTimeout        time.Duration
+	HistoryStoragePath       string
+	StreamingReplies         bool
+	StreamingEditInterval    time.Duration
+	ReplyFormat              string
+	// ReasoningDisplay defines how the reasoning of thinking models is shown, one of ReasoningDisplay* constants
+	ReasoningDisplay string
+	// MemoryTopK is the number of relevant older messages recalled for a request when MODEL_EMBEDDINGS is set.
+	// 0 disables the memory.
+	MemoryTopK int
+	// MemoryMinSimilarity is the minimal cosine similarity of a recalled message to the request
+	MemoryMinSimilarity float32
+	// MemoryLimit is the maximal number of remembered messages per chat
+	MemoryLimit int
+	// QueueConcurrency limits the number of LLM requests processed at once. 0 disables the queue. Embedding of new
+	// messages for the memory doesn't wait in the queue, it's done by a couple of background workers instead.
+	QueueConcurrency int
+	// QueuePriorityPrivate makes requests from private chats to be served before group ones
+	QueuePriorityPrivate bool
+	// QueuePriorityAdmins makes requests from admins to be served before the rest
+	QueuePriorityAdmins bool
+	// VisionChat makes photos to be sent to the chat model as images instead of text descriptions
+	VisionChat bool
+	// VisionHistoryImages is the number of the most recent history photos sent as images besides the request ones
+	VisionHistoryImages int
+	// MaxDocumentSize limits the size of documents downloaded for summarization in bytes
+	MaxDocumentSize int64
 }
 
 // ModelSelection contains configuration for LLM models
 type ModelSelection struct {
-	TextRequestModel      string
-	SummarizeModel        string
-	ImageRecognitionModel string
+	TextRequestModel      ModelChain
+	SummarizeModel        ModelChain
+	ImageRecognitionModel ModelChain
+	// HistorySummaryModel compresses older chat history. SummarizeModel is used when empty.
+	HistorySummaryModel ModelChain
+	// EmbeddingsModel enables the semantic memory over the whole chat history when set
+	EmbeddingsModel ModelChain
+}
+
+// ModelRef is a model name with an optional alias of the endpoint serving it. Empty endpoint means the default API.
+type ModelRef struct {
+	Name     string
+	Endpoint string
+}
+
+func (r ModelRef) String() string {
+	if r.Endpoint == "" {
+		return r.Name
+	}
+
+	return r.Name + "@" + r.Endpoint
+}
+
+// ModelChain is an ordered list of models where each next model is used when the previous one fails
+type ModelChain []ModelRef
+
+// ParseModelChain parses a comma separated list of models in "model" or "model@endpoint" format
+func ParseModelChain(value string) ModelChain {
+	var chain ModelChain
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		ref := ModelRef{Name: item}
+		if i := strings.LastIndex(item, "@"); i > 0 {
+			ref = ModelRef{Name: item[:i], Endpoint: strings.ToLower(item[i+1:])}
+		}
+		chain = append(chain, ref)
+	}
+
+	return chain
+}
+
+// Primary returns the name of the first model in the chain
+func (c ModelChain) Primary() string {
+	if len(c) == 0 {
+		return ""
+	}
+
+	return c[0].Name
+}
+
+func (c ModelChain) String() string {
+	names := make([]string, 0, len(c))
+	for _, ref := range c {
+		names = append(names, ref.String())
+	}
+
+	return strings.Join(names, ", ")
 }
 
 // TelegramConfig contains configuration for Telegram bot
@@ -96,6 +483,315 @@ func Load() *Config {
 		}
 	}
 
+	retryMaxAttempts := 3
+	if attemptsStr := os.Getenv("LLM_RETRY_MAX_ATTEMPTS"); attemptsStr != "" {
+		if attempts, err := strconv.Atoi(attemptsStr); err == nil && attempts > 0 {
+			retryMaxAttempts = attempts
+		}
+	}
+
+	retryBaseDelay := 500 * time.Millisecond
+	if delayStr := os.Getenv("LLM_RETRY_BASE_DELAY"); delayStr != "" {
+		if delay, err := time.ParseDuration(delayStr); err == nil {
+			retryBaseDelay = delay
+		}
+	}
+
+	retryMaxDelay := 5 * time.Second
+	if delayStr := os.Getenv("LLM_RETRY_MAX_DELAY"); delayStr != "" {
+		if delay, err := time.ParseDuration(delayStr); err == nil {
+			retryMaxDelay = delay
+		}
+	}
+
+	breakerFailureThreshold := 5
+	if thrStr := os.Getenv("LLM_BREAKER_FAILURE_THRESHOLD"); thrStr != "" {
+		if thr, err := strconv.Atoi(thrStr); err == nil {
+			breakerFailureThreshold = thr
+		}
+	}
+
+	breakerCooldown := 30 * time.Second
+	if cooldownStr := os.Getenv("LLM_BREAKER_COOLDOWN"); cooldownStr != "" {
+		if cooldown, err := time.ParseDuration(cooldownStr); err == nil {
+			breakerCooldown = cooldown
+		}
+	}
+
+	modelTimeout := time.Duration(0)
+	if toStr := os.Getenv("LLM_MODEL_TIMEOUT"); toStr != "" {
+		if to, err := time.ParseDuration(toStr); err == nil {
+			modelTimeout = to
+		}
+	}
+
+	promptActualModel := false
+	if actualStr := os.Getenv("LLM_PROMPT_ACTUAL_MODEL"); actualStr != "" {
+		if actual, err := strconv.ParseBool(actualStr); err == nil {
+			promptActualModel = actual
+		}
+	}
+
+	contextSize := 0
+	if sizeStr := os.Getenv("LLM_CONTEXT_SIZE"); sizeStr != "" {
+		if size, err := strconv.Atoi(sizeStr); err == nil {
+			contextSize = size
+		}
+	}
+
+	// Format: "model=size,other-model=size"
+	modelContextSizes := map[string]int{}
+	if sizesStr := os.Getenv("LLM_MODEL_CONTEXT_SIZES"); sizesStr != "" {
+		for _, item := range strings.Split(sizesStr, ",") {
+			model, sizeStr, found := strings.Cut(strings.TrimSpace(item), "=")
+			if !found {
+				continue
+			}
+			if size, err := strconv.Atoi(strings.TrimSpace(sizeStr)); err == nil {
+				modelContextSizes[strings.TrimSpace(model)] = size
+			}
+		}
+	}
+
+	reservedCompletionTokens := 1024
+	if tokensStr := os.Getenv("LLM_RESERVED_COMPLETION_TOKENS"); tokensStr != "" {
+		if tokens, err := strconv.Atoi(tokensStr); err == nil {
+			reservedCompletionTokens = tokens
+		}
+	}
+
+	// Format: "model=prompt/completion[/image],other-model@endpoint=prompt/completion"
+	pricing := map[string]ModelPrice{}
+	if pricingStr := os.Getenv("LLM_PRICING"); pricingStr != "" {
+		for _, item := range strings.Split(pricingStr, ",") {
+			item = strings.TrimSpace(item)
+			i := strings.LastIndex(item, "=")
+			if i <= 0 {
+				continue
+			}
+
+			var prices []float64
+			for _, priceStr := range strings.Split(item[i+1:], "/") {
+				price, err := strconv.ParseFloat(strings.TrimSpace(priceStr), 64)
+				if err != nil {
+					prices = nil
+					break
+				}
+				prices = append(prices, price)
+			}
+			if len(prices) < 2 || len(prices) > 3 {
+				continue
+			}
+
+			price := ModelPrice{Prompt: prices[0], Completion: prices[1]}
+			if len(prices) == 3 {
+				price.Image = prices[2]
+			}
+			pricing[strings.TrimSpace(item[:i])] = price
+		}
+	}
+
+	generation := GenerationConfig{
+		Chat:             ParseGenerationParams(os.Getenv("LLM_PARAMS_CHAT"), GenerationParams{}),
+		Summarize:        ParseGenerationParams(os.Getenv("LLM_PARAMS_SUMMARIZE"), GenerationParams{MaxTokens: telegramMessageTokens}),
+		ImageRecognition: ParseGenerationParams(os.Getenv("LLM_PARAMS_IMAGE"), GenerationParams{}),
+		HistorySummary:   ParseGenerationParams(os.Getenv("LLM_PARAMS_HISTORY_SUMMARY"), GenerationParams{}),
+	}
+
+	toolsEnabled := false
+	if toolsStr := os.Getenv("LLM_TOOLS_ENABLED"); toolsStr != "" {
+		if enabled, err := strconv.ParseBool(toolsStr); err == nil {
+			toolsEnabled = enabled
+		}
+	}
+
+	toolsMaxSteps := 4
+	if stepsStr := os.Getenv("LLM_TOOLS_MAX_STEPS"); stepsStr != "" {
+		if steps, err := strconv.Atoi(stepsStr); err == nil && steps >= 0 {
+			toolsMaxSteps = steps
+		}
+	}
+
+	models := ModelSelection{
+		TextRequestModel:      ParseModelChain(os.Getenv("MODEL_TEXT_REQUEST")),
+		SummarizeModel:        ParseModelChain(os.Getenv("MODEL_SUMMARIZE_REQUEST")),
+		ImageRecognitionModel: ParseModelChain(os.Getenv("MODEL_IMAGE_RECOGNITION")),
+		HistorySummaryModel:   ParseModelChain(os.Getenv("MODEL_HISTORY_SUMMARY")),
+		EmbeddingsModel:       ParseModelChain(os.Getenv("MODEL_EMBEDDINGS")),
+	}
+	if len(models.HistorySummaryModel) == 0 {
+		models.HistorySummaryModel = models.SummarizeModel
+	}
+
+	// Additional endpoints are configured only for aliases which are referenced by models
+	endpoints := map[string]EndpointConfig{}
+	for _, chain := range []ModelChain{
+		models.TextRequestModel,
+		models.SummarizeModel,
+		models.ImageRecognitionModel,
+		models.HistorySummaryModel,
+		models.EmbeddingsModel,
+	} {
+		for _, ref := range chain {
+			if ref.Endpoint == "" {
+				continue
+			}
+			envPrefix := "LLM_ENDPOINT_" + strings.ToUpper(strings.ReplaceAll(ref.Endpoint, "-", "_"))
+			endpoints[ref.Endpoint] = EndpointConfig{
+				BaseURL: os.Getenv(envPrefix + "_BASE_URL"),
+				Token:   os.Getenv(envPrefix + "_TOKEN"),
+				Backend: ParseBackend(os.Getenv(envPrefix + "_BACKEND")),
+			}
+		}
+	}
+
+	extractorMaxBodySize := int64(10 << 20)
+	if sizeStr := os.Getenv("EXTRACTOR_MAX_BODY_SIZE_MB"); sizeStr != "" {
+		if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil && size > 0 {
+			extractorMaxBodySize = size << 20
+		}
+	}
+
+	extractorMaxRedirects := 5
+	if redirectsStr := os.Getenv("EXTRACTOR_MAX_REDIRECTS"); redirectsStr != "" {
+		if redirects, err := strconv.Atoi(redirectsStr); err == nil && redirects >= 0 {
+			extractorMaxRedirects = redirects
+		}
+	}
+
+	extractorTimeout := 10 * time.Second
+	if timeoutStr := os.Getenv("EXTRACTOR_TIMEOUT"); timeoutStr != "" {
+		if timeout, err := time.ParseDuration(timeoutStr); err == nil && timeout > 0 {
+			extractorTimeout = timeout
+		}
+	}
+
+	summarizeChunkTokens := 0
+	if tokensStr := os.Getenv("LLM_SUMMARIZE_CHUNK_TOKENS"); tokensStr != "" {
+		if tokens, err := strconv.Atoi(tokensStr); err == nil && tokens >= 0 {
+			summarizeChunkTokens = tokens
+		}
+	}
+
+	summarizeParallelism := 2
+	if parallelismStr := os.Getenv("LLM_SUMMARIZE_PARALLELISM"); parallelismStr != "" {
+		if parallelism, err := strconv.Atoi(parallelismStr); err == nil && parallelism > 0 {
+			summarizeParallelism = parallelism
+		}
+	}
+
+	summarizeMaxChunks := 20
+	if chunksStr := os.Getenv("LLM_SUMMARIZE_MAX_CHUNKS"); chunksStr != "" {
+		if chunks, err := strconv.Atoi(chunksStr); err == nil && chunks > 0 {
+			summarizeMaxChunks = chunks
+		}
+	}
+
+	ollamaPullMissingModels := true
+	if pullStr := os.Getenv("LLM_OLLAMA_PULL_MISSING_MODELS"); pullStr != "" {
+		if pull, err := strconv.ParseBool(pullStr); err == nil {
+			ollamaPullMissingModels = pull
+		}
+	}
+
+	ollamaPullTimeout := 10 * time.Minute
+	if timeoutStr := os.Getenv("LLM_OLLAMA_PULL_TIMEOUT"); timeoutStr != "" {
+		if timeout, err := time.ParseDuration(timeoutStr); err == nil && timeout > 0 {
+			ollamaPullTimeout = timeout
+		}
+	}
+
+	streamingReplies := false
+	if streamStr := os.Getenv("BOT_STREAMING_REPLIES"); streamStr != "" {
+		if stream, err := strconv.ParseBool(streamStr); err == nil {
+			streamingReplies = stream
+		}
+	}
+
+	streamingEditInterval := 2 * time.Second
+	if intervalStr := os.Getenv("BOT_STREAMING_EDIT_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil {
+			streamingEditInterval = interval
+		}
+	}
+
+	visionChat := false
+	if visionStr := os.Getenv("LLM_VISION_CHAT"); visionStr != "" {
+		if vision, err := strconv.ParseBool(visionStr); err == nil {
+			visionChat = vision
+		}
+	}
+
+	visionHistoryImages := 0
+	if imagesStr := os.Getenv("LLM_VISION_HISTORY_IMAGES"); imagesStr != "" {
+		if images, err := strconv.Atoi(imagesStr); err == nil {
+			visionHistoryImages = images
+		}
+	}
+
+	replyFormat := ReplyFormatMarkdownV2
+	if formatStr := strings.ToLower(os.Getenv("BOT_REPLY_FORMAT")); formatStr == ReplyFormatEntities {
+		replyFormat = formatStr
+	}
+
+	memoryTopK := 5
+	if topKStr := os.Getenv("BOT_MEMORY_TOP_K"); topKStr != "" {
+		if topK, err := strconv.Atoi(topKStr); err == nil && topK >= 0 {
+			memoryTopK = topK
+		}
+	}
+
+	memoryMinSimilarity := float32(0.4)
+	if similarityStr := os.Getenv("BOT_MEMORY_MIN_SIMILARITY"); similarityStr != "" {
+		if similarity, err := strconv.ParseFloat(similarityStr, 32); err == nil {
+			memoryMinSimilarity = float32(similarity)
+		}
+	}
+
+	memoryLimit := 10000
+	if limitStr := os.Getenv("BOT_MEMORY_LIMIT"); limitStr != "" {
+		if limit, err := strconv.Atoi(limitStr); err == nil && limit >= 0 {
+			memoryLimit = limit
+		}
+	}
+
+	maxDocumentSize := int64(20 << 20)
+	if sizeStr := os.Getenv("BOT_MAX_DOCUMENT_SIZE_MB"); sizeStr != "" {
+		if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil && size > 0 {
+			maxDocumentSize = size << 20
+		}
+	}
+
+	queueConcurrency := 0
+	if concurrencyStr := os.Getenv("BOT_QUEUE_CONCURRENCY"); concurrencyStr != "" {
+		if concurrency, err := strconv.Atoi(concurrencyStr); err == nil && concurrency >= 0 {
+			queueConcurrency = concurrency
+		}
+	}
+	// Chunks of a long text are summarized under a single place in the request queue, so they don't run in parallel
+	if queueConcurrency > 0 {
+		summarizeParallelism = 1
+	}
+
+	queuePriorityPrivate, queuePriorityAdmins := true, true
+	if priorityStr, set := os.LookupEnv("BOT_QUEUE_PRIORITY"); set {
+		queuePriorityPrivate, queuePriorityAdmins = false, false
+		for _, item := range strings.Split(priorityStr, ",") {
+			switch strings.ToLower(strings.TrimSpace(item)) {
+			case "private":
+				queuePriorityPrivate = true
+			case "admins":
+				queuePriorityAdmins = true
+			}
+		}
+	}
+
+	reasoningDisplay := ReasoningDisplayHidden
+	switch displayStr := strings.ToLower(os.Getenv("BOT_SHOW_REASONING")); displayStr {
+	case ReasoningDisplayBlockquote, ReasoningDisplaySpoiler:
+		reasoningDisplay = displayStr
+	}
+
 	// Parse admin IDs from environment variable
 	var adminIDs []int64
 	if adminIDsStr := os.Getenv("BOT_ADMIN_IDS"); adminIDsStr != "" {
@@ -129,30 +825,83 @@ func Load() *Config {
 
 	defaultImageRecognitionPrompt := "You're an image recognition bot. Describe what you see in the image in detail for an LLM to understand.\n" +
 		"If you can understand the meaning of the image, describe it in detail. If you can't understand the meaning, describe what you see in general.\n" +
+		"If the image is mostly text (a screenshot, a document, a chat, code or an error message), transcribe the text verbatim keeping its structure and then briefly describe the rest.\n" +
+		"If the user asks something about the image, make sure the description contains the details needed to answer.\n" +
 		"You should reply in the following language: {{.Language}}.\n" +
 		"Be concise but informative."
 
+	defaultHistorySummaryPrompt := "You compress a Telegram chat conversation for a chat bot which takes part in it.\n" +
+		"You receive the previous summary of the conversation (possibly empty) and new messages in the " +
+		"\"Name (@username): text\" format. Lines starting with \">\" quote the message being replied to.\n" +
+		"Write an updated summary which merges the previous summary with the new messages.\n" +
+		"Keep who said what: mention participants by their names, their opinions, requests and promises.\n" +
+		"Keep open questions and unfinished tasks, especially ones addressed to the bot.\n" +
+		"Drop greetings, small talk and details which are no longer relevant.\n" +
+		"Write plain text without formatting in the following language: {{.Language}}.\n" +
+		"Limit the summary to maximum of {{.MaxLength}} characters."
+
 	return &Config{
 		LLM: LLMConfig{
 			APIBaseURL: os.Getenv("OPENAI_API_BASE_URL"),
 			APIToken:   os.Getenv("OPENAI_API_TOKEN"),
-			Models: ModelSelection{
-				TextRequestModel:      os.Getenv("MODEL_TEXT_REQUEST"),
-				SummarizeModel:        os.Getenv("MODEL_SUMMARIZE_REQUEST"),
-				ImageRecognitionModel: os.Getenv("MODEL_IMAGE_RECOGNITION"),
+			APIBackend: ParseBackend(os.Getenv("LLM_API_BACKEND")),
+			Ollama: OllamaConfig{
+				KeepAlive:         os.Getenv("LLM_OLLAMA_KEEP_ALIVE"),
+				PullMissingModels: ollamaPullMissingModels,
+				PullTimeout:       ollamaPullTimeout,
 			},
+			Models: models,
 			Prompts: PromptConfig{
 				ChatSystemPrompt:       getEnvOrDefault("PROMPT_CHAT", defaultChatPrompt),
 				SummarizePrompt:        getEnvOrDefault("PROMPT_SUMMARIZE", defaultSummarizePrompt),
 				ImageRecognitionPrompt: getEnvOrDefault("PROMPT_IMAGE_RECOGNITION", defaultImageRecognitionPrompt),
+				HistorySummaryPrompt:   getEnvOrDefault("PROMPT_HISTORY_SUMMARY", defaultHistorySummaryPrompt),
 				Language:               getEnvOrDefault("RESPONSE_LANGUAGE", "Russian"),
 				Gender:                 getEnvOrDefault("RESPONSE_GENDER", "neutral"),
 				MaxSummaryLength:       maxSummaryLength,
 			},
+			Retry: RetryConfig{
+				MaxAttempts: retryMaxAttempts,
+				BaseDelay:   retryBaseDelay,
+				MaxDelay:    retryMaxDelay,
+			},
+			Breaker: BreakerConfig{
+				FailureThreshold: breakerFailureThreshold,
+				Cooldown:         breakerCooldown,
+			},
+			Endpoints:    endpoints,
+			ModelTimeout: modelTimeout,
+			Pricing:      pricing,
+			Generation:   generation,
+			Summarization: SummarizationConfig{
+				ChunkTokens: summarizeChunkTokens,
+				Parallelism: summarizeParallelism,
+				MaxChunks:   summarizeMaxChunks,
+			},
+			Tools: ToolsConfig{
+				Enabled:  toolsEnabled,
+				MaxSteps: toolsMaxSteps,
+			},
+			Context: ContextConfig{
+				DefaultSize:              contextSize,
+				ModelSizes:               modelContextSizes,
+				ReservedCompletionTokens: reservedCompletionTokens,
+			},
+			PromptActualModel: promptActualModel,
 		},
 		Sentry: SentryConfig{
 			DSN: os.Getenv("SENTRY_DSN"),
 		},
+		Audit: LoadAudit(),
+		Extractor: ExtractorConfig{
+			UserAgent:       getEnvOrDefault("EXTRACTOR_USER_AGENT", defaultExtractorUserAgent),
+			ProxyURL:        os.Getenv("EXTRACTOR_PROXY"),
+			MaxBodySize:     extractorMaxBodySize,
+			MaxRedirects:    extractorMaxRedirects,
+			Timeout:         extractorTimeout,
+			DeniedNetworks:  ParseNetworks(os.Getenv("EXTRACTOR_DENY_CIDRS")),
+			AllowedNetworks: ParseNetworks(os.Getenv("EXTRACTOR_ALLOW_CIDRS")),
+		},
 		Bot: BotConfig{
 			HistoryLength: historyLength,
 			AdminIDs:      adminIDs,
@@ -162,6 +911,20 @@ func Load() *Config {
 			UncompressedHistoryLimit: uncompressedHistoryLimit,
 			HistorySummaryThreshold:  historySummaryThreshold,
 			ProcessingTimeout:        processingTimeout,
+			HistoryStoragePath:       os.Getenv("BOT_HISTORY_STORAGE_PATH"),
+			StreamingReplies:         streamingReplies,
+			StreamingEditInterval:    streamingEditInterval,
+			ReplyFormat:              replyFormat,
+			ReasoningDisplay:         reasoningDisplay,
+			MemoryTopK:               memoryTopK,
+			MemoryMinSimilarity:      memoryMinSimilarity,
+			MemoryLimit:              memoryLimit,
+			QueueConcurrency:         queueConcurrency,
+			QueuePriorityPrivate:     queuePriorityPrivate,
+			QueuePriorityAdmins:      queuePriorityAdmins,
+			VisionChat:               visionChat,
+			VisionHistoryImages:      visionHistoryImages,
+			MaxDocumentSize:          maxDocumentSize,
 		},
 	}
 }
@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestParseModelChain(t *testing.T) {
+	chain := ParseModelChain(" llama3:8b , gpt-4o@OpenAI,,")
+	expected := ModelChain{{Name: "llama3:8b"}, {Name: "gpt-4o", Endpoint: "openai"}}
+	if len(chain) != len(expected) || chain[0] != expected[0] || chain[1] != expected[1] {
+		t.Fatalf("unexpected chain: %+v", chain)
+	}
+	if chain.Primary() != "llama3:8b" || chain.String() != "llama3:8b, gpt-4o@openai" {
+		t.Fatalf("unexpected chain presentation: %q %q", chain.Primary(), chain.String())
+	}
+}
+
+func TestParseGenerationParams(t *testing.T) {
+	params := ParseGenerationParams(
+		"temperature=0.5, top_p=0.9,seed=42,stop=END|###,unknown=1,presence_penalty=oops",
+		GenerationParams{MaxTokens: 100, PresencePenalty: 0.1},
+	)
+	if params.Temperature != 0.5 || params.TopP != 0.9 || params.MaxTokens != 100 || params.PresencePenalty != 0.1 {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+	if params.Seed == nil || *params.Seed != 42 {
+		t.Fatalf("unexpected seed: %v", params.Seed)
+	}
+	if len(params.Stop) != 2 || params.Stop[0] != "END" || params.Stop[1] != "###" {
+		t.Fatalf("unexpected stop sequences: %q", params.Stop)
+	}
+
+	if params = ParseGenerationParams("max_tokens=0", GenerationParams{MaxTokens: 100}); params.MaxTokens != 0 {
+		t.Fatalf("default max tokens must be overridable, got %d", params.MaxTokens)
+	}
+}
@@ -0,0 +1,157 @@
+package extractor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	ErrUnsupportedDocument = errors.New("unsupported document type")
+)
+
+// Longer texts take too many LLM requests to summarize. Compressed PDF streams may expand into much more text than the
+// file size suggests, so the limit is checked while pages are extracted too.
+const maxDocumentTextLength = 1 << 20
+
+type documentKind int
+
+const (
+	documentUnsupported documentKind = iota
+	documentPdf
+	documentHtml
+	documentText
+)
+
+// ArticleFromDocument extracts the text of an uploaded document: the text layer of a PDF, the article of an HTML page
+// or a plain text or Markdown file as is. The type is detected by the MIME type and then by the file extension, since
+// clients often send text files as application/octet-stream.
+func ArticleFromDocument(ctx context.Context, data []byte, mimeType string, fileName string) (Article, error) {
+	slog.Info("document-extractor: requested extraction from document", "file", fileName, "mime-type", mimeType, "size", len(data))
+
+	var article Article
+	var err error
+	switch detectDocumentKind(mimeType, fileName) {
+	case documentPdf:
+		article.Text, err = pdfText(ctx, data, maxDocumentTextLength)
+	case documentHtml:
+		var html string
+		if html, err = decodeText(data, mimeType); err == nil {
+			article, err = articleFromHtml(html, nil)
+		}
+	case documentText:
+		article.Text, err = decodeText(data, mimeType)
+	default:
+		return Article{}, fmt.Errorf("%w: %s", ErrUnsupportedDocument, mimeType)
+	}
+	if err != nil {
+		return Article{}, errors.Join(ErrExtractFailed, err)
+	}
+
+	if article.Title == "" {
+		article.Title = fileName
+	}
+	article.Text = strings.TrimSpace(article.Text)
+	if len(article.Text) > maxDocumentTextLength {
+		slog.Info("document-extractor: Document text is too long, the rest is cut", "file", fileName, "length", len(article.Text))
+		article.Text = strings.ToValidUTF8(article.Text[:maxDocumentTextLength], "")
+	}
+
+	return article, nil
+}
+
+func detectDocumentKind(mimeType string, fileName string) documentKind {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	switch mediaType {
+	case "application/pdf":
+		return documentPdf
+	case "text/html", "application/xhtml+xml":
+		return documentHtml
+	case "text/plain", "text/markdown", "text/x-markdown":
+		return documentText
+	}
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".pdf":
+		return documentPdf
+	case ".html", ".htm", ".xhtml":
+		return documentHtml
+	case ".txt", ".md", ".markdown":
+		return documentText
+	}
+
+	return documentUnsupported
+}
+
+// decodeText converts the text to UTF-8 using the charset from the MIME type or detected from the content
+func decodeText(data []byte, mimeType string) (string, error) {
+	reader, err := charset.NewReader(bytes.NewReader(data), mimeType)
+	if err != nil {
+		return "", err
+	}
+
+	text, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToValidUTF8(string(text), ""), nil
+}
+
+// pdfText returns the text layer of the PDF. Scanned documents without it have no text. Pages after the one
+// reaching maxLength bytes of text are skipped.
+func pdfText(ctx context.Context, data []byte, maxLength int) (text string, err error) {
+	// The parser panics on some malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fonts := make(map[string]*pdf.Font)
+	for i := 1; i <= reader.NumPage(); i++ {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if sb.Len() >= maxLength {
+			slog.Info("document-extractor: PDF text is too long, the rest of pages is skipped", "pages", reader.NumPage(), "skipped", reader.NumPage()-i+1)
+			break
+		}
+
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		// Fonts are cached, so their character maps aren't parsed for every page
+		for _, name := range page.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+
+		pageText, err := page.GetPlainText(fonts)
+		if err != nil {
+			return "", fmt.Errorf("page %d: %w", i, err)
+		}
+		sb.WriteString(pageText)
+		sb.WriteString("\n\n")
+	}
+
+	return sb.String(), nil
+}
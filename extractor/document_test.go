@@ -0,0 +1,128 @@
+package extractor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// testPdf builds a minimal PDF with a page with the text layer for each text
+func testPdf(texts ...string) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	}
+	var kids []string
+	for _, text := range texts {
+		content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objects)+1))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents %d 0 R /Resources << /Font << /F1 3 0 R >> >> >>", len(objects)+2),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		)
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(texts))
+
+	var sb strings.Builder
+	sb.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = sb.Len()
+		fmt.Fprintf(&sb, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := sb.Len()
+	fmt.Fprintf(&sb, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&sb, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&sb, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return []byte(sb.String())
+}
+
+func TestArticleFromDocument(t *testing.T) {
+	tests := map[string]struct {
+		data     []byte
+		mimeType string
+		fileName string
+		want     string
+	}{
+		"pdf": {
+			data:     testPdf("Quarterly report", "Revenue grew"),
+			mimeType: "application/pdf",
+			fileName: "report.pdf",
+			want:     "Revenue grew",
+		},
+		"markdown sent as binary": {
+			data:     []byte("# Notes\n\nThe release is planned for Monday.\n"),
+			mimeType: "application/octet-stream",
+			fileName: "notes.md",
+			want:     "# Notes\n\nThe release is planned for Monday.",
+		},
+		"text in windows-1251": {
+			data:     []byte{0xcf, 0xf0, 0xe8, 0xe2, 0xe5, 0xf2},
+			mimeType: "text/plain; charset=windows-1251",
+			fileName: "hello.txt",
+			want:     "Привет",
+		},
+		"html": {
+			data:     []byte(testArticle),
+			mimeType: "text/html",
+			fileName: "page.html",
+			want:     "The second paragraph",
+		},
+	}
+	for name, test := range tests {
+		article, err := ArticleFromDocument(context.Background(), test.data, test.mimeType, test.fileName)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if !strings.Contains(article.Text, test.want) {
+			t.Fatalf("%s: expected %q in the text, got %q", name, test.want, article.Text)
+		}
+	}
+
+	if _, err := ArticleFromDocument(context.Background(), []byte{0x50, 0x4b}, "application/zip", "archive.zip"); !errors.Is(err, ErrUnsupportedDocument) {
+		t.Fatalf("expected ErrUnsupportedDocument, got %v", err)
+	}
+	if _, err := ArticleFromDocument(context.Background(), []byte("%PDF-1.4 broken"), "application/pdf", "broken.pdf"); !errors.Is(err, ErrExtractFailed) {
+		t.Fatalf("expected ErrExtractFailed for a malformed PDF, got %v", err)
+	}
+}
+
+func TestPdfText_LimitAndCancellation(t *testing.T) {
+	data := testPdf("First page", "Second page", "Third page")
+
+	text, err := pdfText(context.Background(), data, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(text, "First page") || strings.Contains(text, "Second page") {
+		t.Fatalf("expected only the first page, got %q", text)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pdfText(ctx, data, maxDocumentTextLength); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestArticleFromDocument_LimitsTextLength(t *testing.T) {
+	data := []byte(strings.Repeat("Всё хорошо. ", maxDocumentTextLength/10))
+
+	article, err := ArticleFromDocument(context.Background(), data, "text/plain; charset=utf-8", "big.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(article.Text) > maxDocumentTextLength || len(article.Text) < maxDocumentTextLength-4 {
+		t.Fatalf("expected the text to be cut at %d bytes, got %d", maxDocumentTextLength, len(article.Text))
+	}
+	if !utf8.ValidString(article.Text) {
+		t.Fatal("the text must be cut on a character boundary")
+	}
+}
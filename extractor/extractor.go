@@ -1,17 +1,14 @@
 package extractor
 
 import (
+	"context"
 	"errors"
 	"log/slog"
-	"time"
+	"net/http"
 
 	"github.com/getsentry/sentry-go"
 )
 
-const (
-	ExtractionTimeout = 10 * time.Second
-)
-
 var (
 	ErrExtractFailed = errors.New("extraction failed")
 )
@@ -23,7 +20,8 @@ type Article struct {
 }
 
 type Extractor interface {
-	GetArticleFromUrl(url string) (Article, error)
+	// GetArticleFromUrl downloads the page and extracts the article. The download is cancelled with the context.
+	GetArticleFromUrl(ctx context.Context, url string) (Article, error)
 }
 
 type MultiExtractor struct {
@@ -31,28 +29,38 @@ type MultiExtractor struct {
 	fallback Extractor
 }
 
-func NewMultiExtractor() *MultiExtractor {
+func NewMultiExtractor(client *http.Client) *MultiExtractor {
 	return &MultiExtractor{
-		primary:  NewReadabilityExtractor(),
-		fallback: NewGoOseExtractor(),
+		primary:  NewReadabilityExtractor(client),
+		fallback: NewGoOseExtractor(client),
 	}
 }
 
-func (e *MultiExtractor) GetArticleFromUrl(url string) (Article, error) {
+func (e *MultiExtractor) GetArticleFromUrl(ctx context.Context, url string) (Article, error) {
 	slog.Info("multi-extractor: requested extraction from URL ", "url", url)
 
-	article, err := e.primary.GetArticleFromUrl(url)
+	article, err := e.primary.GetArticleFromUrl(ctx, url)
 	if err == nil && article.Text != "" {
 		slog.Info("multi-extractor: successfully extracted using primary extractor")
 
 		return article, nil
+	} else if errors.Is(err, ErrForbiddenAddress) {
+		slog.Warn("multi-extractor: URL points to a forbidden address", "url", url, "error", err)
+
+		return Article{}, errors.Join(ErrExtractFailed, err)
 	} else if err != nil {
 		slog.Error("multi-extractor: primary extractor failed", "url", url, "error", err)
 		sentry.CaptureException(err)
 	}
 
+	if ctx.Err() != nil {
+		slog.Error("multi-extractor: extraction cancelled", "url", url, "error", ctx.Err())
+
+		return Article{}, errors.Join(ErrExtractFailed, ctx.Err())
+	}
+
 	slog.Info("multi-extractor: trying fallback extractor")
-	article, err = e.fallback.GetArticleFromUrl(url)
+	article, err = e.fallback.GetArticleFromUrl(ctx, url)
 	if err == nil && article.Text != "" {
 		slog.Info("multi-extractor: successfully extracted using fallback extractor")
 
@@ -64,9 +72,14 @@ func (e *MultiExtractor) GetArticleFromUrl(url string) (Article, error) {
 
 	slog.Error("multi-extractor: both extractors failed", "url", url)
 
+	if err != nil {
+		return Article{}, errors.Join(ErrExtractFailed, err)
+	}
+
 	return Article{}, ErrExtractFailed
 }
 
-func NewExtractor() Extractor {
-	return NewMultiExtractor()
+// NewExtractor creates the extractor which downloads pages using the client
+func NewExtractor(client *http.Client) Extractor {
+	return NewMultiExtractor(client)
 }
@@ -2,61 +2,55 @@ package extractor
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"net/http"
 
 	goose "github.com/advancedlogic/GoOse"
 	"github.com/getsentry/sentry-go"
 )
 
 type GoOseExtractor struct {
-	goose *goose.Goose
+	goose  *goose.Goose
+	client *http.Client
 }
 
-func NewGoOseExtractor() *GoOseExtractor {
+func NewGoOseExtractor(client *http.Client) *GoOseExtractor {
 	gooseExtractor := goose.New()
 	return &GoOseExtractor{
-		goose: &gooseExtractor,
+		goose:  &gooseExtractor,
+		client: client,
 	}
 }
 
-func (e *GoOseExtractor) GetArticleFromUrl(url string) (Article, error) {
+// GetArticleFromUrl downloads the page with the client, so the request is cancelled with the context, and passes it to
+// GoOse which only parses it
+func (e *GoOseExtractor) GetArticleFromUrl(ctx context.Context, url string) (Article, error) {
 	slog.Info("goose-extractor: requested extraction from URL ", "url", url)
 
-	ctx, cancel := context.WithTimeout(context.Background(), ExtractionTimeout)
-	defer cancel()
-
-	resultChan := make(chan struct {
-		article *goose.Article
-		err     error
-	})
-
-	go func() {
-		article, err := e.goose.ExtractFromURL(url)
-		resultChan <- struct {
-			article *goose.Article
-			err     error
-		}{article, err}
-	}()
-
-	select {
-	case result := <-resultChan:
-		if result.err != nil {
-			slog.Error("goose-extractor: failed extracting from URL", "url", url)
-			sentry.CaptureException(result.err)
-			
-			return Article{}, ErrExtractFailed
+	page, err := fetchPage(ctx, e.client, url)
+	if err != nil {
+		slog.Error("goose-extractor: failed fetching URL", "url", url, "error", err)
+		if !errors.Is(err, ErrForbiddenAddress) {
+			sentry.CaptureException(err)
 		}
 
-		slog.Debug("goose-extractor: article extracted", "article", result.article)
-
-		return Article{
-			Title: result.article.Title,
-			Text:  result.article.CleanedText,
-			Url:   result.article.FinalURL,
-		}, nil
-	case <-ctx.Done():
-		slog.Error("goose-extractor: extraction timed out", "url", url)
-		sentry.CaptureMessage("Article extraction timed out")
-		return Article{}, ErrExtractFailed
+		return Article{}, errors.Join(ErrExtractFailed, err)
 	}
+
+	article, err := e.goose.ExtractFromRawHTML(page.html, page.url.String())
+	if err != nil {
+		slog.Error("goose-extractor: failed extracting from URL", "url", url)
+		sentry.CaptureException(err)
+
+		return Article{}, errors.Join(ErrExtractFailed, err)
+	}
+
+	slog.Debug("goose-extractor: article extracted", "article", article)
+
+	return Article{
+		Title: article.Title,
+		Text:  article.CleanedText,
+		Url:   page.url.String(),
+	}, nil
 }
@@ -0,0 +1,148 @@
+package extractor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"syscall"
+
+	"telegram-ollama-reply-bot/config"
+)
+
+var ErrForbiddenAddress = errors.New("address is not allowed")
+
+// Special purpose networks which are not covered by the netip.Addr checks
+var reservedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// NAT64 and 6to4 addresses embed IPv4 ones, so they may translate to internal networks
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// addressGuard prevents the bot from being used to reach the internal network of the server, e.g. cloud metadata
+// services or the LLM back-end. Addresses are checked when connecting, so redirects and DNS rebinding can't bypass it.
+type addressGuard struct {
+	denied  []netip.Prefix
+	allowed []netip.Prefix
+	dialer  *net.Dialer
+	// proxies contains addresses of the proxies used by the transport. They are configured by the owner, so they may
+	// be internal.
+	proxies sync.Map
+}
+
+func newAddressGuard(cfg config.ExtractorConfig) *addressGuard {
+	g := &addressGuard{
+		denied:  slices.Concat(reservedNetworks, cfg.DeniedNetworks),
+		allowed: cfg.AllowedNetworks,
+	}
+	g.dialer = &net.Dialer{Control: g.control}
+
+	return g
+}
+
+// check returns an error if the address is not public or is denied by the configuration
+func (g *addressGuard) check(addr netip.Addr) error {
+	addr = addr.Unmap()
+
+	for _, network := range g.allowed {
+		if network.Contains(addr) {
+			return nil
+		}
+	}
+
+	if addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+	}
+
+	for _, network := range g.denied {
+		if network.Contains(addr) {
+			return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+		}
+	}
+
+	return nil
+}
+
+// control checks the resolved address right before connecting
+func (g *addressGuard) control(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+
+	return g.check(addrPort.Addr())
+}
+
+func (g *addressGuard) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if _, proxy := g.proxies.Load(address); proxy {
+		var dialer net.Dialer
+
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	return g.dialer.DialContext(ctx, network, address)
+}
+
+// guardedTransport checks requests sent through a proxy. The proxy resolves the host itself, so the host is resolved
+// and checked before the request is sent.
+type guardedTransport struct {
+	base  *http.Transport
+	guard *addressGuard
+}
+
+func (t *guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.base.Proxy == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	proxyURL, err := t.base.Proxy(req)
+	if err != nil || proxyURL == nil {
+		return t.base.RoundTrip(req)
+	}
+	t.guard.proxies.Store(proxyAddress(proxyURL), struct{}{})
+
+	addrs, err := net.DefaultResolver.LookupNetIP(req.Context(), "ip", req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if err := t.guard.check(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func proxyAddress(proxyURL *url.URL) string {
+	port := proxyURL.Port()
+	if port == "" {
+		switch proxyURL.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
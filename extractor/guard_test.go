@@ -0,0 +1,116 @@
+package extractor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	"telegram-ollama-reply-bot/config"
+)
+
+func TestAddressGuard_Check(t *testing.T) {
+	guard := newAddressGuard(config.ExtractorConfig{
+		DeniedNetworks:  config.ParseNetworks("203.0.113.0/24"),
+		AllowedNetworks: config.ParseNetworks("10.1.2.3"),
+	})
+
+	tests := map[string]bool{
+		"127.0.0.1":        false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"10.0.0.1":         false,
+		"172.16.5.4":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"224.0.0.1":        false,
+		"203.0.113.7":      false,
+		"64:ff9b::a00:1":   false,
+		"64:ff9b:1::1":     false,
+		"2002:a00:1::1":    false,
+		"10.1.2.3":         true,
+		"8.8.8.8":          true,
+		"2001:4860::8888":  true,
+	}
+	for addr, allowed := range tests {
+		err := guard.check(netip.MustParseAddr(addr))
+		if allowed && err != nil {
+			t.Errorf("%s must be allowed, got %v", addr, err)
+		}
+		if !allowed && !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("%s must be forbidden, got %v", addr, err)
+		}
+	}
+}
+
+func TestHttpClient_BlocksInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(testArticle))
+	}))
+	defer server.Close()
+
+	client, err := NewHttpClient(config.ExtractorConfig{MaxRedirects: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+	for _, target := range []string{server.URL, "http://localhost:" + port} {
+		if _, err := fetchPage(context.Background(), client, target); !errors.Is(err, ErrForbiddenAddress) {
+			t.Fatalf("%s must be forbidden, got %v", target, err)
+		}
+	}
+
+	// The test server itself is allowed, but it redirects to the metadata service
+	client, err = NewHttpClient(config.ExtractorConfig{MaxRedirects: 5, AllowedNetworks: config.ParseNetworks("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := fetchPage(context.Background(), client, server.URL); err != nil {
+		t.Fatalf("allowed address must be fetched, got %v", err)
+	}
+	if _, err := fetchPage(context.Background(), client, server.URL+"/redirect"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("redirect to a forbidden address must fail, got %v", err)
+	}
+}
+
+func TestHttpClient_ChecksProxiedRequests(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(testArticle))
+	}))
+	defer proxy.Close()
+
+	// The proxy on the loopback interface is trusted while the loopback itself is not allowed
+	client, err := NewHttpClient(config.ExtractorConfig{ProxyURL: proxy.URL, AllowedNetworks: config.ParseNetworks("10.1.0.0/16")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := fetchPage(context.Background(), client, "http://10.2.0.1/"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("forbidden address must not be requested through the proxy, got %v", err)
+	}
+	if _, err := fetchPage(context.Background(), client, "http://10.1.0.1/page"); err != nil {
+		t.Fatalf("allowed address must be requested through the proxy, got %v", err)
+	}
+	if len(proxied) != 1 {
+		t.Fatalf("expected 1 proxied request, got %v", proxied)
+	}
+	if u, _ := url.Parse(proxied[0]); u.Host != "10.1.0.1" {
+		t.Fatalf("unexpected proxied request: %s", proxied[0])
+	}
+}
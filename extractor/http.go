@@ -0,0 +1,146 @@
+package extractor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"telegram-ollama-reply-bot/config"
+
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	ErrBodyTooLarge     = errors.New("response body is too large")
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrNotHtml          = errors.New("not an HTML document")
+)
+
+// NewHttpClient creates the client for downloading pages with the User-Agent, proxy, body size and redirect limits
+// from the configuration. Non-public addresses can't be accessed unless they are allowed.
+func NewHttpClient(cfg config.ExtractorConfig) (*http.Client, error) {
+	guard := newAddressGuard(cfg)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = guard.dialContext
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Transport: &limitingTransport{
+			base:        &guardedTransport{base: transport, guard: guard},
+			userAgent:   cfg.UserAgent,
+			maxBodySize: cfg.MaxBodySize,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+
+			return nil
+		},
+		Timeout: cfg.Timeout,
+	}, nil
+}
+
+// limitingTransport sets the User-Agent and stops reading bodies bigger than the limit
+type limitingTransport struct {
+	base        http.RoundTripper
+	userAgent   string
+	maxBodySize int64
+}
+
+func (t *limitingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || t.maxBodySize <= 0 {
+		return resp, err
+	}
+
+	if resp.ContentLength > t.maxBodySize {
+		_ = resp.Body.Close()
+
+		return nil, ErrBodyTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: t.maxBodySize}
+
+	return resp, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// One byte over the limit is allowed to tell the body of exactly the limit size from a bigger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrBodyTooLarge
+	}
+
+	return n, err
+}
+
+// page is a downloaded HTML document converted to UTF-8
+type page struct {
+	html string
+	url  *url.URL
+}
+
+// fetchPage downloads the page. The request is cancelled with the context.
+func fetchPage(ctx context.Context, client *http.Client, pageUrl string) (page, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageUrl, nil)
+	if err != nil {
+		return page{}, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return page{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return page{}, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "html") {
+		return page{}, fmt.Errorf("%w: %s", ErrNotHtml, contentType)
+	}
+
+	body, err := charset.NewReader(resp.Body, contentType)
+	if err != nil {
+		return page{}, err
+	}
+
+	html, err := io.ReadAll(body)
+	if err != nil {
+		return page{}, err
+	}
+
+	return page{html: string(html), url: resp.Request.URL}, nil
+}
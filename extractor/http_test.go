@@ -0,0 +1,133 @@
+package extractor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+)
+
+const testArticle = `<html><head><title>Test article</title></head><body><article>` +
+	`<h1>Test article</h1><p>The first paragraph of the article is long enough to be considered the main content of ` +
+	`the page by the extractors which skip short blocks of text.</p><p>The second paragraph continues the story with ` +
+	`more details, so the page looks like a real article rather than navigation or a footer.</p></article></body></html>`
+
+func newTestClient(t *testing.T, cfg config.ExtractorConfig) *http.Client {
+	t.Helper()
+
+	// Test servers listen on the loopback interface which is denied by default
+	cfg.AllowedNetworks = append(cfg.AllowedNetworks, netip.MustParsePrefix("127.0.0.0/8"))
+	client, err := NewHttpClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return client
+}
+
+func TestMultiExtractor_ExtractsArticle(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/article", http.StatusFound)
+			return
+		}
+		userAgent = r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(testArticle))
+	}))
+	defer server.Close()
+
+	ext := NewExtractor(newTestClient(t, config.ExtractorConfig{UserAgent: "TestBot/1.0", MaxBodySize: 1 << 20, MaxRedirects: 1}))
+
+	article, err := ext.GetArticleFromUrl(context.Background(), server.URL+"/old")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if article.Title != "Test article" || !strings.Contains(article.Text, "The second paragraph") {
+		t.Fatalf("unexpected article: %+v", article)
+	}
+	if article.Url != server.URL+"/article" {
+		t.Fatalf("expected the final URL, got %q", article.Url)
+	}
+	if userAgent != "TestBot/1.0" {
+		t.Fatalf("unexpected User-Agent: %q", userAgent)
+	}
+}
+
+func TestHttpClient_Limits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/big":
+			w.Header().Set("Content-Type", "text/html")
+			// Chunked response without Content-Length
+			for i := 0; i < 100; i++ {
+				_, _ = w.Write([]byte(strings.Repeat("x", 1024)))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, config.ExtractorConfig{MaxBodySize: 10 * 1024, MaxRedirects: 3})
+
+	if _, err := fetchPage(context.Background(), client, server.URL+"/loop"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("expected ErrTooManyRedirects, got %v", err)
+	}
+	if _, err := fetchPage(context.Background(), client, server.URL+"/big"); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+}
+
+func TestMultiExtractor_StopsWhenCancelled(t *testing.T) {
+	requests := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ext := NewExtractor(newTestClient(t, config.ExtractorConfig{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	_, err := ext.GetArticleFromUrl(ctx, server.URL)
+	if !errors.Is(err, ErrExtractFailed) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected cancelled extraction, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("extraction wasn't cancelled in time: %s", elapsed)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("fallback extractor must not run after cancellation, got %d requests", len(requests))
+	}
+}
+
+func TestMultiExtractor_StopsOnForbiddenAddress(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, "http://10.2.0.1/", http.StatusFound)
+	}))
+	defer server.Close()
+
+	ext := NewExtractor(newTestClient(t, config.ExtractorConfig{MaxRedirects: 1}))
+
+	_, err := ext.GetArticleFromUrl(context.Background(), server.URL)
+	if !errors.Is(err, ErrExtractFailed) || !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("expected forbidden address, got %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("fallback extractor must not run for a forbidden address, got %d requests", requests)
+	}
+}
@@ -1,34 +1,68 @@
 package extractor
 
 import (
+	"context"
+	"errors"
 	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/go-shiori/go-readability"
 )
 
-type ReadabilityExtractor struct{}
+type ReadabilityExtractor struct {
+	client *http.Client
+}
 
-func NewReadabilityExtractor() *ReadabilityExtractor {
-	return &ReadabilityExtractor{}
+func NewReadabilityExtractor(client *http.Client) *ReadabilityExtractor {
+	return &ReadabilityExtractor{
+		client: client,
+	}
 }
 
-func (e *ReadabilityExtractor) GetArticleFromUrl(url string) (Article, error) {
+func (e *ReadabilityExtractor) GetArticleFromUrl(ctx context.Context, url string) (Article, error) {
 	slog.Info("readability-extractor: requested extraction from URL ", "url", url)
 
-	article, err := readability.FromURL(url, ExtractionTimeout)
+	page, err := fetchPage(ctx, e.client, url)
+	if err != nil {
+		slog.Error("readability-extractor: failed fetching URL", "url", url, "error", err)
+		if !errors.Is(err, ErrForbiddenAddress) {
+			sentry.CaptureException(err)
+		}
+
+		return Article{}, errors.Join(ErrExtractFailed, err)
+	}
+
+	article, err := articleFromHtml(page.html, page.url)
 	if err != nil {
 		slog.Error("readability-extractor: failed extracting from URL", "url", url)
 		sentry.CaptureException(err)
 
-		return Article{}, ErrExtractFailed
+		return Article{}, errors.Join(ErrExtractFailed, err)
 	}
 
 	slog.Debug("readability-extractor: article extracted", "article", article)
 
-	return Article{
+	return article, nil
+}
+
+// articleFromHtml extracts the article from the HTML document. Relative links are resolved against the page URL
+// unless it's nil.
+func articleFromHtml(html string, pageUrl *url.URL) (Article, error) {
+	article, err := readability.FromReader(strings.NewReader(html), pageUrl)
+	if err != nil {
+		return Article{}, err
+	}
+
+	result := Article{
 		Title: article.Title,
 		Text:  article.TextContent,
-		Url:   url,
-	}, nil
+	}
+	if pageUrl != nil {
+		result.Url = pageUrl.String()
+	}
+
+	return result, nil
 }
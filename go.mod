@@ -8,8 +8,11 @@ require (
 	github.com/advancedlogic/GoOse v0.0.0-20231203033844-ae6b36caf275
 	github.com/getsentry/sentry-go v0.31.1
 	github.com/go-shiori/go-readability v0.0.0-20250217085726-9f5bf5ca7612
+	github.com/ledongthuc/pdf v0.0.0-20220302134840-0c2507a12d80
 	github.com/mymmrac/telego v1.0.2
 	github.com/sashabaranov/go-openai v1.38.1
+	go.etcd.io/bbolt v1.4.0
+	golang.org/x/net v0.35.0
 )
 
 require (
@@ -42,7 +45,6 @@ require (
 	github.com/valyala/fasthttp v1.59.0 // indirect
 	github.com/valyala/fastjson v1.6.4 // indirect
 	golang.org/x/arch v0.15.0 // indirect
-	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 )
@@ -0,0 +1,191 @@
+package llm
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"telegram-ollama-reply-bot/audit"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+type auditTaskKey struct{}
+type auditNamesKey struct{}
+
+type auditChatIDKey struct{}
+
+// WithChatID marks LLM requests made with the context as made for the chat in the audit log
+func WithChatID(ctx context.Context, chatID int64) context.Context {
+	return context.WithValue(ctx, auditChatIDKey{}, chatID)
+}
+
+func withAuditTask(ctx context.Context, task string) context.Context {
+	return context.WithValue(ctx, auditTaskKey{}, task)
+}
+
+// withAuditNames passes names of the users and the chat found in the request to the audit log, so they can be
+// redacted there
+func (l *LlmConnector) withAuditNames(ctx context.Context, requestContext RequestContext, messages ...ChatMessage) context.Context {
+	if l.auditLog == nil {
+		return ctx
+	}
+
+	names := []string{
+		requestContext.User.FirstName,
+		requestContext.User.LastName,
+		requestContext.Chat.Title,
+		requestContext.Chat.Description,
+	}
+	messages = append(messages, requestContext.Chat.History...)
+	messages = append(messages, requestContext.Chat.RelevantMemories...)
+	for _, message := range messages {
+		for msg := &message; msg != nil; msg = msg.ReplyTo {
+			names = append(names, msg.Name)
+		}
+	}
+
+	return context.WithValue(ctx, auditNamesKey{}, names)
+}
+
+// SetAuditLog makes the connector write every LLM back-end request to the log
+func (l *LlmConnector) SetAuditLog(log *audit.Logger) {
+	l.auditLog = log
+}
+
+func (l *LlmConnector) newAuditRecord(ctx context.Context, ep *endpoint, model string, started time.Time, err error) audit.Record {
+	record := audit.Record{
+		Time:      started,
+		Endpoint:  ep.name,
+		Model:     model,
+		LatencyMs: time.Since(started).Milliseconds(),
+	}
+	record.Task, _ = ctx.Value(auditTaskKey{}).(string)
+	record.ChatID, _ = ctx.Value(auditChatIDKey{}).(int64)
+	record.Names, _ = ctx.Value(auditNamesKey{}).([]string)
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	return record
+}
+
+func (l *LlmConnector) writeAuditRecord(record audit.Record) {
+	if err := l.auditLog.Write(record); err != nil {
+		slog.Error("llm: Cannot write audit log record", "error", err)
+	}
+}
+
+// auditChat writes the completion request with its result to the audit log
+func (l *LlmConnector) auditChat(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+	started time.Time,
+	reply openai.ChatCompletionMessage,
+	usage *TokenUsage,
+	err error,
+) {
+	if l.auditLog == nil {
+		return
+	}
+
+	record := l.newAuditRecord(ctx, ep, req.Model, started, err)
+	record.Stream = req.Stream
+	record.Params = audit.Params{
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		MaxTokens:        req.MaxTokens,
+		Seed:             req.Seed,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+	}
+	for _, tool := range req.Tools {
+		if tool.Function != nil {
+			record.Params.Tools = append(record.Params.Tools, tool.Function.Name)
+		}
+	}
+
+	for _, msg := range req.Messages {
+		record.Messages = append(record.Messages, toAuditMessage(msg))
+	}
+
+	record.Response = reply.Content
+	record.ToolCalls = toAuditToolCalls(reply.ToolCalls)
+	if usage != nil {
+		record.Reasoning = usage.Reasoning
+		record.Truncated = usage.Truncated
+		record.Usage = &audit.Usage{
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			TotalTokens:      usage.TotalTokens,
+			Cost:             usage.Cost,
+		}
+	}
+
+	l.writeAuditRecord(record)
+}
+
+// auditEmbeddings writes the embeddings request to the audit log. The texts are saved as user messages.
+func (l *LlmConnector) auditEmbeddings(
+	ctx context.Context,
+	ep *endpoint,
+	texts []string,
+	model string,
+	started time.Time,
+	resp openai.EmbeddingResponse,
+	err error,
+) {
+	if l.auditLog == nil {
+		return
+	}
+
+	record := l.newAuditRecord(ctx, ep, model, started, err)
+	for _, text := range texts {
+		record.Messages = append(record.Messages, audit.Message{Role: openai.ChatMessageRoleUser, Content: text})
+	}
+	if err == nil {
+		record.Usage = &audit.Usage{
+			PromptTokens: resp.Usage.PromptTokens,
+			TotalTokens:  resp.Usage.TotalTokens,
+		}
+	}
+
+	l.writeAuditRecord(record)
+}
+
+func toAuditMessage(msg openai.ChatCompletionMessage) audit.Message {
+	result := audit.Message{
+		Role:       msg.Role,
+		Name:       msg.Name,
+		ToolCalls:  toAuditToolCalls(msg.ToolCalls),
+		ToolCallID: msg.ToolCallID,
+	}
+
+	texts := []string{}
+	if msg.Content != "" {
+		texts = append(texts, msg.Content)
+	}
+	for _, part := range msg.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			texts = append(texts, part.Text)
+		case openai.ChatMessagePartTypeImageURL:
+			result.Images++
+		}
+	}
+	result.Content = strings.Join(texts, "\n")
+
+	return result
+}
+
+func toAuditToolCalls(calls []openai.ToolCall) []audit.ToolCall {
+	var result []audit.ToolCall
+	for _, call := range calls {
+		result = append(result, audit.ToolCall{Name: call.Function.Name, Arguments: call.Function.Arguments})
+	}
+
+	return result
+}
@@ -0,0 +1,73 @@
+package llm
+
+import (
+	"context"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// backend is the API of an LLM server. Requests and responses use the OpenAI types, so the rest of the connector
+// doesn't depend on the API which is actually used.
+type backend interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chatStream, error)
+	CreateEmbeddings(ctx context.Context, req openai.EmbeddingRequest) (openai.EmbeddingResponse, error)
+	// ListModels returns the names of the models available on the server
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// modelPuller is implemented by back-ends which can download missing models
+type modelPuller interface {
+	PullModel(ctx context.Context, model string) error
+}
+
+// chatStream is the stream of completion chunks. Close may be called more than once.
+type chatStream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+func newBackend(epCfg config.EndpointConfig, cfg config.LLMConfig) backend {
+	if epCfg.Backend == config.BackendOllama {
+		return newOllamaBackend(epCfg.BaseURL, epCfg.Token, cfg.Ollama, cfg.Context)
+	}
+
+	clientCfg := openai.DefaultConfig(epCfg.Token)
+	clientCfg.BaseURL = epCfg.BaseURL
+	clientCfg.HTTPClient = newResponseInspectingClient()
+
+	return &openAIBackend{client: openai.NewClientWithConfig(clientCfg)}
+}
+
+// openAIBackend uses an OpenAI compatible API
+type openAIBackend struct {
+	client *openai.Client
+}
+
+func (b *openAIBackend) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return b.client.CreateChatCompletion(ctx, req)
+}
+
+func (b *openAIBackend) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chatStream, error) {
+	return b.client.CreateChatCompletionStream(ctx, req)
+}
+
+func (b *openAIBackend) CreateEmbeddings(ctx context.Context, req openai.EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	return b.client.CreateEmbeddings(ctx, req)
+}
+
+func (b *openAIBackend) ListModels(ctx context.Context) ([]string, error) {
+	modelList, err := b.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(modelList.Models))
+	for _, model := range modelList.Models {
+		ids = append(ids, model.ID)
+	}
+
+	return ids, nil
+}
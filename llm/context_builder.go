@@ -0,0 +1,186 @@
+package llm
+
+import (
+	"log/slog"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// Role markers and separators which the chat template adds to each message
+	messageTokenOverhead = 4
+	// Reply chain messages are cropped instead of being dropped unless there's less space than this
+	minCompressedMessageTokens = 32
+	// Typical cost of a downscaled image for vision models
+	imageTokens = 765
+)
+
+// estimateTokens roughly estimates the token count of the text without a model specific tokenizer. English text is
+// about 4 characters per token while other scripts usually take more tokens per character.
+func estimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+
+	return (ascii+3)/4 + (other+1)/2
+}
+
+func estimateMessageTokens(message openai.ChatCompletionMessage) int {
+	tokens := estimateTokens(message.Content) + messageTokenOverhead
+	for _, part := range message.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			tokens += estimateTokens(part.Text)
+		case openai.ChatMessagePartTypeImageURL:
+			tokens += imageTokens
+		}
+	}
+
+	return tokens
+}
+
+// cropToTokens cuts the end of the text so its estimated size doesn't exceed the limit
+func cropToTokens(text string, limit int) string {
+	if estimateTokens(text) <= limit {
+		return text
+	}
+
+	runes := []rune(text)
+	low, high := 0, len(runes)
+	for low < high {
+		mid := (low + high + 1) / 2
+		if estimateTokens(string(runes[:mid])+"…") <= limit {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+
+	return string(runes[:low]) + "…"
+}
+
+// fitHistory selects the history messages which fit into the token budget. The newest messages are preferred while
+// messages from the reply chain of the current message are always kept, cropped if necessary.
+func fitHistory(history []ChatMessage, current ChatMessage, budget int) []ChatMessage {
+	if len(history) == 0 {
+		return history
+	}
+
+	messages := make([]ChatMessage, len(history))
+	copy(messages, history)
+
+	costs := make([]int, len(messages))
+	total := 0
+	for i, msg := range messages {
+		costs[i] = estimateMessageTokens(chatMessageToOpenAiChatCompletionMessage(msg))
+		total += costs[i]
+	}
+	if total <= budget {
+		return messages
+	}
+
+	chain := replyChain(messages, current)
+	keep := make([]bool, len(messages))
+	remaining := budget
+
+	// Reply chain goes first since the current message can't be understood without it
+	for i := len(messages) - 1; i >= 0; i-- {
+		if !chain[i] {
+			continue
+		}
+
+		if costs[i] > remaining {
+			// Everything except the text itself (author, quoted reply, overhead) is kept as is
+			textLimit := remaining - (costs[i] - estimateTokens(messages[i].Text))
+			if textLimit < minCompressedMessageTokens {
+				continue
+			}
+			messages[i].Text = cropToTokens(messages[i].Text, textLimit)
+			costs[i] = estimateMessageTokens(chatMessageToOpenAiChatCompletionMessage(messages[i]))
+			if costs[i] > remaining {
+				continue
+			}
+		}
+
+		keep[i] = true
+		remaining -= costs[i]
+	}
+
+	// The rest of the space is filled with the newest messages without gaps
+	for i := len(messages) - 1; i >= 0; i-- {
+		if chain[i] {
+			continue
+		}
+		if costs[i] > remaining {
+			break
+		}
+
+		keep[i] = true
+		remaining -= costs[i]
+	}
+
+	result := make([]ChatMessage, 0, len(messages))
+	for i, msg := range messages {
+		if keep[i] {
+			result = append(result, msg)
+		}
+	}
+
+	slog.Debug("llm: Chat history is cropped to fit into the context",
+		"budget", budget,
+		"estimated_tokens", total,
+		"kept", len(result),
+		"dropped", len(messages)-len(result),
+	)
+
+	return result
+}
+
+// replyChain marks history messages the current message replies to directly or through other replies. Replies to
+// any part of a split message are matched.
+func replyChain(history []ChatMessage, current ChatMessage) []bool {
+	byID := make(map[int]int, len(history))
+	for i, msg := range history {
+		if msg.MessageID != 0 {
+			byID[msg.MessageID] = i
+		}
+		for _, partID := range msg.PartIDs {
+			byID[partID] = i
+		}
+	}
+
+	chain := make([]bool, len(history))
+	next := current.ReplyTo
+	for next != nil && next.MessageID != 0 {
+		i, found := byID[next.MessageID]
+		if !found || chain[i] {
+			break
+		}
+
+		chain[i] = true
+		next = history[i].ReplyTo
+	}
+
+	return chain
+}
+
+// historyBudget calculates how many tokens are left for the chat history in the request to the model
+func (l *LlmConnector) historyBudget(model string, fixed []openai.ChatCompletionMessage) (int, bool) {
+	contextSize := l.cfg.Context.SizeFor(model)
+	if contextSize <= 0 {
+		return 0, false
+	}
+
+	budget := contextSize - l.cfg.Context.ReservedCompletionTokens
+	for _, msg := range fixed {
+		budget -= estimateMessageTokens(msg)
+	}
+
+	return max(budget, 0), true
+}
@@ -0,0 +1,75 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	if got := estimateTokens(strings.Repeat("a", 40)); got != 10 {
+		t.Fatalf("unexpected estimate for ASCII text: %d", got)
+	}
+	if got := estimateTokens(strings.Repeat("я", 40)); got != 20 {
+		t.Fatalf("unexpected estimate for Cyrillic text: %d", got)
+	}
+}
+
+func TestFitHistory_KeepsEverythingWithinBudget(t *testing.T) {
+	history := []ChatMessage{{Name: "a", Text: "one"}, {Name: "b", Text: "two"}}
+	if got := fitHistory(history, ChatMessage{Text: "three"}, 1000); len(got) != 2 {
+		t.Fatalf("expected whole history, got %+v", got)
+	}
+}
+
+func TestFitHistory_DropsOldestAndKeepsReplyChain(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+	history := []ChatMessage{
+		{MessageID: 1, Name: "a", Text: "question " + long},
+		{MessageID: 2, Name: "bot", IsMe: true, Text: "answer " + long, ReplyTo: &ChatMessage{MessageID: 1}},
+		{MessageID: 3, Name: "c", Text: "unrelated " + long},
+		{MessageID: 4, Name: "d", Text: "recent " + long},
+	}
+	current := ChatMessage{MessageID: 5, Name: "a", Text: "follow up", ReplyTo: &ChatMessage{MessageID: 2}}
+
+	// Enough space for 3 messages: the reply chain and the most recent one
+	budget := 3 * estimateMessageTokens(chatMessageToOpenAiChatCompletionMessage(history[3]))
+	got := fitHistory(history, current, budget)
+
+	var ids []int
+	for _, msg := range got {
+		ids = append(ids, msg.MessageID)
+	}
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 4 {
+		t.Fatalf("unexpected messages kept: %v", ids)
+	}
+}
+
+func TestReplyChain_MatchesReplyParts(t *testing.T) {
+	history := []ChatMessage{
+		{MessageID: 1, Name: "a", Text: "question"},
+		{MessageID: 2, PartIDs: []int{3, 4}, Name: "bot", IsMe: true, Text: "long answer", ReplyTo: &ChatMessage{MessageID: 1}},
+		{MessageID: 5, Name: "c", Text: "unrelated"},
+	}
+	current := ChatMessage{MessageID: 6, Name: "a", Text: "about the last part", ReplyTo: &ChatMessage{MessageID: 4}}
+
+	chain := replyChain(history, current)
+	if !chain[0] || !chain[1] || chain[2] {
+		t.Fatalf("reply to a part must keep the whole chain, got %v", chain)
+	}
+}
+
+func TestFitHistory_CropsReplyChainMessage(t *testing.T) {
+	history := []ChatMessage{
+		{MessageID: 1, Name: "a", Text: strings.Repeat("long text ", 200)},
+		{MessageID: 2, Name: "b", Text: "recent"},
+	}
+	current := ChatMessage{Text: "what?", ReplyTo: &ChatMessage{MessageID: 1}}
+
+	got := fitHistory(history, current, 100)
+	if len(got) != 1 || got[0].MessageID != 1 || !strings.HasSuffix(got[0].Text, "…") {
+		t.Fatalf("expected cropped reply chain message, got %+v", got)
+	}
+	if cost := estimateMessageTokens(chatMessageToOpenAiChatCompletionMessage(got[0])); cost > 100 {
+		t.Fatalf("cropped message doesn't fit: %d", cost)
+	}
+}
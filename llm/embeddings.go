@@ -0,0 +1,72 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+var (
+	ErrEmbeddingsDisabled = errors.New("embeddings model is not configured")
+	ErrInvalidEmbeddings  = errors.New("invalid embeddings response")
+)
+
+// HasEmbeddings checks if the embeddings model is configured
+func (l *LlmConnector) HasEmbeddings() bool {
+	return len(l.cfg.Models.EmbeddingsModel) > 0
+}
+
+// Embed converts the texts into vectors for the semantic search. Vectors are returned in the order of the texts.
+func (l *LlmConnector) Embed(ctx context.Context, texts []string) ([][]float32, *TokenUsage, error) {
+	if !l.HasEmbeddings() {
+		return nil, nil, ErrEmbeddingsDisabled
+	}
+
+	var vectors [][]float32
+	var usage *TokenUsage
+
+	model, err := l.withFallback(ctx, TaskEmbeddings, l.cfg.Models.EmbeddingsModel, func(ctx context.Context, ep *endpoint, model string) error {
+		started := time.Now()
+		resp, err := l.createEmbeddings(ctx, ep, openai.EmbeddingRequest{
+			Input: texts,
+			Model: openai.EmbeddingModel(model),
+		})
+		l.auditEmbeddings(ctx, ep, texts, model, started, resp, err)
+		if err != nil {
+			reportRequestError("llm: Embeddings request failed", model, err)
+
+			return errors.Join(ErrLlmBackendRequestFailed, err)
+		}
+		if len(resp.Data) != len(texts) {
+			slog.Error("llm: Unexpected embeddings count", "model", model, "expected", len(texts), "got", len(resp.Data))
+
+			return ErrInvalidEmbeddings
+		}
+
+		vectors = make([][]float32, len(texts))
+		for _, embedding := range resp.Data {
+			if embedding.Index < 0 || embedding.Index >= len(texts) {
+				return ErrInvalidEmbeddings
+			}
+			vectors[embedding.Index] = embedding.Embedding
+		}
+
+		usage = &TokenUsage{
+			PromptTokens: resp.Usage.PromptTokens,
+			TotalTokens:  resp.Usage.TotalTokens,
+			Cost:         l.embeddingsCost(ep, model, resp.Usage.PromptTokens),
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	usage.Model = model
+	usage.Task = TaskEmbeddings
+
+	return vectors, usage, nil
+}
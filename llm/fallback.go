@@ -0,0 +1,106 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"telegram-ollama-reply-bot/config"
+)
+
+const defaultEndpointName = "default"
+
+var ErrNoModelsAvailable = errors.New("no models available for the task")
+
+// endpoint is an LLM API with its own circuit breaker
+type endpoint struct {
+	name    string
+	backend backend
+	breaker *circuitBreaker
+}
+
+func newEndpoint(name string, epCfg config.EndpointConfig, cfg config.LLMConfig) *endpoint {
+	return &endpoint{
+		name:    name,
+		backend: newBackend(epCfg, cfg),
+		breaker: newCircuitBreaker(cfg.Breaker),
+	}
+}
+
+// finalError stops falling through the model chain, e.g. when a part of the reply is already streamed to the user
+type finalError struct {
+	err error
+}
+
+func (e finalError) Error() string {
+	return e.err.Error()
+}
+
+func (e finalError) Unwrap() error {
+	return e.err
+}
+
+func (l *LlmConnector) endpointFor(ref config.ModelRef) *endpoint {
+	if ref.Endpoint == "" {
+		return l.endpoints[defaultEndpointName]
+	}
+
+	return l.endpoints[ref.Endpoint]
+}
+
+// withFallback calls the models of the chain one by one until one of them succeeds. Returns the model which replied.
+func (l *LlmConnector) withFallback(
+	ctx context.Context,
+	task string,
+	chain config.ModelChain,
+	call func(ctx context.Context, ep *endpoint, model string) error,
+) (string, error) {
+	ctx = withAuditTask(ctx, task)
+
+	var lastErr error
+	for i, ref := range chain {
+		if l.missingModels[ref.String()] {
+			continue
+		}
+
+		ep := l.endpointFor(ref)
+		if ep == nil {
+			slog.Error("llm: Unknown endpoint for model", "task", task, "model", ref.String())
+			continue
+		}
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if l.cfg.ModelTimeout > 0 && i < len(chain)-1 {
+			attemptCtx, cancel = context.WithTimeout(ctx, l.cfg.ModelTimeout)
+		}
+
+		err := call(attemptCtx, ep, ref.Name)
+		cancel()
+		if err == nil {
+			slog.Debug("llm: Model replied", "task", task, "model", ref.String())
+
+			return ref.String(), nil
+		}
+		lastErr = err
+
+		var final finalError
+		if errors.As(err, &final) {
+			return ref.String(), final.err
+		}
+		if ctx.Err() != nil || errors.Is(err, ErrTemplateProcessing) {
+			return ref.String(), err
+		}
+
+		if i < len(chain)-1 {
+			slog.Warn("llm: Model failed, falling back to the next one", "task", task, "model", ref.String(), "error", err)
+		}
+	}
+
+	if lastErr == nil {
+		slog.Error("llm: No models available", "task", task, "chain", chain.String())
+
+		return "", ErrNoModelsAvailable
+	}
+
+	return "", lastErr
+}
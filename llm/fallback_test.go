@@ -0,0 +1,77 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+)
+
+func newModelServer(t *testing.T, models []string, failing map[string]bool) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path == "/models" {
+			var list struct {
+				Data []map[string]string `json:"data"`
+			}
+			for _, model := range models {
+				list.Data = append(list.Data, map[string]string{"id": model})
+			}
+			_ = json.NewEncoder(w).Encode(list)
+			return
+		}
+
+		var req struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if failing[req.Model] {
+			http.Error(w, "model crashed", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"reply from ` + req.Model + `"}}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestLlmConnector_FallsBackToNextModel(t *testing.T) {
+	primary := newModelServer(t, []string{"big", "small"}, map[string]bool{"big": true})
+	secondary := newModelServer(t, []string{"remote"}, nil)
+
+	models := config.ModelSelection{
+		TextRequestModel: config.ParseModelChain("missing, big, remote@backup"),
+		SummarizeModel:   config.ParseModelChain("small"),
+	}
+	tp, err := NewTemplateProcessor(config.PromptConfig{ChatSystemPrompt: "You're {{.Model}}"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: primary.URL,
+		Models:     models,
+		Endpoints:  map[string]config.EndpointConfig{"backup": {BaseURL: secondary.URL}},
+		Retry:      config.RetryConfig{MaxAttempts: 1, BaseDelay: time.Millisecond},
+	}, tp)
+
+	hasAll, result := l.HasAllModels(context.Background(), models)
+	if !hasAll || result["missing"] || !result["remote@backup"] {
+		t.Fatalf("unexpected model check result: %t %v", hasAll, result)
+	}
+
+	reply, usage, err := l.HandleChatMessage(context.Background(), ChatMessage{Text: "hi"}, RequestContext{Empty: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply != "reply from remote" || usage.Model != "remote@backup" {
+		t.Fatalf("unexpected reply %q from %q", reply, usage.Model)
+	}
+}
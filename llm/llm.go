@@ -4,9 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"slices"
+	"strings"
+	"sync/atomic"
+	"telegram-ollama-reply-bot/audit"
 	"telegram-ollama-reply-bot/config"
+	"time"
+	"unicode/utf8"
 
 	"encoding/base64"
 
@@ -14,6 +20,15 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+// Kinds of LLM requests
+const (
+	TaskChat             = "chat"
+	TaskSummarize        = "summarize"
+	TaskImageRecognition = "image_recognition"
+	TaskHistorySummary   = "history_summary"
+	TaskEmbeddings       = "embeddings"
+)
+
 var (
 	ErrLlmBackendRequestFailed = errors.New("llm back-end request failed")
 	ErrNoChoices               = errors.New("no choices in LLM response")
@@ -21,9 +36,14 @@ var (
 )
 
 type LlmConnector struct {
-	client            *openai.Client
+	endpoints         map[string]*endpoint
 	cfg               config.LLMConfig
 	templateProcessor *TemplateProcessor
+	tools             *ToolRegistry
+	retries           atomic.Uint64
+	// missingModels is filled by HasAllModels on startup and contains models which are skipped in the chains
+	missingModels map[string]bool
+	auditLog      *audit.Logger
 }
 
 type TokenUsage struct {
@@ -31,34 +51,302 @@ type TokenUsage struct {
 	CompletionTokens int
 	TotalTokens      int
 	Cost             float64
+	// Model is the model which actually produced the reply
+	Model string
+	// Task is the kind of request, one of Task* constants
+	Task string
+	// ToolCalls contains tools called by the model while handling the request
+	ToolCalls []ToolCall
+	// Reasoning is the thinking of a reasoning model. It's never a part of the reply text.
+	Reasoning string
+	// Truncated is true when the reply was cut by the max tokens limit
+	Truncated bool
 }
 
-func NewConnector(cfg config.LLMConfig, templateProcessor *TemplateProcessor) *LlmConnector {
-	clientCfg := openai.DefaultConfig(cfg.APIToken)
-	clientCfg.BaseURL = cfg.APIBaseURL
+func (u *TokenUsage) add(other *TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.Cost += other.Cost
+	u.Reasoning = joinReasoning(u.Reasoning, other.Reasoning)
+	u.Truncated = other.Truncated
+}
 
-	client := openai.NewClientWithConfig(clientCfg)
+func NewConnector(cfg config.LLMConfig, templateProcessor *TemplateProcessor) *LlmConnector {
+	endpoints := map[string]*endpoint{
+		defaultEndpointName: newEndpoint(defaultEndpointName, config.EndpointConfig{
+			BaseURL: cfg.APIBaseURL,
+			Token:   cfg.APIToken,
+			Backend: cfg.APIBackend,
+		}, cfg),
+	}
+	for name, epCfg := range cfg.Endpoints {
+		endpoints[name] = newEndpoint(name, epCfg, cfg)
+	}
 
 	return &LlmConnector{
-		client:            client,
+		endpoints:         endpoints,
 		cfg:               cfg,
 		templateProcessor: templateProcessor,
+		tools:             NewToolRegistry(),
+		missingModels:     map[string]bool{},
 	}
 }
 
 func (l *LlmConnector) HandleChatMessage(ctx context.Context, userMessage ChatMessage, requestContext RequestContext) (string, *TokenUsage, error) {
-	systemPrompt, err := l.templateProcessor.ProcessChatTemplate(l.cfg.Models.TextRequestModel, requestContext.Prompt())
+	ctx = l.withAuditNames(ctx, requestContext, userMessage)
+
+	var reply string
+	var usage *TokenUsage
+
+	model, err := l.withFallback(ctx, TaskChat, l.cfg.Models.TextRequestModel, func(ctx context.Context, ep *endpoint, model string) error {
+		req, err := l.createChatRequest(model, userMessage, requestContext)
+		if err != nil {
+			return err
+		}
+
+		if l.toolsEnabled() {
+			reply, usage, err = l.completeWithTools(ctx, ep, req, requestContext)
+		} else {
+			reply, usage, err = l.complete(ctx, ep, req)
+		}
+
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	usage.Model = model
+	usage.Task = TaskChat
+
+	return reply, usage, nil
+}
+
+// StreamChatMessage works like HandleChatMessage but receives the completion in chunks. onUpdate is called with the
+// accumulated reply text each time a new chunk arrives.
+func (l *LlmConnector) StreamChatMessage(
+	ctx context.Context,
+	userMessage ChatMessage,
+	requestContext RequestContext,
+	onUpdate func(text string),
+) (string, *TokenUsage, error) {
+	if l.toolsEnabled() {
+		// Tool calls are requested in the middle of the reply, so the reply is shown only when it's complete
+		reply, usage, err := l.HandleChatMessage(ctx, userMessage, requestContext)
+		if err == nil {
+			onUpdate(reply)
+		}
+
+		return reply, usage, err
+	}
+	ctx = l.withAuditNames(ctx, requestContext, userMessage)
+
+	var reply string
+	var usage *TokenUsage
+
+	model, err := l.withFallback(ctx, TaskChat, l.cfg.Models.TextRequestModel, func(ctx context.Context, ep *endpoint, model string) error {
+		req, err := l.createChatRequest(model, userMessage, requestContext)
+		if err != nil {
+			return err
+		}
+
+		reply, usage, err = l.stream(ctx, ep, req, onUpdate)
+
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	usage.Model = model
+	usage.Task = TaskChat
+
+	return reply, usage, nil
+}
+
+func (l *LlmConnector) stream(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+	onUpdate func(text string),
+) (string, *TokenUsage, error) {
+	req.Stream = true
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+	started := time.Now()
+	reply, usage, err := l.receiveStream(ctx, ep, req, onUpdate)
+	l.auditChat(ctx, ep, req, started, openai.ChatCompletionMessage{Content: reply}, usage, err)
+
+	return reply, usage, err
+}
+
+func (l *LlmConnector) receiveStream(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+	onUpdate func(text string),
+) (string, *TokenUsage, error) {
+
+	recorder := &responseRecorder{}
+	stream, err := l.createChatCompletionStream(withResponseRecorder(ctx, recorder), ep, req)
+	if err != nil {
+		reportRequestError("llm: LLM back-end stream request failed", req.Model, err)
+
+		return "", nil, errors.Join(ErrLlmBackendRequestFailed, err)
+	}
+	defer stream.Close()
+
+	var reply strings.Builder
+	var shown string
+	usage := &TokenUsage{}
+	hasChoices := false
+
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			slog.Error("llm: LLM back-end stream failed", "model", req.Model, "error", err)
+			sentry.CaptureException(err)
+
+			err = errors.Join(ErrLlmBackendRequestFailed, err)
+			if shown != "" {
+				// The user has already seen a part of this reply, so another model can't continue it
+				return "", nil, finalError{err: err}
+			}
+
+			return "", nil, err
+		}
+
+		if chunk.Usage != nil {
+			usage.PromptTokens = chunk.Usage.PromptTokens
+			usage.CompletionTokens = chunk.Usage.CompletionTokens
+			usage.TotalTokens = chunk.Usage.TotalTokens
+		}
+
+		if len(chunk.Choices) < 1 {
+			continue
+		}
+		hasChoices = true
+
+		if chunk.Choices[0].FinishReason == openai.FinishReasonLength {
+			slog.Warn("llm: Streamed reply is cut by the max tokens limit", "model", req.Model, "max_tokens", req.MaxTokens)
+			usage.Truncated = true
+		}
+
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			reply.WriteString(delta)
+
+			// Only the answer is shown, so nothing is updated while the model is thinking
+			_, answer := splitReasoning(reply.String())
+			if answer != shown && !isPartialThinkTag(answer) {
+				shown = answer
+				onUpdate(answer)
+			}
+		}
+	}
+
+	if !hasChoices {
+		slog.Error("llm: LLM back-end stream has no choices", "model", req.Model)
+		sentry.CaptureMessage("LLM back-end stream has no choices")
+
+		return "", nil, ErrNoChoices
+	}
+
+	// The reported cost and reasoning are parsed when the body is closed
+	_ = stream.Close()
+	usage.Cost = l.calculateCost(ep, req, usage, recorder)
+
+	slog.Debug("llm: Received LLM back-end stream", "model", req.Model, "reply", reply.String(), "usage", usage)
+
+	reasoning, answer := splitReasoning(reply.String())
+	usage.Reasoning = joinReasoning(recorder.getReasoning(), reasoning)
+
+	return answer, usage, nil
+}
+
+// complete sends a non-streaming completion request and extracts the reply from the response
+func (l *LlmConnector) complete(ctx context.Context, ep *endpoint, req openai.ChatCompletionRequest) (string, *TokenUsage, error) {
+	message, usage, err := l.completeMessage(ctx, ep, req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return message.Content, usage, nil
+}
+
+func (l *LlmConnector) completeMessage(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+) (openai.ChatCompletionMessage, *TokenUsage, error) {
+	started := time.Now()
+	message, usage, err := l.requestCompletion(ctx, ep, req)
+	l.auditChat(ctx, ep, req, started, message, usage, err)
+
+	return message, usage, err
+}
+
+func (l *LlmConnector) requestCompletion(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+) (openai.ChatCompletionMessage, *TokenUsage, error) {
+	recorder := &responseRecorder{}
+	resp, err := l.createChatCompletion(withResponseRecorder(ctx, recorder), ep, req)
+	if err != nil {
+		reportRequestError("llm: LLM back-end request failed", req.Model, err)
+
+		return openai.ChatCompletionMessage{}, nil, errors.Join(ErrLlmBackendRequestFailed, err)
+	}
+
+	slog.Debug("llm: Received LLM back-end response", "model", req.Model, "response", resp)
+
+	if len(resp.Choices) < 1 {
+		slog.Error("llm: LLM back-end reply has no choices", "model", req.Model)
+		sentry.CaptureMessage("LLM back-end reply has no choices")
+
+		return openai.ChatCompletionMessage{}, nil, ErrNoChoices
+	}
+
+	usage := &TokenUsage{
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+		TotalTokens:      resp.Usage.TotalTokens,
+	}
+	usage.Cost = l.calculateCost(ep, req, usage, recorder)
+
+	if resp.Choices[0].FinishReason == openai.FinishReasonLength {
+		slog.Warn("llm: Reply is cut by the max tokens limit", "model", req.Model, "max_tokens", req.MaxTokens)
+		usage.Truncated = true
+	}
+
+	message := resp.Choices[0].Message
+	reasoning, answer := splitReasoning(message.Content)
+	message.Content = answer
+	usage.Reasoning = joinReasoning(recorder.getReasoning(), reasoning)
+
+	return message, usage, nil
+}
+
+func (l *LlmConnector) createChatRequest(model string, userMessage ChatMessage, requestContext RequestContext) (openai.ChatCompletionRequest, error) {
+	promptModel := l.cfg.Models.TextRequestModel.Primary()
+	if l.cfg.PromptActualModel {
+		promptModel = model
+	}
+
+	systemPrompt, err := l.templateProcessor.ProcessChatTemplate(promptModel, requestContext.Prompt())
 	if err != nil {
 		slog.Error("llm: Template processing failed", "error", err)
 		sentry.CaptureException(err)
-		return "", nil, ErrTemplateProcessing
+		return openai.ChatCompletionRequest{}, ErrTemplateProcessing
 	}
 
 	history := requestContext.Chat.History
 	earlierSummary := requestContext.Chat.EarlierSummary
 
 	req := openai.ChatCompletionRequest{
-		Model: l.cfg.Models.TextRequestModel,
+		Model: model,
 		Messages: []openai.ChatCompletionMessage{
 			{
 				Role:    openai.ChatMessageRoleSystem,
@@ -66,6 +354,7 @@ func (l *LlmConnector) HandleChatMessage(ctx context.Context, userMessage ChatMe
 			},
 		},
 	}
+	applyGenerationParams(&req, l.cfg.Generation.Chat)
 
 	if earlierSummary != "" {
 		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
@@ -74,38 +363,51 @@ func (l *LlmConnector) HandleChatMessage(ctx context.Context, userMessage ChatMe
 		})
 	}
 
-	if len(history) > 0 {
-		for _, msg := range history {
-			req.Messages = append(req.Messages, chatMessageToOpenAiChatCompletionMessage(msg))
-		}
+	if len(requestContext.Chat.RelevantMemories) > 0 {
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: relevantMemoriesToText(requestContext.Chat.RelevantMemories),
+		})
 	}
 
-	req.Messages = append(req.Messages, chatMessageToOpenAiChatCompletionMessage(userMessage))
+	currentMessage := chatMessageToOpenAiChatCompletionMessage(userMessage)
 
-	resp, err := l.client.CreateChatCompletion(ctx, req)
-	if err != nil {
-		slog.Error("llm: LLM back-end request failed", "error", err)
-		sentry.CaptureException(err)
+	if budget, limited := l.historyBudget(model, append(req.Messages, currentMessage)); limited {
+		history = fitHistory(history, userMessage, budget)
+	}
 
-		return "", nil, errors.Join(ErrLlmBackendRequestFailed, err)
+	if len(history) > 0 {
+		for _, msg := range history {
+			req.Messages = append(req.Messages, chatMessageToOpenAiChatCompletionMessage(msg))
+		}
 	}
 
-	slog.Debug("llm: Received LLM back-end response", "response", resp)
+	req.Messages = append(req.Messages, currentMessage)
 
-	if len(resp.Choices) < 1 {
-		slog.Error("llm: LLM back-end reply has no choices")
-		sentry.CaptureMessage("LLM back-end reply has no choices")
+	return req, nil
+}
 
-		return "", nil, ErrNoChoices
-	}
+// applyGenerationParams sets the sampling parameters and limits of the request
+func applyGenerationParams(req *openai.ChatCompletionRequest, params config.GenerationParams) {
+	req.Temperature = params.Temperature
+	req.TopP = params.TopP
+	req.MaxTokens = params.MaxTokens
+	req.Seed = params.Seed
+	req.Stop = params.Stop
+	req.PresencePenalty = params.PresencePenalty
+	req.FrequencyPenalty = params.FrequencyPenalty
+}
 
-	usage := &TokenUsage{
-		PromptTokens:     resp.Usage.PromptTokens,
-		CompletionTokens: resp.Usage.CompletionTokens,
-		TotalTokens:      resp.Usage.TotalTokens,
+// cropToLastSentence drops the unfinished sentence of the reply cut by the max tokens limit. Replies without
+// complete sentences are kept as is.
+func cropToLastSentence(text string) string {
+	end := strings.LastIndexAny(strings.TrimRight(text, " \t\n"), ".!?…\n")
+	if end <= 0 {
+		return text
 	}
+	_, size := utf8.DecodeRuneInString(text[end:])
 
-	return resp.Choices[0].Message.Content, usage, nil
+	return strings.TrimSpace(text[:end+size])
 }
 
 func (l *LlmConnector) Summarize(ctx context.Context, text string, instructions string) (string, *TokenUsage, error) {
@@ -120,84 +422,260 @@ func (l *LlmConnector) Summarize(ctx context.Context, text string, instructions
 		systemPrompt = systemPrompt + "\n\nAdditional instruction from user:\n\n>" + instructions
 	}
 
-	req := openai.ChatCompletionRequest{
-		Model: l.cfg.Models.SummarizeModel,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: systemPrompt,
-			},
-		},
+	if budget, limited := l.summarizeChunkBudget(systemPrompt); limited && estimateTokens(text) > budget {
+		return l.summarizeInChunks(ctx, text, instructions, systemPrompt, budget)
+	}
+
+	reply, usage, err := l.summarizeOnce(ctx, systemPrompt, text)
+	if err != nil {
+		return "", nil, err
 	}
+	if usage.Truncated {
+		reply = cropToLastSentence(reply)
+	}
+
+	return reply, usage, nil
+}
+
+// summarizeOnce sends the text to the summarize model in a single request
+func (l *LlmConnector) summarizeOnce(ctx context.Context, systemPrompt string, text string) (string, *TokenUsage, error) {
+	if timeout, ok := ctx.Value(summarizeRequestTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var reply string
+	var usage *TokenUsage
+
+	model, err := l.withFallback(ctx, TaskSummarize, l.cfg.Models.SummarizeModel, func(ctx context.Context, ep *endpoint, model string) error {
+		req := openai.ChatCompletionRequest{
+			Model: model,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: systemPrompt,
+				},
+			},
+		}
+
+		applyGenerationParams(&req, l.cfg.Generation.Summarize)
+
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: text,
+		})
+
+		var err error
+		reply, usage, err = l.complete(ctx, ep, req)
 
-	req.Messages = append(req.Messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: text,
+		return err
 	})
+	if err != nil {
+		return "", nil, err
+	}
+	usage.Model = model
+	usage.Task = TaskSummarize
+
+	return reply, usage, nil
+}
 
-	resp, err := l.client.CreateChatCompletion(ctx, req)
+// SummarizeHistory merges the previous summary of the chat with the new messages into an updated summary
+func (l *LlmConnector) SummarizeHistory(ctx context.Context, previousSummary string, messages []ChatMessage) (string, *TokenUsage, error) {
+	systemPrompt, err := l.templateProcessor.ProcessHistorySummaryTemplate()
 	if err != nil {
-		slog.Error("llm: LLM back-end request failed", "error", err)
+		slog.Error("llm: Template processing failed", "error", err)
 		sentry.CaptureException(err)
+		return "", nil, ErrTemplateProcessing
+	}
 
-		return "", nil, errors.Join(ErrLlmBackendRequestFailed, err)
+	input := "<previous_summary>\n" + previousSummary + "\n</previous_summary>\n\n" +
+		"<new_messages>\n" + chatHistoryToPlainText(messages) + "</new_messages>"
+	ctx = l.withAuditNames(ctx, RequestContext{}, messages...)
+
+	var reply string
+	var usage *TokenUsage
+
+	model, err := l.withFallback(ctx, TaskHistorySummary, l.cfg.Models.HistorySummaryModel, func(ctx context.Context, ep *endpoint, model string) error {
+		req := openai.ChatCompletionRequest{
+			Model: model,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: systemPrompt,
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: input,
+				},
+			},
+		}
+
+		applyGenerationParams(&req, l.cfg.Generation.HistorySummary)
+
+		var err error
+		reply, usage, err = l.complete(ctx, ep, req)
+
+		return err
+	})
+	if err != nil {
+		return "", nil, err
 	}
+	usage.Model = model
+	usage.Task = TaskHistorySummary
 
-	slog.Debug("llm: Received LLM back-end response", "response", resp)
+	return reply, usage, nil
+}
 
-	if len(resp.Choices) < 1 {
-		slog.Error("llm: LLM back-end reply has no choices")
-		sentry.CaptureMessage("LLM back-end reply has no choices")
+// HasAllModels checks if every task has at least one available model. Models missing on their endpoints are
+// excluded from the fallback chains. The image recognition model is optional.
+func (l *LlmConnector) HasAllModels(ctx context.Context, models config.ModelSelection) (bool, map[string]bool) {
+	searchResult := map[string]bool{}
+	endpointModels := map[string][]string{}
+
+	for _, chain := range []config.ModelChain{
+		models.TextRequestModel,
+		models.SummarizeModel,
+		models.ImageRecognitionModel,
+		models.HistorySummaryModel,
+		models.EmbeddingsModel,
+	} {
+		for _, ref := range chain {
+			ep := l.endpointFor(ref)
+			if ep == nil {
+				searchResult[ref.String()] = false
+				continue
+			}
+
+			if _, listed := endpointModels[ep.name]; !listed {
+				endpointModels[ep.name] = l.listModels(ctx, ep)
+			}
+			searchResult[ref.String()] = slices.Contains(endpointModels[ep.name], ref.Name)
+
+			if !searchResult[ref.String()] && l.pullModel(ctx, ep, ref.Name) {
+				searchResult[ref.String()] = true
+				endpointModels[ep.name] = append(endpointModels[ep.name], ref.Name)
+			}
+		}
+	}
 
-		return "", nil, ErrNoChoices
+	slog.Info("llm: Checking for requested models", "result", searchResult)
+
+	for model, found := range searchResult {
+		if !found {
+			slog.Warn("llm: Model is not available and will be skipped", "model", model)
+			l.missingModels[model] = true
+		}
 	}
 
-	usage := &TokenUsage{
-		PromptTokens:     resp.Usage.PromptTokens,
-		CompletionTokens: resp.Usage.CompletionTokens,
-		TotalTokens:      resp.Usage.TotalTokens,
+	hasAll := true
+	for task, chain := range map[string]config.ModelChain{
+		"chat":      models.TextRequestModel,
+		"summarize": models.SummarizeModel,
+	} {
+		if !l.hasAvailableModel(chain) {
+			slog.Error("llm: No models available for the task", "task", task, "chain", chain.String())
+			hasAll = false
+		}
+	}
+
+	if len(models.ImageRecognitionModel) > 0 && !l.hasAvailableModel(models.ImageRecognitionModel) {
+		slog.Warn("llm: No image recognition models available", "chain", models.ImageRecognitionModel.String())
+	}
+	if len(models.HistorySummaryModel) > 0 && !l.hasAvailableModel(models.HistorySummaryModel) {
+		slog.Warn("llm: No history summary models available", "chain", models.HistorySummaryModel.String())
+	}
+	if len(models.EmbeddingsModel) > 0 && !l.hasAvailableModel(models.EmbeddingsModel) {
+		slog.Warn("llm: No embeddings models available", "chain", models.EmbeddingsModel.String())
 	}
 
-	return resp.Choices[0].Message.Content, usage, nil
+	return hasAll, searchResult
 }
 
-func (l *LlmConnector) HasAllModels(ctx context.Context, models config.ModelSelection) (bool, map[string]bool) {
-	modelList, err := l.client.ListModels(ctx)
-	if err != nil {
-		slog.Error("llm: Model list request failed", "error", err)
-		sentry.CaptureException(err)
+// pullModel downloads the missing model if the back-end supports it and pulling is enabled. The download is limited
+// by the pull timeout, so a stuck pull doesn't block the startup.
+func (l *LlmConnector) pullModel(ctx context.Context, ep *endpoint, model string) bool {
+	puller, ok := ep.backend.(modelPuller)
+	if !ok {
+		return false
+	}
+	if !l.cfg.Ollama.PullMissingModels {
+		slog.Info("llm: Model is missing, pulling is disabled", "endpoint", ep.name, "model", model)
 
-		return false, map[string]bool{}
+		return false
 	}
 
-	modelIds := []string{models.TextRequestModel, models.SummarizeModel}
-	slog.Info("llm: Returned models count", "count", len(modelList.Models))
-	slog.Debug("llm: Returned model list", "models", modelList)
-	slog.Info("llm: Checking for requested models", "requested", modelIds)
+	slog.Info("llm: Pulling missing model", "endpoint", ep.name, "model", model, "timeout", l.cfg.Ollama.PullTimeout)
+
+	if l.cfg.Ollama.PullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.cfg.Ollama.PullTimeout)
+		defer cancel()
+	}
+
+	if err := puller.PullModel(ctx, model); errors.Is(err, context.DeadlineExceeded) {
+		slog.Error("llm: Model pull timed out", "endpoint", ep.name, "model", model, "timeout", l.cfg.Ollama.PullTimeout)
+		sentry.CaptureException(err)
 
-	requestedModelsCount := len(modelIds)
-	searchResult := make(map[string]bool, requestedModelsCount)
+		return false
+	} else if err != nil {
+		slog.Error("llm: Model pull failed", "endpoint", ep.name, "model", model, "error", err)
+		sentry.CaptureException(err)
 
-	for _, modelId := range modelIds {
-		searchResult[modelId] = false
+		return false
 	}
 
-	for _, model := range modelList.Models {
-		if slices.Contains(modelIds, model.ID) {
-			searchResult[model.ID] = true
+	slog.Info("llm: Model pulled", "endpoint", ep.name, "model", model)
+
+	return true
+}
+
+func (l *LlmConnector) hasAvailableModel(chain config.ModelChain) bool {
+	for _, ref := range chain {
+		if !l.missingModels[ref.String()] {
+			return true
 		}
 	}
 
-	for _, v := range searchResult {
-		if !v {
-			return false, searchResult
-		}
+	return false
+}
+
+func (l *LlmConnector) listModels(ctx context.Context, ep *endpoint) []string {
+	ids, err := ep.backend.ListModels(ctx)
+	if err != nil {
+		slog.Error("llm: Model list request failed", "endpoint", ep.name, "error", err)
+		sentry.CaptureException(err)
+
+		return nil
 	}
 
-	return true, searchResult
+	slog.Info("llm: Returned models count", "endpoint", ep.name, "count", len(ids))
+	slog.Debug("llm: Returned model list", "endpoint", ep.name, "models", ids)
+
+	return ids
 }
 
-func (l *LlmConnector) RecognizeImage(ctx context.Context, imageData []byte) (string, *TokenUsage, error) {
+func imageRecognitionParts(imageData []byte, question string) []openai.ChatMessagePart {
+	var parts []openai.ChatMessagePart
+	if question != "" {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeText,
+			Text: "The user's message about this image:\n<question>\n" + question + "\n</question>\n" +
+				"Describe the image including everything needed to answer it. Don't answer it yourself.",
+		})
+	}
+
+	return append(parts, openai.ChatMessagePart{
+		Type: openai.ChatMessagePartTypeImageURL,
+		ImageURL: &openai.ChatMessageImageURL{
+			URL: fmt.Sprintf("data:image/jpeg;base64,%s", base64.StdEncoding.EncodeToString(imageData)),
+		},
+	})
+}
+
+// RecognizeImage describes the image. When the question is not empty, the description focuses on the details needed
+// to answer it.
+func (l *LlmConnector) RecognizeImage(ctx context.Context, imageData []byte, question string) (string, *TokenUsage, error) {
 	systemPrompt, err := l.templateProcessor.ProcessImageRecognitionTemplate()
 	if err != nil {
 		slog.Error("llm: Template processing failed", "error", err)
@@ -205,50 +683,36 @@ func (l *LlmConnector) RecognizeImage(ctx context.Context, imageData []byte) (st
 		return "", nil, ErrTemplateProcessing
 	}
 
-	req := openai.ChatCompletionRequest{
-		Model: l.cfg.Models.ImageRecognitionModel,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: systemPrompt,
-			},
-			{
-				Role: openai.ChatMessageRoleUser,
-				MultiContent: []openai.ChatMessagePart{
-					//{
-					//	Type: openai.ChatMessagePartTypeText,
-					//	Text: "What do you see in this image?",
-					//},
-					{
-						Type: openai.ChatMessagePartTypeImageURL,
-						ImageURL: &openai.ChatMessageImageURL{
-							URL: fmt.Sprintf("data:image/jpeg;base64,%s", base64.StdEncoding.EncodeToString(imageData)),
-							//Detail: "auto",
-						},
-					},
+	var reply string
+	var usage *TokenUsage
+
+	model, err := l.withFallback(ctx, TaskImageRecognition, l.cfg.Models.ImageRecognitionModel, func(ctx context.Context, ep *endpoint, model string) error {
+		req := openai.ChatCompletionRequest{
+			Model: model,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: systemPrompt,
+				},
+				{
+					Role:         openai.ChatMessageRoleUser,
+					MultiContent: imageRecognitionParts(imageData, question),
 				},
 			},
-		},
-	}
+		}
 
-	resp, err := l.client.CreateChatCompletion(ctx, req)
-	if err != nil {
-		slog.Error("llm: LLM back-end request failed", "error", err)
-		sentry.CaptureException(err)
-		return "", nil, errors.Join(ErrLlmBackendRequestFailed, err)
-	}
+		applyGenerationParams(&req, l.cfg.Generation.ImageRecognition)
 
-	if len(resp.Choices) < 1 {
-		slog.Error("llm: LLM back-end reply has no choices")
-		sentry.CaptureMessage("LLM back-end reply has no choices")
-		return "", nil, ErrNoChoices
-	}
+		var err error
+		reply, usage, err = l.complete(ctx, ep, req)
 
-	usage := &TokenUsage{
-		PromptTokens:     resp.Usage.PromptTokens,
-		CompletionTokens: resp.Usage.CompletionTokens,
-		TotalTokens:      resp.Usage.TotalTokens,
+		return err
+	})
+	if err != nil {
+		return "", nil, err
 	}
+	usage.Model = model
+	usage.Task = TaskImageRecognition
 
-	return resp.Choices[0].Message.Content, usage, nil
+	return reply, usage, nil
 }
@@ -0,0 +1,147 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"telegram-ollama-reply-bot/audit"
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestLlmConnector_SummarizeHistory(t *testing.T) {
+	var received openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"updated summary"}}]}`))
+	}))
+	defer server.Close()
+
+	tp, err := NewTemplateProcessor(config.PromptConfig{
+		HistorySummaryPrompt: "Compress in {{.Language}}",
+		Language:             "English",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Models: config.ModelSelection{
+			SummarizeModel:      config.ParseModelChain("article-model"),
+			HistorySummaryModel: config.ParseModelChain("history-model"),
+		},
+		Retry: config.RetryConfig{MaxAttempts: 1},
+	}, tp)
+
+	summary, usage, err := l.SummarizeHistory(context.Background(), "Alice asked about the release.", []ChatMessage{
+		{Name: "Bob", Username: "bob", Text: "It's planned for Monday"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if summary != "updated summary" || usage.Task != TaskHistorySummary || usage.Model != "history-model" {
+		t.Fatalf("unexpected result %q with usage %+v", summary, usage)
+	}
+
+	if received.Model != "history-model" || received.Messages[0].Content != "Compress in English" {
+		t.Fatalf("unexpected request: %+v", received)
+	}
+	input := received.Messages[1].Content
+	if !strings.Contains(input, "<previous_summary>\nAlice asked about the release.\n</previous_summary>") ||
+		!strings.Contains(input, "Bob (@bob): It's planned for Monday") {
+		t.Fatalf("unexpected summary input: %q", input)
+	}
+}
+
+func TestLlmConnector_SummarizeAppliesGenerationParams(t *testing.T) {
+	var received openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"- Fact one.\n- Fact tw"},` +
+			`"finish_reason":"length"}]}`))
+	}))
+	defer server.Close()
+
+	tp, err := NewTemplateProcessor(config.PromptConfig{SummarizePrompt: "Summarize"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	seed := 7
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Models:     config.ModelSelection{SummarizeModel: config.ParseModelChain("summary-model")},
+		Retry:      config.RetryConfig{MaxAttempts: 1},
+		Generation: config.GenerationConfig{
+			Summarize: config.GenerationParams{Temperature: 0.2, MaxTokens: 300, Seed: &seed, Stop: []string{"END"}},
+		},
+	}, tp)
+
+	summary, usage, err := l.Summarize(context.Background(), "Long article", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received.Temperature != 0.2 || received.MaxTokens != 300 || received.Seed == nil || *received.Seed != 7 ||
+		len(received.Stop) != 1 || received.Stop[0] != "END" {
+		t.Fatalf("generation params are not applied: %+v", received)
+	}
+	if !usage.Truncated || summary != "- Fact one." {
+		t.Fatalf("unfinished sentence must be dropped from the truncated summary, got %q", summary)
+	}
+}
+
+func TestLlmConnector_WritesAuditLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Short"}}],` +
+			`"usage":{"prompt_tokens":10,"completion_tokens":2,"total_tokens":12}}`))
+	}))
+	defer server.Close()
+
+	tp, err := NewTemplateProcessor(config.PromptConfig{SummarizePrompt: "Summarize"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Models:     config.ModelSelection{SummarizeModel: config.ParseModelChain("summary-model")},
+		Retry:      config.RetryConfig{MaxAttempts: 1},
+		Generation: config.GenerationConfig{Summarize: config.GenerationParams{MaxTokens: 100}},
+	}, tp)
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := audit.NewLogger(config.AuditConfig{Path: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer auditLog.Close()
+	l.SetAuditLog(auditLog)
+
+	if _, _, err := l.Summarize(WithChatID(context.Background(), 42), "Long article", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	records, err := audit.ReadRecords(path, audit.Filter{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	record := records[0]
+	if record.Task != TaskSummarize || record.ChatID != 42 || record.Model != "summary-model" ||
+		record.Endpoint != defaultEndpointName || record.Params.MaxTokens != 100 {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+	if len(record.Messages) != 2 || record.Messages[1].Content != "Long article" || record.Response != "Short" ||
+		record.Usage == nil || record.Usage.TotalTokens != 12 {
+		t.Fatalf("unexpected record content: %+v", record)
+	}
+}
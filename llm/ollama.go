@@ -0,0 +1,476 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ollamaError is an error response of the Ollama API
+type ollamaError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ollamaError) Error() string {
+	return fmt.Sprintf("ollama: status %d: %s", e.StatusCode, e.Message)
+}
+
+// ollamaBackend uses the native Ollama API which supports loaded model lifetime, context size and model pulling
+type ollamaBackend struct {
+	baseURL string
+	token   string
+	client  *http.Client
+	// keepAlive is either a number of seconds or a duration string. nil leaves the server default.
+	keepAlive any
+	context   config.ContextConfig
+}
+
+func newOllamaBackend(baseURL, token string, cfg config.OllamaConfig, contextCfg config.ContextConfig) *ollamaBackend {
+	// The same URL may be used for the OpenAI compatible API of Ollama
+	baseURL = strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/v1")
+
+	var keepAlive any
+	if cfg.KeepAlive != "" {
+		if seconds, err := strconv.Atoi(cfg.KeepAlive); err == nil {
+			keepAlive = seconds
+		} else {
+			keepAlive = cfg.KeepAlive
+		}
+	}
+
+	return &ollamaBackend{
+		baseURL:   baseURL,
+		token:     token,
+		client:    &http.Client{},
+		keepAlive: keepAlive,
+		context:   contextCfg,
+	}
+}
+
+type ollamaChatRequest struct {
+	Model     string          `json:"model"`
+	Messages  []ollamaMessage `json:"messages"`
+	Tools     []openai.Tool   `json:"tools,omitempty"`
+	Stream    bool            `json:"stream"`
+	Options   map[string]any  `json:"options,omitempty"`
+	KeepAlive any             `json:"keep_alive,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Thinking  string           `json:"thinking,omitempty"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (b *ollamaBackend) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	body, err := b.post(ctx, "/api/chat", b.chatRequest(req, false))
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer body.Close()
+
+	var resp ollamaChatResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	if resp.Error != "" {
+		return openai.ChatCompletionResponse{}, &ollamaError{StatusCode: http.StatusInternalServerError, Message: resp.Error}
+	}
+
+	if recorder, ok := ctx.Value(responseRecorderKey{}).(*responseRecorder); ok && resp.Message.Thinking != "" {
+		recorder.setReasoning(resp.Message.Thinking)
+	}
+
+	message := openai.ChatCompletionMessage{
+		Role:    resp.Message.Role,
+		Content: resp.Message.Content,
+	}
+	for i, call := range resp.Message.ToolCalls {
+		message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+			// Ollama doesn't identify calls, so results are matched by their order
+			ID:   "call_" + strconv.Itoa(i),
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: string(call.Function.Arguments),
+			},
+		})
+	}
+
+	return openai.ChatCompletionResponse{
+		Model: resp.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      message,
+			FinishReason: ollamaFinishReason(resp),
+		}},
+		Usage: ollamaUsage(resp),
+	}, nil
+}
+
+func (b *ollamaBackend) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chatStream, error) {
+	body, err := b.post(ctx, "/api/chat", b.chatRequest(req, true))
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxInspectedResponseSize)
+	recorder, _ := ctx.Value(responseRecorderKey{}).(*responseRecorder)
+
+	return &ollamaStream{body: body, scanner: scanner, recorder: recorder}, nil
+}
+
+type ollamaEmbedRequest struct {
+	Model     string         `json:"model"`
+	Input     any            `json:"input"`
+	Options   map[string]any `json:"options,omitempty"`
+	KeepAlive any            `json:"keep_alive,omitempty"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings      [][]float32 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+func (b *ollamaBackend) CreateEmbeddings(ctx context.Context, req openai.EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	body, err := b.post(ctx, "/api/embed", ollamaEmbedRequest{
+		Model:     string(req.Model),
+		Input:     req.Input,
+		Options:   b.contextOptions(string(req.Model)),
+		KeepAlive: b.keepAlive,
+	})
+	if err != nil {
+		return openai.EmbeddingResponse{}, err
+	}
+	defer body.Close()
+
+	var resp ollamaEmbedResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return openai.EmbeddingResponse{}, err
+	}
+
+	data := make([]openai.Embedding, 0, len(resp.Embeddings))
+	for i, embedding := range resp.Embeddings {
+		data = append(data, openai.Embedding{Object: "embedding", Embedding: embedding, Index: i})
+	}
+
+	return openai.EmbeddingResponse{
+		Object: "list",
+		Data:   data,
+		Model:  req.Model,
+		Usage: openai.Usage{
+			PromptTokens: resp.PromptEvalCount,
+			TotalTokens:  resp.PromptEvalCount,
+		},
+	}, nil
+}
+
+// ListModels returns the names of the local models. Models with the "latest" tag are listed with and without it,
+// the same way Ollama resolves them.
+func (b *ollamaBackend) ListModels(ctx context.Context) ([]string, error) {
+	body, err := b.do(ctx, http.MethodGet, "/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var resp struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(resp.Models))
+	for _, model := range resp.Models {
+		names = append(names, model.Name)
+		if name, latest := strings.CutSuffix(model.Name, ":latest"); latest {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// PullModel downloads the model to the server. It may take a long time for big models.
+func (b *ollamaBackend) PullModel(ctx context.Context, model string) error {
+	body, err := b.post(ctx, "/api/pull", map[string]any{"model": model, "stream": false})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var resp struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return &ollamaError{StatusCode: http.StatusInternalServerError, Message: resp.Error}
+	}
+	if resp.Status != "success" {
+		return &ollamaError{StatusCode: http.StatusInternalServerError, Message: "unexpected pull status: " + resp.Status}
+	}
+
+	return nil
+}
+
+func (b *ollamaBackend) chatRequest(req openai.ChatCompletionRequest, stream bool) ollamaChatRequest {
+	options := b.contextOptions(req.Model)
+	setOption := func(name string, value any, set bool) {
+		if set {
+			if options == nil {
+				options = map[string]any{}
+			}
+			options[name] = value
+		}
+	}
+	setOption("temperature", req.Temperature, req.Temperature != 0)
+	setOption("top_p", req.TopP, req.TopP != 0)
+	setOption("num_predict", req.MaxTokens, req.MaxTokens != 0)
+	setOption("stop", req.Stop, len(req.Stop) > 0)
+	setOption("presence_penalty", req.PresencePenalty, req.PresencePenalty != 0)
+	setOption("frequency_penalty", req.FrequencyPenalty, req.FrequencyPenalty != 0)
+	if req.Seed != nil {
+		setOption("seed", *req.Seed, true)
+	}
+
+	messages := make([]ollamaMessage, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		messages = append(messages, toOllamaMessage(msg))
+	}
+
+	tools := req.Tools
+	if req.ToolChoice == "none" {
+		tools = nil
+	}
+
+	return ollamaChatRequest{
+		Model:     req.Model,
+		Messages:  messages,
+		Tools:     tools,
+		Stream:    stream,
+		Options:   options,
+		KeepAlive: b.keepAlive,
+	}
+}
+
+// contextOptions sets the context window of the model. Ollama uses a small default one otherwise.
+func (b *ollamaBackend) contextOptions(model string) map[string]any {
+	if size := b.context.SizeFor(model); size > 0 {
+		return map[string]any{"num_ctx": size}
+	}
+
+	return nil
+}
+
+func toOllamaMessage(msg openai.ChatCompletionMessage) ollamaMessage {
+	result := ollamaMessage{Role: msg.Role}
+
+	var texts []string
+	if msg.Content != "" {
+		texts = append(texts, msg.Content)
+	}
+	for _, part := range msg.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			texts = append(texts, part.Text)
+		case openai.ChatMessagePartTypeImageURL:
+			// Ollama accepts only the image data without the data URL prefix
+			if part.ImageURL == nil {
+				continue
+			}
+			if _, data, found := strings.Cut(part.ImageURL.URL, ";base64,"); found {
+				result.Images = append(result.Images, data)
+			}
+		}
+	}
+	result.Content = strings.Join(texts, "\n")
+
+	for _, call := range msg.ToolCalls {
+		var toolCall ollamaToolCall
+		toolCall.Function.Name = call.Function.Name
+		toolCall.Function.Arguments = json.RawMessage("{}")
+		if json.Valid([]byte(call.Function.Arguments)) {
+			toolCall.Function.Arguments = json.RawMessage(call.Function.Arguments)
+		}
+		result.ToolCalls = append(result.ToolCalls, toolCall)
+	}
+
+	if msg.Role == openai.ChatMessageRoleTool {
+		result.ToolName = msg.Name
+	}
+
+	return result
+}
+
+func ollamaFinishReason(resp ollamaChatResponse) openai.FinishReason {
+	switch {
+	case resp.DoneReason == "length":
+		return openai.FinishReasonLength
+	case len(resp.Message.ToolCalls) > 0:
+		return openai.FinishReasonToolCalls
+	default:
+		return openai.FinishReasonStop
+	}
+}
+
+// ollamaUsage converts the evaluation counts. Unlike the OpenAI compatible API, they are always reported.
+func ollamaUsage(resp ollamaChatResponse) openai.Usage {
+	return openai.Usage{
+		PromptTokens:     resp.PromptEvalCount,
+		CompletionTokens: resp.EvalCount,
+		TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+	}
+}
+
+func (b *ollamaBackend) post(ctx context.Context, path string, payload any) (io.ReadCloser, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.do(ctx, http.MethodPost, path, bytes.NewReader(data))
+}
+
+// do sends the request and returns the body of the successful response
+func (b *ollamaBackend) do(ctx context.Context, method, path string, body io.Reader) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		message := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &errResp) == nil && errResp.Error != "" {
+			message = errResp.Error
+		}
+
+		return nil, &ollamaError{StatusCode: resp.StatusCode, Message: message}
+	}
+
+	return resp.Body, nil
+}
+
+// ollamaStream converts the newline delimited JSON stream of Ollama into completion chunks
+type ollamaStream struct {
+	body     io.ReadCloser
+	scanner  *bufio.Scanner
+	recorder *responseRecorder
+	thinking strings.Builder
+	done     bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (s *ollamaStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	for !s.done {
+		if !s.scanner.Scan() {
+			if err := s.scanner.Err(); err != nil {
+				return openai.ChatCompletionStreamResponse{}, err
+			}
+
+			return openai.ChatCompletionStreamResponse{}, io.ErrUnexpectedEOF
+		}
+
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var resp ollamaChatResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return openai.ChatCompletionStreamResponse{}, err
+		}
+		if resp.Error != "" {
+			return openai.ChatCompletionStreamResponse{}, &ollamaError{StatusCode: http.StatusInternalServerError, Message: resp.Error}
+		}
+
+		s.thinking.WriteString(resp.Message.Thinking)
+
+		chunk := openai.ChatCompletionStreamResponse{
+			Model: resp.Model,
+			Choices: []openai.ChatCompletionStreamChoice{{
+				Delta: openai.ChatCompletionStreamChoiceDelta{
+					Role:    resp.Message.Role,
+					Content: resp.Message.Content,
+				},
+			}},
+		}
+
+		if resp.Done {
+			s.done = true
+			usage := ollamaUsage(resp)
+			chunk.Usage = &usage
+			chunk.Choices[0].FinishReason = ollamaFinishReason(resp)
+
+			if s.recorder != nil && s.thinking.Len() > 0 {
+				s.recorder.setReasoning(s.thinking.String())
+			}
+		}
+
+		return chunk, nil
+	}
+
+	return openai.ChatCompletionStreamResponse{}, io.EOF
+}
+
+func (s *ollamaStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.body.Close()
+	})
+
+	return s.closeErr
+}
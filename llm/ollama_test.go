@@ -0,0 +1,142 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+)
+
+func TestLlmConnector_OllamaBackend(t *testing.T) {
+	var mu sync.Mutex
+	installed := []string{"chat:latest"}
+	var chatReq ollamaChatRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/api/tags":
+			var list struct {
+				Models []map[string]string `json:"models"`
+			}
+			for _, name := range installed {
+				list.Models = append(list.Models, map[string]string{"name": name})
+			}
+			_ = json.NewEncoder(w).Encode(list)
+		case "/api/pull":
+			var req struct {
+				Model string `json:"model"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			installed = append(installed, req.Model)
+			_, _ = w.Write([]byte(`{"status":"success"}`))
+		case "/api/chat":
+			_ = json.NewDecoder(r.Body).Decode(&chatReq)
+			if chatReq.Stream {
+				_, _ = w.Write([]byte(
+					`{"message":{"role":"assistant","content":"","thinking":"hmm"},"done":false}` + "\n" +
+						`{"message":{"role":"assistant","content":"Hel"},"done":false}` + "\n" +
+						`{"message":{"role":"assistant","content":"lo"},"done":false}` + "\n" +
+						`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":12,"eval_count":3}` + "\n",
+				))
+				return
+			}
+			_, _ = w.Write([]byte(`{"message":{"role":"assistant","content":"Short"},"done":true,"done_reason":"length","prompt_eval_count":20,"eval_count":5}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	models := config.ModelSelection{
+		TextRequestModel: config.ParseModelChain("chat"),
+		SummarizeModel:   config.ParseModelChain("summarizer"),
+	}
+	tp, err := NewTemplateProcessor(config.PromptConfig{ChatSystemPrompt: "You're a bot", SummarizePrompt: "Summarize"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL + "/v1",
+		APIBackend: config.BackendOllama,
+		Ollama:     config.OllamaConfig{KeepAlive: "-1", PullMissingModels: true},
+		Models:     models,
+		Context:    config.ContextConfig{DefaultSize: 8192},
+		Generation: config.GenerationConfig{Summarize: config.GenerationParams{MaxTokens: 5}},
+		Retry:      config.RetryConfig{MaxAttempts: 1},
+	}, tp)
+
+	hasAll, result := l.HasAllModels(context.Background(), models)
+	if !hasAll || !result["chat"] || !result["summarizer"] {
+		t.Fatalf("unexpected model check result: %t %v", hasAll, result)
+	}
+
+	var updates []string
+	reply, usage, err := l.StreamChatMessage(context.Background(), ChatMessage{Text: "hi"}, RequestContext{Empty: true}, func(text string) {
+		updates = append(updates, text)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply != "Hello" || usage.Reasoning != "hmm" || usage.PromptTokens != 12 || usage.CompletionTokens != 3 {
+		t.Fatalf("unexpected stream result %q: %+v", reply, usage)
+	}
+	if len(updates) != 2 || updates[1] != "Hello" {
+		t.Fatalf("unexpected stream updates: %v", updates)
+	}
+	if chatReq.KeepAlive != float64(-1) || chatReq.Options["num_ctx"] != float64(8192) {
+		t.Fatalf("unexpected request options: keep_alive=%v options=%v", chatReq.KeepAlive, chatReq.Options)
+	}
+
+	_, usage, err = l.Summarize(context.Background(), "Long text", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !usage.Truncated || usage.TotalTokens != 25 || chatReq.Options["num_predict"] != float64(5) {
+		t.Fatalf("unexpected summary usage %+v with options %v", usage, chatReq.Options)
+	}
+}
+
+func TestLlmConnector_OllamaPullTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			_, _ = w.Write([]byte(`{"models":[{"name":"chat:latest"}]}`))
+		case "/api/pull":
+			<-stop
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(stop) })
+
+	models := config.ModelSelection{
+		TextRequestModel: config.ParseModelChain("chat"),
+		SummarizeModel:   config.ParseModelChain("summarizer,chat"),
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		APIBackend: config.BackendOllama,
+		Ollama:     config.OllamaConfig{PullMissingModels: true, PullTimeout: 100 * time.Millisecond},
+		Models:     models,
+		Retry:      config.RetryConfig{MaxAttempts: 1},
+	}, nil)
+
+	started := time.Now()
+	hasAll, result := l.HasAllModels(context.Background(), models)
+	if !hasAll || result["summarizer"] {
+		t.Fatalf("unexpected model check result: %t %v", hasAll, result)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("model pull wasn't stopped in time: %s", elapsed)
+	}
+}
@@ -0,0 +1,211 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Responses bigger than this are not inspected for the data missing in the client library
+const maxInspectedResponseSize = 4 << 20
+
+type responseRecorderKey struct{}
+
+// responseRecorder receives the data which the client library doesn't parse from the response body: the request
+// cost reported by the provider (e.g. by OpenRouter) and the reasoning returned separately from the reply.
+type responseRecorder struct {
+	mu        sync.Mutex
+	cost      float64
+	reported  bool
+	reasoning string
+}
+
+func (r *responseRecorder) setCost(cost float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cost = cost
+	r.reported = true
+}
+
+func (r *responseRecorder) getCost() (float64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cost, r.reported
+}
+
+func (r *responseRecorder) setReasoning(reasoning string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reasoning = reasoning
+}
+
+func (r *responseRecorder) getReasoning() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reasoning
+}
+
+func withResponseRecorder(ctx context.Context, recorder *responseRecorder) context.Context {
+	return context.WithValue(ctx, responseRecorderKey{}, recorder)
+}
+
+// responseInspectingTransport inspects the responses of the requests which have a responseRecorder in their context.
+// The body is passed to the client unchanged.
+type responseInspectingTransport struct {
+	base http.RoundTripper
+}
+
+func newResponseInspectingClient() *http.Client {
+	return &http.Client{Transport: &responseInspectingTransport{base: http.DefaultTransport}}
+}
+
+func (t *responseInspectingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	recorder, ok := req.Context().Value(responseRecorderKey{}).(*responseRecorder)
+	if !ok || resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	resp.Body = &inspectedBody{
+		ReadCloser: resp.Body,
+		recorder:   recorder,
+		stream:     strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"),
+	}
+
+	return resp, nil
+}
+
+type inspectedBody struct {
+	io.ReadCloser
+	recorder *responseRecorder
+	stream   bool
+	buf      bytes.Buffer
+	tooBig   bool
+	closed   bool
+}
+
+func (b *inspectedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.tooBig {
+		if b.buf.Len()+n > maxInspectedResponseSize {
+			b.tooBig = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	return n, err
+}
+
+func (b *inspectedBody) Close() error {
+	if !b.closed && !b.tooBig {
+		b.closed = true
+		if cost, found := findReportedCost(b.buf.Bytes(), b.stream); found {
+			b.recorder.setCost(cost)
+		}
+		if reasoning := findReportedReasoning(b.buf.Bytes(), b.stream); reasoning != "" {
+			b.recorder.setReasoning(reasoning)
+		}
+	}
+
+	return b.ReadCloser.Close()
+}
+
+type reportedUsage struct {
+	Usage *struct {
+		Cost *float64 `json:"cost"`
+	} `json:"usage"`
+}
+
+// findReportedCost extracts usage.cost from a JSON response or from the last stream event which has it
+func findReportedCost(body []byte, stream bool) (float64, bool) {
+	if !stream {
+		return parseReportedCost(body)
+	}
+
+	cost, found := 0.0, false
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxInspectedResponseSize)
+	for scanner.Scan() {
+		data, isData := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !isData {
+			continue
+		}
+		if eventCost, ok := parseReportedCost(bytes.TrimSpace(data)); ok {
+			cost, found = eventCost, true
+		}
+	}
+
+	return cost, found
+}
+
+func parseReportedCost(data []byte) (float64, bool) {
+	var usage reportedUsage
+	if err := json.Unmarshal(data, &usage); err != nil || usage.Usage == nil || usage.Usage.Cost == nil {
+		return 0, false
+	}
+
+	return *usage.Usage.Cost, true
+}
+
+// calculateCost returns the provider reported cost if available. Otherwise, the cost is calculated using the pricing
+// table. Unknown models are free.
+func (l *LlmConnector) calculateCost(ep *endpoint, req openai.ChatCompletionRequest, usage *TokenUsage, recorder *responseRecorder) float64 {
+	if cost, reported := recorder.getCost(); reported {
+		return cost
+	}
+
+	price, found := l.modelPrice(ep, req.Model)
+	if !found {
+		return 0
+	}
+
+	images := 0
+	for _, msg := range req.Messages {
+		for _, part := range msg.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				images++
+			}
+		}
+	}
+
+	return float64(usage.PromptTokens)*price.Prompt/1_000_000 +
+		float64(usage.CompletionTokens)*price.Completion/1_000_000 +
+		float64(images)*price.Image
+}
+
+// embeddingsCost returns the cost of the embeddings request calculated using the pricing table
+func (l *LlmConnector) embeddingsCost(ep *endpoint, model string, promptTokens int) float64 {
+	price, found := l.modelPrice(ep, model)
+	if !found {
+		return 0
+	}
+
+	return float64(promptTokens) * price.Prompt / 1_000_000
+}
+
+// modelPrice returns the price of the model on the endpoint or the price of the model on any endpoint
+func (l *LlmConnector) modelPrice(ep *endpoint, model string) (config.ModelPrice, bool) {
+	if price, found := l.cfg.Pricing[model+"@"+ep.name]; found {
+		return price, true
+	}
+	price, found := l.cfg.Pricing[model]
+
+	return price, found
+}
@@ -0,0 +1,106 @@
+package llm
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestFindReportedCost(t *testing.T) {
+	cost, found := findReportedCost([]byte(`{"usage":{"prompt_tokens":10,"cost":0.0025}}`), false)
+	if !found || cost != 0.0025 {
+		t.Fatalf("unexpected cost: %f %t", cost, found)
+	}
+
+	if _, found = findReportedCost([]byte(`{"usage":{"prompt_tokens":10}}`), false); found {
+		t.Fatalf("cost must not be found without usage.cost")
+	}
+
+	stream := "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+		"data: {\"choices\":[],\"usage\":{\"total_tokens\":3,\"cost\":0.5}}\n\n" +
+		"data: [DONE]\n\n"
+	cost, found = findReportedCost([]byte(stream), true)
+	if !found || cost != 0.5 {
+		t.Fatalf("unexpected stream cost: %f %t", cost, found)
+	}
+}
+
+func TestLlmConnector_CalculatesCost(t *testing.T) {
+	reportCost := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		usage := `"usage":{"prompt_tokens":1000000,"completion_tokens":500000,"total_tokens":1500000}`
+		if reportCost {
+			usage = `"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2,"cost":0.42}`
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}],` + usage + `}`))
+	}))
+	defer server.Close()
+
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Retry:      config.RetryConfig{MaxAttempts: 1},
+		Pricing: map[string]config.ModelPrice{
+			"priced": {Prompt: 2, Completion: 10, Image: 0.01},
+		},
+	}, nil)
+	ep := l.endpoints[defaultEndpointName]
+
+	req := openai.ChatCompletionRequest{
+		Model: "priced",
+		Messages: []openai.ChatCompletionMessage{{
+			Role: openai.ChatMessageRoleUser,
+			MultiContent: []openai.ChatMessagePart{
+				{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:"}},
+			},
+		}},
+	}
+	_, usage, err := l.complete(context.Background(), ep, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if math.Abs(usage.Cost-7.01) > 1e-9 {
+		t.Fatalf("unexpected cost from pricing table: %f", usage.Cost)
+	}
+
+	req.Model = "unknown"
+	if _, usage, _ = l.complete(context.Background(), ep, req); usage.Cost != 0 {
+		t.Fatalf("unknown models must be free, got %f", usage.Cost)
+	}
+
+	reportCost = true
+	if _, usage, _ = l.complete(context.Background(), ep, req); usage.Cost != 0.42 {
+		t.Fatalf("provider reported cost must be used, got %f", usage.Cost)
+	}
+}
+
+func TestLlmConnector_CalculatesEmbeddingsCost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":[{"index":0,"embedding":[0.1,0.2]}],"usage":{"prompt_tokens":500000,"total_tokens":500000}}`))
+	}))
+	defer server.Close()
+
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Models:     config.ModelSelection{EmbeddingsModel: config.ParseModelChain("embedder")},
+		Retry:      config.RetryConfig{MaxAttempts: 1},
+		Pricing: map[string]config.ModelPrice{
+			"embedder@" + defaultEndpointName: {Prompt: 0.02},
+		},
+	}, nil)
+
+	_, usage, err := l.Embed(context.Background(), []string{"text"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if math.Abs(usage.Cost-0.01) > 1e-9 || usage.Task != TaskEmbeddings {
+		t.Fatalf("unexpected embeddings usage: %+v", usage)
+	}
+}
@@ -0,0 +1,124 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+// splitReasoning separates <think> blocks of reasoning models from the reply. An unclosed block (e.g. while the
+// reply is still streamed) lasts until the end of the text. Some chat templates put the opening tag into the prompt,
+// so a closing tag without the opening one ends the reasoning started at the beginning of the reply.
+func splitReasoning(text string) (reasoning string, reply string) {
+	if !strings.Contains(text, thinkOpenTag) && !strings.Contains(text, thinkCloseTag) {
+		return "", text
+	}
+
+	var thoughts []string
+	var answer strings.Builder
+	rest := text
+
+	if closeIdx := strings.Index(rest, thinkCloseTag); closeIdx >= 0 {
+		if openIdx := strings.Index(rest, thinkOpenTag); openIdx < 0 || openIdx > closeIdx {
+			thoughts = append(thoughts, rest[:closeIdx])
+			rest = rest[closeIdx+len(thinkCloseTag):]
+		}
+	}
+
+	for rest != "" {
+		openIdx := strings.Index(rest, thinkOpenTag)
+		if openIdx < 0 {
+			answer.WriteString(rest)
+			break
+		}
+		answer.WriteString(rest[:openIdx])
+		rest = rest[openIdx+len(thinkOpenTag):]
+
+		closeIdx := strings.Index(rest, thinkCloseTag)
+		if closeIdx < 0 {
+			thoughts = append(thoughts, rest)
+			break
+		}
+		thoughts = append(thoughts, rest[:closeIdx])
+		rest = rest[closeIdx+len(thinkCloseTag):]
+	}
+
+	return joinReasoning(thoughts...), strings.TrimSpace(answer.String())
+}
+
+// joinReasoning joins non-empty reasoning parts
+func joinReasoning(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+
+	return strings.Join(nonEmpty, "\n\n")
+}
+
+// isPartialThinkTag checks if the streamed reply so far may be the beginning of the opening tag
+func isPartialThinkTag(text string) bool {
+	text = strings.TrimSpace(text)
+
+	return text != "" && len(text) < len(thinkOpenTag) && strings.HasPrefix(thinkOpenTag, text)
+}
+
+// Back-ends return reasoning in one of these fields besides the reply content
+type reportedReasoning struct {
+	ReasoningContent string `json:"reasoning_content"`
+	Reasoning        string `json:"reasoning"`
+}
+
+func (r reportedReasoning) text() string {
+	if r.ReasoningContent != "" {
+		return r.ReasoningContent
+	}
+
+	return r.Reasoning
+}
+
+type reportedChoices struct {
+	Choices []struct {
+		Message reportedReasoning `json:"message"`
+		Delta   reportedReasoning `json:"delta"`
+	} `json:"choices"`
+}
+
+// findReportedReasoning extracts the reasoning field of the reply from a JSON response or joins its chunks from the
+// stream events
+func findReportedReasoning(body []byte, stream bool) string {
+	if !stream {
+		var resp reportedChoices
+		if err := json.Unmarshal(body, &resp); err != nil || len(resp.Choices) == 0 {
+			return ""
+		}
+
+		return resp.Choices[0].Message.text()
+	}
+
+	var reasoning strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxInspectedResponseSize)
+	for scanner.Scan() {
+		data, isData := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !isData {
+			continue
+		}
+
+		var chunk reportedChoices
+		if err := json.Unmarshal(bytes.TrimSpace(data), &chunk); err != nil || len(chunk.Choices) == 0 {
+			continue
+		}
+		reasoning.WriteString(chunk.Choices[0].Delta.text())
+	}
+
+	return reasoning.String()
+}
@@ -0,0 +1,67 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestSplitReasoning(t *testing.T) {
+	tests := []struct {
+		text      string
+		reasoning string
+		reply     string
+	}{
+		{"Just a reply", "", "Just a reply"},
+		{"<think>\nLet me think.\n</think>\n\nThe answer", "Let me think.", "The answer"},
+		{"Implicit opening tag</think>The answer", "Implicit opening tag", "The answer"},
+		{"<think>Still thinking", "Still thinking", ""},
+		{"<think>a</think>Part one <think>b</think>part two", "a\n\nb", "Part one part two"},
+	}
+
+	for _, tt := range tests {
+		reasoning, reply := splitReasoning(tt.text)
+		if reasoning != tt.reasoning || reply != tt.reply {
+			t.Fatalf("splitReasoning(%q) = %q, %q; want %q, %q", tt.text, reasoning, reply, tt.reasoning, tt.reply)
+		}
+	}
+
+	if !isPartialThinkTag("<thi") || isPartialThinkTag("<b>") || isPartialThinkTag("") {
+		t.Fatalf("unexpected partial tag detection")
+	}
+}
+
+func TestLlmConnector_SeparatesReportedReasoning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<think>inline</think>Answer",` +
+			`"reasoning_content":"reported"}}],"usage":{"total_tokens":2}}`))
+	}))
+	defer server.Close()
+
+	l := NewConnector(config.LLMConfig{APIBaseURL: server.URL, Retry: config.RetryConfig{MaxAttempts: 1}}, nil)
+
+	req := openai.ChatCompletionRequest{
+		Model:    "thinking",
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+	}
+	reply, usage, err := l.complete(context.Background(), l.endpoints[defaultEndpointName], req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply != "Answer" || usage.Reasoning != "reported\n\ninline" {
+		t.Fatalf("unexpected reply %q with reasoning %q", reply, usage.Reasoning)
+	}
+
+	stream := "data: {\"choices\":[{\"delta\":{\"reasoning\":\"step 1, \"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"reasoning\":\"step 2\"}}]}\n\n" +
+		"data: [DONE]\n\n"
+	if reasoning := findReportedReasoning([]byte(stream), true); reasoning != "step 1, step 2" {
+		t.Fatalf("unexpected stream reasoning: %q", reasoning)
+	}
+}
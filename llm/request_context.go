@@ -1,7 +1,9 @@
 package llm
 
 import (
+	"encoding/base64"
 	"strings"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
@@ -20,14 +22,20 @@ type UserContext struct {
 }
 
 type ChatContext struct {
+	ID             int64
 	Title          string
 	Description    string
 	Type           string
 	History        []ChatMessage
 	EarlierSummary string
+	// RelevantMemories are older messages of the chat which are semantically close to the request
+	RelevantMemories []ChatMessage
 }
 
 type ChatMessage struct {
+	MessageID int
+	// PartIDs are IDs of the following messages of a reply split into several parts
+	PartIDs       []int
 	Name          string
 	Username      string
 	Text          string
@@ -35,7 +43,11 @@ type ChatMessage struct {
 	IsUserRequest bool
 	HasImage      bool
 	Image         string
-	ReplyTo       *ChatMessage
+	// ImageData contains the JPEG image for vision capable models. The Image description is used when it's empty.
+	ImageData []byte
+	ReplyTo   *ChatMessage
+	// Date is the time the message was sent. Zero for messages saved before it was tracked.
+	Date time.Time
 }
 
 func (c RequestContext) Prompt() string {
@@ -102,12 +114,47 @@ func chatMessageToOpenAiChatCompletionMessage(message ChatMessage) openai.ChatCo
 		msgText = chatMessageToText(message)
 	}
 
+	var images [][]byte
+	// Assistant messages can't contain images
+	if !message.IsMe {
+		images = chatMessageImages(message)
+	}
+	if len(images) == 0 {
+		return openai.ChatCompletionMessage{
+			Role:    msgRole,
+			Content: msgText,
+		}
+	}
+
+	parts := []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: msgText}}
+	for _, image := range images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				URL: "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(image),
+			},
+		})
+	}
+
 	return openai.ChatCompletionMessage{
-		Role:    msgRole,
-		Content: msgText,
+		Role:         msgRole,
+		MultiContent: parts,
 	}
 }
 
+// chatMessageImages returns images of the message and the quoted message it replies to
+func chatMessageImages(message ChatMessage) [][]byte {
+	var images [][]byte
+	if message.ReplyTo != nil && len(message.ReplyTo.ImageData) > 0 {
+		images = append(images, message.ReplyTo.ImageData)
+	}
+	if len(message.ImageData) > 0 {
+		images = append(images, message.ImageData)
+	}
+
+	return images
+}
+
 func chatMessageToText(message ChatMessage) string {
 	var msgText string
 
@@ -139,6 +186,23 @@ func presentUserMessageAsText(message ChatMessage) string {
 	return result
 }
 
+// relevantMemoriesToText presents older messages with their dates, so the model can answer questions like "what did
+// Alex say last month"
+func relevantMemoriesToText(memories []ChatMessage) string {
+	var sb strings.Builder
+	sb.WriteString("[Relevant past messages from this chat which may help to answer:\n")
+	for _, msg := range memories {
+		if !msg.Date.IsZero() {
+			sb.WriteString(msg.Date.UTC().Format("2006-01-02 15:04 UTC") + " ")
+		}
+		sb.WriteString(presentUserMessageAsText(msg))
+		sb.WriteString("\n")
+	}
+	sb.WriteString("]")
+
+	return sb.String()
+}
+
 func chatHistoryToPlainText(history []ChatMessage) string {
 	var sb strings.Builder
 	for _, msg := range history {
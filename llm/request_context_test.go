@@ -0,0 +1,55 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestChatMessageToOpenAiChatCompletionMessage_Images(t *testing.T) {
+	message := ChatMessage{
+		Name:      "John",
+		Text:      "What is on this photo?",
+		HasImage:  true,
+		ImageData: []byte("photo"),
+		ReplyTo: &ChatMessage{
+			Name:      "Jane",
+			Text:      "Look",
+			HasImage:  true,
+			ImageData: []byte("quoted"),
+		},
+	}
+
+	converted := chatMessageToOpenAiChatCompletionMessage(message)
+	if converted.Content != "" || len(converted.MultiContent) != 3 {
+		t.Fatalf("expected text and two image parts, got %+v", converted)
+	}
+	if converted.MultiContent[0].Type != openai.ChatMessagePartTypeText ||
+		!strings.Contains(converted.MultiContent[0].Text, "What is on this photo?") {
+		t.Fatalf("unexpected text part: %+v", converted.MultiContent[0])
+	}
+	for _, part := range converted.MultiContent[1:] {
+		if part.Type != openai.ChatMessagePartTypeImageURL || !strings.HasPrefix(part.ImageURL.URL, "data:image/jpeg;base64,") {
+			t.Fatalf("unexpected image part: %+v", part)
+		}
+	}
+
+	message.ImageData, message.ReplyTo.ImageData = nil, nil
+	if converted = chatMessageToOpenAiChatCompletionMessage(message); converted.Content == "" || converted.MultiContent != nil {
+		t.Fatalf("expected plain text message without image data, got %+v", converted)
+	}
+}
+
+func TestRelevantMemoriesToText(t *testing.T) {
+	text := relevantMemoriesToText([]ChatMessage{
+		{Name: "Alex", Username: "alex", Text: "Deploy is postponed", Date: time.Date(2026, 9, 1, 10, 30, 0, 0, time.UTC)},
+		{Name: "Kate", Text: "Saved before dates were tracked"},
+	})
+
+	if !strings.Contains(text, "2026-09-01 10:30 UTC Alex (@alex): Deploy is postponed\n") ||
+		!strings.Contains(text, "\nKate: Saved before dates were tracked\n") {
+		t.Fatalf("unexpected memories text: %q", text)
+	}
+}
@@ -0,0 +1,345 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sashabaranov/go-openai"
+)
+
+var ErrLlmBackendUnavailable = errors.New("llm back-end is unavailable")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BackendStatus is a snapshot of the LLM back-end endpoint health as seen by the connector
+type BackendStatus struct {
+	Endpoint            string
+	BreakerState        string
+	ConsecutiveFailures int
+}
+
+// circuitBreaker stops sending requests to the back-end after several consecutive failures. When the cooldown passes,
+// a single probe request is allowed. Its result either closes the breaker or opens it again.
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(cfg config.BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: cfg.FailureThreshold,
+		cooldown:  cfg.Cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow checks if a request may be sent to the back-end
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the result of the request allowed by allow
+func (b *circuitBreaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	switch {
+	case err == nil || (!isRetryableError(err) && !isContextError(err)):
+		// Non-retryable errors like bad requests still mean that the back-end is up
+		if b.state != breakerClosed {
+			slog.Info("llm: Circuit breaker is closed")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+	case isContextError(err):
+		// Cancelled requests say nothing about the back-end health
+	default:
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= b.threshold {
+			if b.state == breakerClosed {
+				slog.Warn("llm: Circuit breaker is open", "failures", b.failures, "cooldown", b.cooldown)
+				sentry.CaptureMessage("LLM back-end circuit breaker is open")
+			}
+			b.state = breakerOpen
+			b.openedAt = b.now()
+		}
+	}
+}
+
+func (b *circuitBreaker) status() (breakerState, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.failures
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// isRetryableError checks if the request failed because of a transient back-end or network problem
+func isRetryableError(err error) bool {
+	if err == nil || isContextError(err) {
+		return false
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.HTTPStatusCode)
+	}
+
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return isRetryableStatus(reqErr.HTTPStatusCode)
+	}
+
+	var ollamaErr *ollamaError
+	if errors.As(err, &ollamaErr) {
+		return isRetryableStatus(ollamaErr.StatusCode)
+	}
+
+	if errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr)
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns the jittered delay before the next attempt. attempt starts from 1.
+func backoff(cfg config.RetryConfig, attempt int) time.Duration {
+	delay := cfg.BaseDelay
+	for i := 1; i < attempt && delay < cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if cfg.MaxDelay > 0 && delay > cfg.MaxDelay {
+		delay = cfg.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	// Random delay in the [delay/2, delay] range to prevent retries of concurrent requests from bunching up
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// reportRequestError logs the failed back-end request. Requests failing fast while the circuit breaker is open are
+// expected during an outage, so they are not sent to Sentry. The breaker reports its state changes itself.
+func reportRequestError(message string, model string, err error) {
+	if errors.Is(err, ErrLlmBackendUnavailable) {
+		slog.Warn(message, "model", model, "error", err)
+
+		return
+	}
+
+	slog.Error(message, "model", model, "error", err)
+	sentry.CaptureException(err)
+}
+
+// withRetries calls the back-end through the circuit breaker and retries transient failures while the context
+// deadline allows it.
+func (l *LlmConnector) withRetries(ctx context.Context, ep *endpoint, call func(ctx context.Context) error) error {
+	maxAttempts := max(l.cfg.Retry.MaxAttempts, 1)
+
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		if !ep.breaker.allow() {
+			if lastErr != nil {
+				return errors.Join(ErrLlmBackendUnavailable, lastErr)
+			}
+
+			return ErrLlmBackendUnavailable
+		}
+
+		err := call(ctx)
+		ep.breaker.record(err)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if attempt >= maxAttempts || !isRetryableError(err) {
+			return err
+		}
+
+		delay := backoff(l.cfg.Retry, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		l.retries.Add(1)
+		slog.Warn("llm: LLM back-end request failed, retrying",
+			"endpoint", ep.name,
+			"error", err,
+			"attempt", attempt,
+			"delay", delay,
+		)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// createChatCompletion is the single entry point for non-streaming completion requests
+func (l *LlmConnector) createChatCompletion(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+) (openai.ChatCompletionResponse, error) {
+	var resp openai.ChatCompletionResponse
+	err := l.withRetries(ctx, ep, func(ctx context.Context) error {
+		var err error
+		resp, err = ep.backend.CreateChatCompletion(ctx, req)
+
+		return err
+	})
+
+	return resp, err
+}
+
+func (l *LlmConnector) createEmbeddings(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.EmbeddingRequest,
+) (openai.EmbeddingResponse, error) {
+	var resp openai.EmbeddingResponse
+	err := l.withRetries(ctx, ep, func(ctx context.Context) error {
+		var err error
+		resp, err = ep.backend.CreateEmbeddings(ctx, req)
+
+		return err
+	})
+
+	return resp, err
+}
+
+// createChatCompletionStream opens the completion stream. Only opening is retried since chunks already passed to
+// the caller can't be taken back.
+func (l *LlmConnector) createChatCompletionStream(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+) (chatStream, error) {
+	var stream chatStream
+	err := l.withRetries(ctx, ep, func(ctx context.Context) error {
+		var err error
+		stream, err = ep.backend.CreateChatCompletionStream(ctx, req)
+
+		return err
+	})
+
+	return stream, err
+}
+
+// BackendStatus returns the current circuit breaker state of each endpoint
+func (l *LlmConnector) BackendStatus() []BackendStatus {
+	statuses := make([]BackendStatus, 0, len(l.endpoints))
+	for _, ep := range l.endpoints {
+		state, failures := ep.breaker.status()
+		statuses = append(statuses, BackendStatus{
+			Endpoint:            ep.name,
+			BreakerState:        state.String(),
+			ConsecutiveFailures: failures,
+		})
+	}
+	slices.SortFunc(statuses, func(a, b BackendStatus) int {
+		return strings.Compare(a.Endpoint, b.Endpoint)
+	})
+
+	return statuses
+}
+
+// Retries returns the total number of retried LLM back-end requests
+func (l *LlmConnector) Retries() uint64 {
+	return l.retries.Load()
+}
@@ -0,0 +1,129 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCircuitBreaker_OpensAndRecovers(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(config.BreakerConfig{FailureThreshold: 2, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+
+	unavailable := &openai.RequestError{HTTPStatusCode: http.StatusServiceUnavailable, Err: errors.New("unavailable")}
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("breaker must be closed before %d failures", i+1)
+		}
+		b.record(unavailable)
+	}
+	if b.allow() {
+		t.Fatalf("breaker must be open after reaching the threshold")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatalf("breaker must allow a probe after the cooldown")
+	}
+	if b.allow() {
+		t.Fatalf("breaker must allow only one probe at a time")
+	}
+	b.record(unavailable)
+	if state, _ := b.status(); state != breakerOpen {
+		t.Fatalf("failed probe must open the breaker again, got %s", state)
+	}
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatalf("breaker must allow a probe after the cooldown")
+	}
+	b.record(nil)
+	if state, failures := b.status(); state != breakerClosed || failures != 0 {
+		t.Fatalf("successful probe must close the breaker, got %s with %d failures", state, failures)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	cases := map[error]bool{
+		&openai.APIError{HTTPStatusCode: http.StatusBadGateway}:                        true,
+		&openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}:                   true,
+		&openai.APIError{HTTPStatusCode: http.StatusBadRequest}:                        false,
+		fmt.Errorf("wrapped: %w", &openai.RequestError{HTTPStatusCode: 503, Err: nil}): true,
+		context.DeadlineExceeded: false,
+		errors.New("unknown"):    false,
+	}
+	for err, expected := range cases {
+		if got := isRetryableError(err); got != expected {
+			t.Fatalf("unexpected result for %v: expected %t, got %t", err, expected, got)
+		}
+	}
+}
+
+func TestLlmConnector_RetriesTransientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "model is loading", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	defer server.Close()
+
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Retry:      config.RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		Breaker:    config.BreakerConfig{FailureThreshold: 5, Cooldown: time.Minute},
+	}, nil)
+
+	resp, err := l.createChatCompletion(context.Background(), l.endpoints[defaultEndpointName], openai.ChatCompletionRequest{Model: "test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Choices[0].Message.Content != "ok" || calls.Load() != 3 {
+		t.Fatalf("unexpected response after %d calls: %+v", calls.Load(), resp)
+	}
+	if retries := l.Retries(); retries != 2 {
+		t.Fatalf("unexpected retries count: %d", retries)
+	}
+	if status := l.BackendStatus(); len(status) != 1 || status[0].BreakerState != "closed" {
+		t.Fatalf("unexpected backend status: %+v", status)
+	}
+}
+
+func TestLlmConnector_FailsFastWhenBreakerIsOpen(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Retry:      config.RetryConfig{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		Breaker:    config.BreakerConfig{FailureThreshold: 2, Cooldown: time.Minute},
+	}, nil)
+
+	_, err := l.createChatCompletion(context.Background(), l.endpoints[defaultEndpointName], openai.ChatCompletionRequest{Model: "test"})
+	if !errors.Is(err, ErrLlmBackendUnavailable) || calls.Load() != 2 {
+		t.Fatalf("expected breaker to stop retries after 2 calls, got %d calls and error %v", calls.Load(), err)
+	}
+
+	_, err = l.createChatCompletion(context.Background(), l.endpoints[defaultEndpointName], openai.ChatCompletionRequest{Model: "test"})
+	if !errors.Is(err, ErrLlmBackendUnavailable) || calls.Load() != 2 {
+		t.Fatalf("expected request to fail fast, got %d calls and error %v", calls.Load(), err)
+	}
+}
@@ -0,0 +1,270 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var ErrTextTooLong = errors.New("text is too long to summarize")
+
+const (
+	// Partial summaries are summarized again while they don't fit into a single request, but not more than this
+	maxSummaryReduceRounds = 3
+	// Smaller chunks lose too much context to be summarized separately
+	minSummaryChunkTokens = 256
+)
+
+type summarizeRequestTimeoutKey struct{}
+
+// WithSummarizeRequestTimeout limits each summarize request made with the context. Long texts take several requests,
+// so the whole summarization isn't limited by it.
+func WithSummarizeRequestTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, summarizeRequestTimeoutKey{}, timeout)
+}
+
+// summarizeChunkBudget returns the number of text tokens which fit into a single summarize request. Returns false
+// when the context size of the summarize models is unknown.
+func (l *LlmConnector) summarizeChunkBudget(systemPrompt string) (int, bool) {
+	if l.cfg.Summarization.ChunkTokens > 0 {
+		return l.cfg.Summarization.ChunkTokens, true
+	}
+
+	// Any model of the chain may get the request, so the smallest context is used
+	contextSize := 0
+	for _, ref := range l.cfg.Models.SummarizeModel {
+		if size := l.cfg.Context.SizeFor(ref.Name); size > 0 && (contextSize == 0 || size < contextSize) {
+			contextSize = size
+		}
+	}
+	if contextSize <= 0 {
+		return 0, false
+	}
+
+	reserved := max(l.cfg.Context.ReservedCompletionTokens, l.cfg.Generation.Summarize.MaxTokens)
+	budget := contextSize - reserved - estimateTokens(systemPrompt) - 2*messageTokenOverhead
+
+	return max(budget, minSummaryChunkTokens), true
+}
+
+// summarizeInChunks summarizes chunks of the text separately and then merges partial summaries into the final one
+// using the regular summarize prompt, so the length limit and the user's instructions are respected.
+func (l *LlmConnector) summarizeInChunks(
+	ctx context.Context,
+	text string,
+	instructions string,
+	systemPrompt string,
+	budget int,
+) (string, *TokenUsage, error) {
+	usage := &TokenUsage{}
+	chunks := splitIntoChunks(text, budget)
+	if maxChunks := l.cfg.Summarization.MaxChunks; maxChunks > 0 && len(chunks) > maxChunks {
+		return "", nil, fmt.Errorf("%w: %d chunks of %d tokens, the limit is %d", ErrTextTooLong, len(chunks), budget, maxChunks)
+	}
+
+	for round := 1; ; round++ {
+		slog.Info("llm: Summarizing long text in chunks", "chunks", len(chunks), "round", round, "chunk_tokens", budget)
+
+		summaries, err := l.summarizeChunks(ctx, chunks, instructions, usage)
+		if err != nil {
+			return "", nil, err
+		}
+
+		merged := joinPartialSummaries(summaries)
+		if estimateTokens(merged) > budget && len(summaries) > 1 && round < maxSummaryReduceRounds {
+			chunks = splitIntoChunks(merged, budget)
+			continue
+		}
+
+		input := "The text was too long, so its parts were summarized separately. " +
+			"Write the summary of the whole text using these partial summaries:\n\n" + cropToTokens(merged, budget)
+
+		reply, finalUsage, err := l.summarizeOnce(ctx, systemPrompt, input)
+		if err != nil {
+			return "", nil, err
+		}
+		usage.add(finalUsage)
+		usage.Model = finalUsage.Model
+		usage.Task = TaskSummarize
+
+		if usage.Truncated {
+			reply = cropToLastSentence(reply)
+		}
+
+		return reply, usage, nil
+	}
+}
+
+// summarizeChunks summarizes the chunks with bounded parallelism. The first failure cancels the rest of requests.
+func (l *LlmConnector) summarizeChunks(ctx context.Context, chunks []string, instructions string, usage *TokenUsage) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	summaries := make([]string, len(chunks))
+	usages := make([]*TokenUsage, len(chunks))
+	errs := make([]error, len(chunks))
+
+	slots := make(chan struct{}, max(l.cfg.Summarization.Parallelism, 1))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-slots }()
+
+			summaries[i], usages[i], errs[i] = l.summarizeOnce(ctx, chunkSummaryPrompt(i+1, len(chunks), instructions), chunk)
+			if errs[i] != nil {
+				cancel()
+				return
+			}
+			if usages[i].Truncated {
+				summaries[i] = cropToLastSentence(summaries[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, chunkUsage := range usages {
+		if chunkUsage != nil {
+			usage.add(chunkUsage)
+		}
+	}
+
+	// The error which caused the cancellation is more useful than the cancellation itself
+	var cancelled error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		cancelled = err
+	}
+	if cancelled != nil {
+		return nil, cancelled
+	}
+
+	return summaries, nil
+}
+
+func chunkSummaryPrompt(part, total int, instructions string) string {
+	prompt := "You're summarizing part " + strconv.Itoa(part) + " of " + strconv.Itoa(total) + " of a long text. " +
+		"The parts are summarized separately and merged later, so keep every important fact, name, number and " +
+		"conclusion of this part. Write a concise list of facts without an introduction."
+	if instructions != "" {
+		prompt += "\n\nThe final summary will follow this instruction from the user, so keep what it needs:\n\n>" + instructions
+	}
+
+	return prompt
+}
+
+func joinPartialSummaries(summaries []string) string {
+	var sb strings.Builder
+	for i, summary := range summaries {
+		if i > 0 {
+			sb.WriteString("\n\n")
+		}
+		fmt.Fprintf(&sb, "Part %d:\n%s", i+1, strings.TrimSpace(summary))
+	}
+
+	return sb.String()
+}
+
+// splitIntoChunks splits the text on paragraph boundaries, so each chunk fits into the token budget. Paragraphs
+// bigger than the budget are split on sentences and, if needed, on words.
+func splitIntoChunks(text string, budget int) []string {
+	var units []string
+	for _, line := range strings.Split(text, "\n") {
+		paragraph := strings.TrimSpace(line)
+		if paragraph == "" {
+			continue
+		}
+
+		if estimateTokens(paragraph) <= budget {
+			units = append(units, paragraph)
+			continue
+		}
+
+		var sentences []string
+		for _, sentence := range splitSentences(paragraph) {
+			if estimateTokens(sentence) <= budget {
+				sentences = append(sentences, sentence)
+			} else {
+				sentences = append(sentences, splitWords(sentence, budget)...)
+			}
+		}
+		units = append(units, packPieces(sentences, " ", budget)...)
+	}
+
+	return packPieces(units, "\n\n", budget)
+}
+
+// packPieces joins consecutive pieces while they fit into the budget
+func packPieces(pieces []string, separator string, budget int) []string {
+	var result []string
+	var current strings.Builder
+	for _, piece := range pieces {
+		if current.Len() > 0 && estimateTokens(current.String()+separator+piece) > budget {
+			result = append(result, current.String())
+			current.Reset()
+		}
+		if current.Len() > 0 {
+			current.WriteString(separator)
+		}
+		current.WriteString(piece)
+	}
+	if current.Len() > 0 {
+		result = append(result, current.String())
+	}
+
+	return result
+}
+
+func splitSentences(text string) []string {
+	var sentences []string
+	runes := []rune(text)
+	start := 0
+	for i, r := range runes {
+		if !strings.ContainsRune(".!?…", r) || i+1 >= len(runes) || !unicode.IsSpace(runes[i+1]) {
+			continue
+		}
+		if sentence := strings.TrimSpace(string(runes[start : i+1])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = i + 1
+	}
+	if tail := strings.TrimSpace(string(runes[start:])); tail != "" {
+		sentences = append(sentences, tail)
+	}
+
+	return sentences
+}
+
+// splitWords splits the text into pieces of whole words fitting into the budget. Words bigger than the budget are cut.
+func splitWords(text string, budget int) []string {
+	var words []string
+	for _, word := range strings.Fields(text) {
+		// Each token takes at least 2 characters
+		for runes := []rune(word); len(runes) > 0; {
+			size := min(len(runes), budget*2)
+			words = append(words, string(runes[:size]))
+			runes = runes[size:]
+		}
+	}
+
+	return packPieces(words, " ", budget)
+}
@@ -0,0 +1,194 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestSplitIntoChunks(t *testing.T) {
+	paragraphs := []string{
+		strings.Repeat("First paragraph. ", 4),
+		strings.Repeat("Second paragraph. ", 4),
+		strings.Repeat("A very long sentence without an end ", 20),
+	}
+	text := strings.Join(paragraphs, "\n\n")
+
+	chunks := splitIntoChunks(text, 40)
+	if len(chunks) < 3 {
+		t.Fatalf("expected the text to be split, got %q", chunks)
+	}
+	for _, chunk := range chunks {
+		if tokens := estimateTokens(chunk); tokens > 40 {
+			t.Fatalf("chunk of %d tokens exceeds the budget: %q", tokens, chunk)
+		}
+	}
+	if chunks[0] != strings.TrimSpace(paragraphs[0])+"\n\n"+strings.TrimSpace(paragraphs[1]) {
+		t.Fatalf("paragraphs fitting into the budget must be kept together, got %q", chunks[0])
+	}
+	if strings.Join(strings.Fields(strings.Join(chunks, " ")), " ") != strings.Join(strings.Fields(text), " ") {
+		t.Fatal("chunks must contain the whole text")
+	}
+}
+
+func TestLlmConnector_SummarizeInChunks(t *testing.T) {
+	var mu sync.Mutex
+	var running, maxRunning int
+	var partial int
+	var final openai.ChatCompletionRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		reply := "The final summary."
+		if strings.HasPrefix(req.Messages[0].Content, "You're summarizing part") {
+			partial++
+			reply = "Facts about " + strings.Fields(req.Messages[1].Content)[0] + "."
+		} else {
+			final = req
+		}
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": reply}, "finish_reason": "stop"}},
+			"usage":   map[string]int{"prompt_tokens": 10, "completion_tokens": 2, "total_tokens": 12},
+		})
+	}))
+	defer server.Close()
+
+	tp, err := NewTemplateProcessor(config.PromptConfig{SummarizePrompt: "Summarize"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL:    server.URL,
+		Models:        config.ModelSelection{SummarizeModel: config.ParseModelChain("summary-model")},
+		Retry:         config.RetryConfig{MaxAttempts: 1},
+		Summarization: config.SummarizationConfig{ChunkTokens: 50, Parallelism: 2},
+	}, tp)
+
+	var paragraphs []string
+	for _, topic := range []string{"Apples", "Bananas", "Cherries", "Dates", "Elderberries"} {
+		paragraphs = append(paragraphs, topic+" "+strings.Repeat("are tasty fruits. ", 8))
+	}
+
+	summary, usage, err := l.Summarize(context.Background(), strings.Join(paragraphs, "\n"), "only yellow ones")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if summary != "The final summary." || usage.Task != TaskSummarize || usage.Model != "summary-model" {
+		t.Fatalf("unexpected result %q with usage %+v", summary, usage)
+	}
+	if partial != 5 || usage.TotalTokens != 6*12 {
+		t.Fatalf("expected 5 partial summaries and the final one, got %d partial with usage %+v", partial, usage)
+	}
+	if maxRunning != 2 {
+		t.Fatalf("expected 2 parallel requests, got %d", maxRunning)
+	}
+	if !strings.Contains(final.Messages[0].Content, "only yellow ones") ||
+		!strings.Contains(final.Messages[1].Content, "Part 1:\nFacts about Apples.") ||
+		!strings.Contains(final.Messages[1].Content, "Part 5:\nFacts about Elderberries.") {
+		t.Fatalf("unexpected final request: %+v", final.Messages)
+	}
+}
+
+func TestLlmConnector_SummarizeRequestTimeoutLimitsEachRequest(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(40 * time.Millisecond)
+		mu.Lock()
+		requests++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": "Summary."}, "finish_reason": "stop"}},
+			"usage":   map[string]int{"prompt_tokens": 10, "completion_tokens": 2, "total_tokens": 12},
+		})
+	}))
+	defer server.Close()
+
+	tp, err := NewTemplateProcessor(config.PromptConfig{SummarizePrompt: "Summarize"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL:    server.URL,
+		Models:        config.ModelSelection{SummarizeModel: config.ParseModelChain("summary-model")},
+		Retry:         config.RetryConfig{MaxAttempts: 1},
+		Summarization: config.SummarizationConfig{ChunkTokens: 50, Parallelism: 1},
+	}, tp)
+
+	var paragraphs []string
+	for range 4 {
+		paragraphs = append(paragraphs, strings.Repeat("Fruits are tasty. ", 9))
+	}
+
+	// The whole summarization takes longer than the timeout while each request fits into it
+	ctx := WithSummarizeRequestTimeout(context.Background(), 150*time.Millisecond)
+	if _, _, err := l.Summarize(ctx, strings.Join(paragraphs, "\n"), ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests != 5 {
+		t.Fatalf("expected 4 partial summaries and the final one, got %d requests", requests)
+	}
+
+	ctx = WithSummarizeRequestTimeout(context.Background(), 10*time.Millisecond)
+	if _, _, err := l.Summarize(ctx, "Short text.", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+}
+
+func TestLlmConnector_SummarizeRejectsTooManyChunks(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	tp, err := NewTemplateProcessor(config.PromptConfig{SummarizePrompt: "Summarize"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL:    server.URL,
+		Models:        config.ModelSelection{SummarizeModel: config.ParseModelChain("summary-model")},
+		Retry:         config.RetryConfig{MaxAttempts: 1},
+		Summarization: config.SummarizationConfig{ChunkTokens: 50, Parallelism: 1, MaxChunks: 3},
+	}, tp)
+
+	var paragraphs []string
+	for range 4 {
+		paragraphs = append(paragraphs, strings.Repeat("Fruits are tasty. ", 9))
+	}
+
+	if _, _, err := l.Summarize(context.Background(), strings.Join(paragraphs, "\n"), ""); !errors.Is(err, ErrTextTooLong) {
+		t.Fatalf("expected ErrTextTooLong, got %v", err)
+	}
+	if requests != 0 {
+		t.Fatalf("too long texts must be rejected before any request, got %d requests", requests)
+	}
+}
@@ -11,6 +11,7 @@ type TemplateProcessor struct {
 	chatTemplate             *template.Template
 	summarizeTemplate        *template.Template
 	imageRecognitionTemplate *template.Template
+	historySummaryTemplate   *template.Template
 	language                 string
 	gender                   string
 	maxSummaryLength         int
@@ -33,10 +34,16 @@ func NewTemplateProcessor(prompts config.PromptConfig) (*TemplateProcessor, erro
 		return nil, err
 	}
 
+	historySummaryTmpl, err := template.New("history_summary").Parse(prompts.HistorySummaryPrompt)
+	if err != nil {
+		return nil, err
+	}
+
 	return &TemplateProcessor{
 		chatTemplate:             chatTmpl,
 		summarizeTemplate:        summarizeTmpl,
 		imageRecognitionTemplate: imageRecognitionTmpl,
+		historySummaryTemplate:   historySummaryTmpl,
 		language:                 prompts.Language,
 		gender:                   prompts.Gender,
 		maxSummaryLength:         prompts.MaxSummaryLength,
@@ -92,3 +99,19 @@ func (p *TemplateProcessor) ProcessImageRecognitionTemplate() (string, error) {
 	}
 	return buf.String(), nil
 }
+
+// ProcessHistorySummaryTemplate processes the chat history summary prompt template
+func (p *TemplateProcessor) ProcessHistorySummaryTemplate() (string, error) {
+	var buf bytes.Buffer
+	err := p.historySummaryTemplate.Execute(&buf, struct {
+		Language  string
+		MaxLength int
+	}{
+		Language:  p.language,
+		MaxLength: p.maxSummaryLength,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
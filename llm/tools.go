@@ -0,0 +1,214 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Tool results longer than this are cropped to save the context
+const maxToolResultLength = 8000
+
+var (
+	ErrUnknownTool  = errors.New("unknown tool")
+	ErrNoToolsReply = errors.New("model didn't reply without tools")
+)
+
+// Tool is a function which the chat model can call to get data it doesn't have
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is a JSON schema of the arguments object
+	Parameters any
+	// Call runs the tool with the arguments provided by the model as a JSON object
+	Call func(ctx context.Context, rc RequestContext, arguments string) (string, error)
+}
+
+// ToolCall is a record of the tool called while handling a request
+type ToolCall struct {
+	Name     string
+	Failed   bool
+	Duration time.Duration
+}
+
+// ToolRegistry contains tools available to the chat model
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools []Tool
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{}
+}
+
+// Register adds the tool replacing the registered one with the same name
+func (r *ToolRegistry) Register(tool Tool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, registered := range r.tools {
+		if registered.Name == tool.Name {
+			r.tools[i] = tool
+			return
+		}
+	}
+	r.tools = append(r.tools, tool)
+}
+
+func (r *ToolRegistry) definitions() []openai.Tool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	definitions := make([]openai.Tool, 0, len(r.tools))
+	for _, tool := range r.tools {
+		definitions = append(definitions, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	return definitions
+}
+
+func (r *ToolRegistry) find(name string) (Tool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, tool := range r.tools {
+		if tool.Name == name {
+			return tool, true
+		}
+	}
+
+	return Tool{}, false
+}
+
+// call runs the requested tool. Errors are returned to the model as the tool result, so it can recover from them.
+func (r *ToolRegistry) call(ctx context.Context, rc RequestContext, toolCall openai.ToolCall) (string, ToolCall) {
+	record := ToolCall{Name: toolCall.Function.Name}
+	started := time.Now()
+
+	tool, found := r.find(toolCall.Function.Name)
+	if !found {
+		record.Failed = true
+		slog.Warn("llm: Model called unknown tool", "tool", toolCall.Function.Name)
+
+		return "Error: " + ErrUnknownTool.Error(), record
+	}
+
+	result, err := tool.Call(ctx, rc, toolCall.Function.Arguments)
+	record.Duration = time.Since(started)
+	if err != nil {
+		record.Failed = true
+		slog.Error("llm: Tool call failed", "tool", tool.Name, "arguments", toolCall.Function.Arguments, "error", err)
+		sentry.CaptureException(err)
+
+		return "Error: " + err.Error(), record
+	}
+
+	slog.Info("llm: Tool called", "tool", tool.Name, "arguments", toolCall.Function.Arguments, "duration", record.Duration)
+
+	if runes := []rune(result); len(runes) > maxToolResultLength {
+		result = string(runes[:maxToolResultLength]) + "…"
+	}
+
+	return result, record
+}
+
+func (l *LlmConnector) toolsEnabled() bool {
+	return l.cfg.Tools.Enabled && len(l.tools.definitions()) > 0
+}
+
+// RegisterTool makes the tool available to the chat model when tools are enabled
+func (l *LlmConnector) RegisterTool(tool Tool) {
+	l.tools.Register(tool)
+}
+
+// completeWithTools lets the model call tools until it replies with text. The number of steps is limited, so when
+// the limit is reached, the model is asked to reply without tools. Back-ends ignoring the tool choice get one more
+// request without the tools at all.
+func (l *LlmConnector) completeWithTools(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+	rc RequestContext,
+) (string, *TokenUsage, error) {
+	req.Tools = l.tools.definitions()
+	usage := &TokenUsage{}
+
+	for step := 0; ; step++ {
+		if step >= l.cfg.Tools.MaxSteps {
+			slog.Warn("llm: Tool steps limit reached, requesting final reply", "steps", step)
+			req.ToolChoice = "none"
+		}
+
+		message, stepUsage, err := l.completeMessage(ctx, ep, req)
+		if err != nil {
+			return "", nil, err
+		}
+		usage.add(stepUsage)
+
+		if len(message.ToolCalls) == 0 {
+			return message.Content, usage, nil
+		}
+
+		if req.ToolChoice == "none" {
+			if message.Content != "" {
+				return message.Content, usage, nil
+			}
+
+			return l.completeWithoutTools(ctx, ep, req, usage)
+		}
+
+		req.Messages = append(req.Messages, message)
+		for _, toolCall := range message.ToolCalls {
+			result, record := l.tools.call(ctx, rc, toolCall)
+			usage.ToolCalls = append(usage.ToolCalls, record)
+
+			req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    result,
+				Name:       toolCall.Function.Name,
+				ToolCallID: toolCall.ID,
+			})
+		}
+
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		}
+	}
+}
+
+// completeWithoutTools requests the final reply from the model which ignored the "none" tool choice
+func (l *LlmConnector) completeWithoutTools(
+	ctx context.Context,
+	ep *endpoint,
+	req openai.ChatCompletionRequest,
+	usage *TokenUsage,
+) (string, *TokenUsage, error) {
+	slog.Warn("llm: Model called tools after the steps limit, requesting final reply without tools")
+
+	req.Tools = nil
+	req.ToolChoice = nil
+
+	message, stepUsage, err := l.completeMessage(ctx, ep, req)
+	if err != nil {
+		return "", nil, err
+	}
+	usage.add(stepUsage)
+
+	if message.Content == "" && len(message.ToolCalls) > 0 {
+		return "", nil, ErrNoToolsReply
+	}
+
+	return message.Content, usage, nil
+}
@@ -0,0 +1,89 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"telegram-ollama-reply-bot/extractor"
+)
+
+var ErrInvalidToolArguments = errors.New("invalid tool arguments")
+
+// NewCurrentTimeTool creates a tool returning the current date and time in the requested time zone
+func NewCurrentTimeTool() Tool {
+	return Tool{
+		Name:        "current_datetime",
+		Description: "Get the current date, time and day of the week.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"timezone": map[string]any{
+					"type":        "string",
+					"description": "IANA time zone name, e.g. Europe/Moscow. UTC is used when omitted.",
+				},
+			},
+		},
+		Call: func(_ context.Context, _ RequestContext, arguments string) (string, error) {
+			var args struct {
+				Timezone string `json:"timezone"`
+			}
+			if arguments != "" {
+				if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+					return "", errors.Join(ErrInvalidToolArguments, err)
+				}
+			}
+
+			location := time.UTC
+			if args.Timezone != "" {
+				loc, err := time.LoadLocation(args.Timezone)
+				if err != nil {
+					return "", errors.Join(ErrInvalidToolArguments, err)
+				}
+				location = loc
+			}
+
+			return time.Now().In(location).Format("Monday, 2006-01-02 15:04:05 MST"), nil
+		},
+	}
+}
+
+// NewFetchUrlTool creates a tool which reads the main text of a web page
+func NewFetchUrlTool(ext extractor.Extractor) Tool {
+	return Tool{
+		Name:        "fetch_url",
+		Description: "Download a web page and return its title and main text. Use it when the user asks about a link.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"url": map[string]any{
+					"type":        "string",
+					"description": "Absolute http or https URL of the page.",
+				},
+			},
+			"required": []string{"url"},
+		},
+		Call: func(ctx context.Context, _ RequestContext, arguments string) (string, error) {
+			var args struct {
+				Url string `json:"url"`
+			}
+			if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+				return "", errors.Join(ErrInvalidToolArguments, err)
+			}
+
+			parsed, err := url.ParseRequestURI(args.Url)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return "", errors.Join(ErrInvalidToolArguments, errors.New("url must be an absolute http(s) URL"))
+			}
+
+			article, err := ext.GetArticleFromUrl(ctx, args.Url)
+			if err != nil {
+				return "", err
+			}
+
+			return "Title: " + article.Title + "\n\n" + article.Text, nil
+		},
+	}
+}
@@ -0,0 +1,129 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"telegram-ollama-reply-bot/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestLlmConnector_ToolLoop(t *testing.T) {
+	var requests []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(requests) == 1 {
+			_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","tool_calls":[
+				{"id":"call_1","type":"function","function":{"name":"echo","arguments":"{\"text\":\"pong\"}"}},
+				{"id":"call_2","type":"function","function":{"name":"missing","arguments":"{}"}}
+			]}}],"usage":{"total_tokens":10}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"done"}}],"usage":{"total_tokens":5}}`))
+	}))
+	defer server.Close()
+
+	tp, err := NewTemplateProcessor(config.PromptConfig{ChatSystemPrompt: "system"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Models:     config.ModelSelection{TextRequestModel: config.ParseModelChain("model")},
+		Retry:      config.RetryConfig{MaxAttempts: 1},
+		Tools:      config.ToolsConfig{Enabled: true, MaxSteps: 3},
+	}, tp)
+	l.RegisterTool(Tool{
+		Name:       "echo",
+		Parameters: map[string]any{"type": "object"},
+		Call: func(_ context.Context, _ RequestContext, arguments string) (string, error) {
+			var args struct {
+				Text string `json:"text"`
+			}
+			_ = json.Unmarshal([]byte(arguments), &args)
+
+			return args.Text, nil
+		},
+	})
+
+	reply, usage, err := l.HandleChatMessage(context.Background(), ChatMessage{Text: "ping"}, RequestContext{Empty: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply != "done" || usage.TotalTokens != 15 {
+		t.Fatalf("unexpected reply %q with usage %+v", reply, usage)
+	}
+	if len(usage.ToolCalls) != 2 || usage.ToolCalls[0].Failed || !usage.ToolCalls[1].Failed {
+		t.Fatalf("unexpected tool calls: %+v", usage.ToolCalls)
+	}
+
+	if len(requests) != 2 || len(requests[0].Tools) != 1 {
+		t.Fatalf("unexpected requests: %+v", requests)
+	}
+	messages := requests[1].Messages
+	toolResult := messages[len(messages)-2]
+	if toolResult.Role != openai.ChatMessageRoleTool || toolResult.ToolCallID != "call_1" || toolResult.Content != "pong" {
+		t.Fatalf("unexpected tool result message: %+v", toolResult)
+	}
+}
+
+func TestLlmConnector_ToolLoopWithIgnoredToolChoice(t *testing.T) {
+	var requests []openai.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		// The back-end calls tools whenever they are available regardless of the tool choice
+		if len(req.Tools) > 0 {
+			_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","tool_calls":[
+				{"id":"call_1","type":"function","function":{"name":"echo","arguments":"{}"}}
+			]}}],"usage":{"total_tokens":10}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"done"}}],"usage":{"total_tokens":5}}`))
+	}))
+	defer server.Close()
+
+	tp, err := NewTemplateProcessor(config.PromptConfig{ChatSystemPrompt: "system"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewConnector(config.LLMConfig{
+		APIBaseURL: server.URL,
+		Models:     config.ModelSelection{TextRequestModel: config.ParseModelChain("model")},
+		Retry:      config.RetryConfig{MaxAttempts: 1},
+		Tools:      config.ToolsConfig{Enabled: true, MaxSteps: 1},
+	}, tp)
+	l.RegisterTool(Tool{
+		Name:       "echo",
+		Parameters: map[string]any{"type": "object"},
+		Call: func(context.Context, RequestContext, string) (string, error) {
+			return "pong", nil
+		},
+	})
+
+	reply, usage, err := l.HandleChatMessage(context.Background(), ChatMessage{Text: "ping"}, RequestContext{Empty: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply != "done" || usage.TotalTokens != 25 || len(usage.ToolCalls) != 1 {
+		t.Fatalf("unexpected reply %q with usage %+v", reply, usage)
+	}
+
+	if len(requests) != 3 || requests[1].ToolChoice != "none" {
+		t.Fatalf("unexpected requests: %+v", requests)
+	}
+	if len(requests[2].Tools) != 0 || requests[2].ToolChoice != nil {
+		t.Fatalf("final request must not contain tools: %+v", requests[2])
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"telegram-ollama-reply-bot/audit"
 	"telegram-ollama-reply-bot/bot"
 	"telegram-ollama-reply-bot/config"
 	"telegram-ollama-reply-bot/extractor"
@@ -18,6 +21,18 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := audit.RunCommand(os.Args[2:], config.LoadAudit().Path, os.Stdout); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	ctx := context.Background()
 
 	cfg := config.Load()
@@ -49,6 +64,31 @@ func main() {
 
 	llmc := llm.NewConnector(cfg.LLM, templateProcessor)
 
+	// os.Exit skips deferred calls, so the audit log is closed explicitly before exiting
+	var auditLog *audit.Logger
+	closeAuditLog := func() {
+		if auditLog == nil {
+			return
+		}
+		if err := auditLog.Close(); err != nil {
+			slog.Error("main: Cannot close audit log", "error", err)
+		}
+	}
+	if cfg.Audit.Path != "" {
+		slog.Info("main: Writing LLM requests to the audit log", "path", cfg.Audit.Path)
+
+		auditLog, err = audit.NewLogger(cfg.Audit)
+		if err != nil {
+			slog.Error("main: Cannot open audit log", "error", err)
+			sentry.CaptureException(err)
+
+			os.Exit(1)
+		}
+		defer closeAuditLog()
+
+		llmc.SetAuditLog(auditLog)
+	}
+
 	slog.Info("main: Checking models availability")
 
 	hasAll, searchResult := llmc.HasAllModels(ctx, cfg.LLM.Models)
@@ -56,29 +96,68 @@ func main() {
 		slog.Error("main: Not all models are available", "result", searchResult)
 		sentry.CaptureMessage("Not all models are available")
 
+		closeAuditLog()
 		os.Exit(1)
 	}
 
 	slog.Info("main: All needed models are available")
 
-	ext := extractor.NewExtractor()
+	extractorClient, err := extractor.NewHttpClient(cfg.Extractor)
+	if err != nil {
+		slog.Error("main: Cannot create HTTP client for the extractor", "error", err)
+		sentry.CaptureException(err)
+
+		closeAuditLog()
+		os.Exit(1)
+	}
+	ext := extractor.NewExtractor(extractorClient)
+
+	llmc.RegisterTool(llm.NewCurrentTimeTool())
+	llmc.RegisterTool(llm.NewFetchUrlTool(ext))
 
 	telegramApi, err := tg.NewBot(cfg.Bot.Telegram.Token, tg.WithLogger(bot.NewLogger("telego: ")))
 	if err != nil {
 		fmt.Println(err)
 		sentry.CaptureMessage("Telegram API initialization failed")
 
+		closeAuditLog()
 		os.Exit(1)
 	}
 
+	var historyStore bot.HistoryStore
+	if cfg.Bot.HistoryStoragePath != "" {
+		slog.Info("main: Using persistent chat history storage", "path", cfg.Bot.HistoryStoragePath)
+
+		historyStore, err = bot.NewBoltHistoryStore(cfg.Bot.HistoryStoragePath, cfg.Bot.HistoryLength, cfg.Bot.MemoryLimit)
+		if err != nil {
+			slog.Error("main: Cannot open chat history storage", "error", err)
+			sentry.CaptureException(err)
+
+			closeAuditLog()
+			os.Exit(1)
+		}
+	} else {
+		slog.Info("main: Using in-memory chat history storage")
+
+		historyStore = bot.NewMemoryHistoryStore(cfg.Bot.HistoryLength, cfg.Bot.MemoryLimit)
+	}
+	defer func() {
+		if err := historyStore.Close(); err != nil {
+			slog.Error("main: Cannot close chat history storage", "error", err)
+		}
+	}()
+
 	sanitizer := markdown.NewTgMarkdownV2Sanitizer()
-	botService := bot.NewBot(telegramApi, llmc, ext, sanitizer, bot.NewImageCache(), cfg.Bot, ctx)
+	renderer := markdown.NewTgEntitiesRenderer()
+	botService := bot.NewBot(telegramApi, llmc, ext, sanitizer, renderer, bot.NewImageCache(), historyStore, cfg.Bot, ctx)
 
 	err = botService.Run()
 	if err != nil {
 		slog.Error("main: Running bot finished with an error", "error", err)
 		sentry.CaptureMessage("Bot start error")
+		_ = historyStore.Close()
 
+		closeAuditLog()
 		os.Exit(1)
 	}
 }
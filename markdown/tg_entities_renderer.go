@@ -0,0 +1,589 @@
+package markdown
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	t "github.com/mymmrac/telego"
+)
+
+// EntitiesRenderer converts Markdown written by LLMs (CommonMark with some common extensions) into plain text with
+// Telegram message entities. Such messages are sent without parse mode, so Telegram never rejects them because of
+// markup errors. Unsupported or broken markup is kept as plain text, as well as links with URLs Telegram doesn't
+// accept. Block quotations are rendered as regular ones; expandable quotations are only produced by Wrapped.
+type EntitiesRenderer interface {
+	Render(text string) Rendered
+}
+
+// Rendered is a plain text with Telegram message entities. Entity offsets and lengths are in UTF-16 code units as
+// required by Telegram.
+type Rendered struct {
+	Text     string
+	Entities []t.MessageEntity
+}
+
+// NewTgEntitiesRenderer returns an EntitiesRenderer producing Telegram message entities.
+func NewTgEntitiesRenderer() EntitiesRenderer {
+	return tgEntitiesRenderer{}
+}
+
+type tgEntitiesRenderer struct{}
+
+// inlineDelimiters are checked in order, so longer markers must go before shorter ones with the same characters
+var inlineDelimiters = []struct {
+	marker     string
+	entityType string
+}{
+	{"**", t.EntityTypeBold},
+	{"__", t.EntityTypeBold},
+	{"~~", t.EntityTypeStrikethrough},
+	{"||", t.EntityTypeSpoiler},
+	{"*", t.EntityTypeItalic},
+	{"_", t.EntityTypeItalic},
+}
+
+// entitiesBuilder accumulates plain text and entities keeping track of the UTF-16 length of the text
+type entitiesBuilder struct {
+	text     strings.Builder
+	offset   int
+	entities []t.MessageEntity
+}
+
+func (b *entitiesBuilder) write(s string) {
+	b.text.WriteString(s)
+	b.offset += utf16Len(s)
+}
+
+func (b *entitiesBuilder) writeRune(r rune) {
+	b.text.WriteRune(r)
+	b.offset += utf16RuneLen(r)
+}
+
+// wrap adds an entity covering the text written since start. Empty entities are skipped.
+func (b *entitiesBuilder) wrap(start int, entity t.MessageEntity) {
+	if b.offset <= start {
+		return
+	}
+
+	entity.Offset = start
+	entity.Length = b.offset - start
+	b.entities = append(b.entities, entity)
+}
+
+// Render parses Markdown and returns its plain text representation with entities.
+func (r tgEntitiesRenderer) Render(text string) Rendered {
+	b := &entitiesBuilder{}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		if i > 0 {
+			b.write("\n")
+		}
+
+		line := lines[i]
+		trimmed := strings.TrimLeft(line, " ")
+
+		if fence, lang, ok := parseFenceOpening(trimmed); ok {
+			end := i + 1
+			for end < len(lines) && !strings.HasPrefix(strings.TrimLeft(lines[end], " "), fence) {
+				end++
+			}
+
+			start := b.offset
+			b.write(strings.Join(lines[i+1:min(end, len(lines))], "\n"))
+			b.wrap(start, t.MessageEntity{Type: t.EntityTypePre, Language: lang})
+
+			i = end
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, ">") {
+			start := b.offset
+			for {
+				quoted := strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">")
+				r.inline(b, []rune(strings.TrimPrefix(quoted, " ")))
+
+				if i+1 >= len(lines) || !strings.HasPrefix(strings.TrimLeft(lines[i+1], " "), ">") {
+					break
+				}
+				i++
+				b.write("\n")
+			}
+			b.wrap(start, t.MessageEntity{Type: t.EntityTypeBlockquote})
+
+			continue
+		}
+
+		if heading, ok := parseHeading(trimmed); ok {
+			start := b.offset
+			r.inline(b, []rune(heading))
+			b.wrap(start, t.MessageEntity{Type: t.EntityTypeBold})
+
+			continue
+		}
+
+		if isThematicBreak(trimmed) {
+			b.write("———")
+
+			continue
+		}
+
+		indent := line[:len(line)-len(trimmed)]
+		if len(trimmed) > 1 && strings.ContainsRune("-*+", rune(trimmed[0])) && trimmed[1] == ' ' {
+			b.write(indent + "• ")
+			trimmed = trimmed[2:]
+		} else {
+			b.write(indent)
+		}
+
+		r.inline(b, []rune(trimmed))
+	}
+
+	entities := b.entities
+	slices.SortStableFunc(entities, func(a, b t.MessageEntity) int {
+		if a.Offset != b.Offset {
+			return a.Offset - b.Offset
+		}
+		return b.Length - a.Length
+	})
+
+	return Rendered{
+		Text:     b.text.String(),
+		Entities: entities,
+	}
+}
+
+// inline renders inline markup: emphasis, code spans, links and escapes
+func (r tgEntitiesRenderer) inline(b *entitiesBuilder, runes []rune) {
+	i := 0
+	for i < len(runes) {
+		c := runes[i]
+
+		switch {
+		case c == '\\' && i+1 < len(runes) && isEscapable(runes[i+1]):
+			b.writeRune(runes[i+1])
+			i += 2
+			continue
+		case c == '`':
+			n := runLength(runes, i, '`')
+			if end := findCodeSpanEnd(runes, i+n, n); end >= 0 {
+				code := string(runes[i+n : end])
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				start := b.offset
+				b.write(code)
+				b.wrap(start, t.MessageEntity{Type: t.EntityTypeCode})
+				i = end + n
+			} else {
+				b.write(string(runes[i : i+n]))
+				i += n
+			}
+			continue
+		case c == '[' || c == '!' && i+1 < len(runes) && runes[i+1] == '[':
+			textStart := i + 1
+			if c == '!' {
+				textStart++
+			}
+			if textEnd, url, next, ok := parseLink(runes, textStart); ok {
+				start := b.offset
+				if textEnd > textStart {
+					r.inline(b, runes[textStart:textEnd])
+				} else {
+					b.write(url)
+				}
+				if isValidLinkURL(url) {
+					b.wrap(start, t.MessageEntity{Type: t.EntityTypeTextLink, URL: url})
+				}
+				i = next
+				continue
+			}
+		case c == '<':
+			if end := slices.Index(runes[i:], '>'); end > 0 {
+				inner := string(runes[i+1 : i+end])
+				if strings.HasPrefix(inner, "http://") || strings.HasPrefix(inner, "https://") {
+					b.write(inner)
+					i += end + 1
+					continue
+				}
+			}
+		}
+
+		matched := false
+		for _, d := range inlineDelimiters {
+			marker := []rune(d.marker)
+			if !hasRunePrefix(runes[i:], marker) || !canOpenEmphasis(runes, i, marker) {
+				continue
+			}
+			end := findEmphasisCloser(runes, i+len(marker), marker)
+			if end < 0 {
+				continue
+			}
+
+			start := b.offset
+			r.inline(b, runes[i+len(marker):end])
+			b.wrap(start, t.MessageEntity{Type: d.entityType})
+			i = end + len(marker)
+			matched = true
+			break
+		}
+		if matched {
+			continue
+		}
+
+		b.writeRune(c)
+		i++
+	}
+}
+
+// Wrapped returns the plain text entirely covered with an entity of the given type.
+func Wrapped(text string, entityType string) Rendered {
+	if text == "" {
+		return Rendered{}
+	}
+
+	return Rendered{
+		Text:     text,
+		Entities: []t.MessageEntity{{Type: entityType, Offset: 0, Length: utf16Len(text)}},
+	}
+}
+
+// Split splits the rendered text into parts which are no longer than limit UTF-16 code units each. Paragraph
+// boundaries are preferred over line breaks and line breaks over spaces. Entities crossing the split point are
+// clipped and continued in the next part.
+func (r Rendered) Split(limit int) []Rendered {
+	if utf16Len(r.Text) <= limit {
+		return []Rendered{r}
+	}
+
+	runes := []rune(r.Text)
+	offsets := make([]int, len(runes)+1)
+	for i, c := range runes {
+		offsets[i+1] = offsets[i] + utf16RuneLen(c)
+	}
+
+	var parts []Rendered
+	start := 0
+	for start < len(runes) {
+		end := start
+		for end < len(runes) && offsets[end+1]-offsets[start] <= limit {
+			end++
+		}
+		if end == start {
+			end = start + 1
+		}
+
+		next := end
+		if end < len(runes) {
+			end, next = chooseEntitiesSplit(runes, start, end)
+		}
+
+		parts = append(parts, r.slice(runes, offsets, start, end))
+		start = next
+	}
+
+	return parts
+}
+
+// Crop returns the rendered text cut to limit UTF-16 code units with an ellipsis added if it was longer. The second
+// value is true if the text was cut.
+func (r Rendered) Crop(limit int) (Rendered, bool) {
+	if utf16Len(r.Text) <= limit {
+		return r, false
+	}
+
+	cropped := r.Split(limit - 1)[0]
+	cropped.Text += "…"
+
+	return cropped, true
+}
+
+// Append returns the rendered text followed by another one with its entities shifted accordingly.
+func (r Rendered) Append(other Rendered) Rendered {
+	offset := utf16Len(r.Text)
+
+	entities := slices.Clone(r.Entities)
+	for _, e := range other.Entities {
+		e.Offset += offset
+		entities = append(entities, e)
+	}
+
+	return Rendered{
+		Text:     r.Text + other.Text,
+		Entities: entities,
+	}
+}
+
+// chooseEntitiesSplit looks for the best split point in the second half of runes[start:maxEnd]. It returns the end
+// of the current part and the start of the next one.
+func chooseEntitiesSplit(runes []rune, start int, maxEnd int) (int, int) {
+	minEnd := start + (maxEnd-start)/2
+
+	for i := maxEnd; i > minEnd; i-- {
+		if runes[i] == '\n' && i > 0 && runes[i-1] == '\n' {
+			return i - 1, i + 1
+		}
+	}
+	for i := maxEnd; i > minEnd; i-- {
+		if runes[i] == '\n' {
+			return i, i + 1
+		}
+	}
+	for i := maxEnd; i > minEnd; i-- {
+		if runes[i] == ' ' {
+			return i, i + 1
+		}
+	}
+
+	return maxEnd, maxEnd
+}
+
+func (r Rendered) slice(runes []rune, offsets []int, start int, end int) Rendered {
+	from := offsets[start]
+	to := offsets[end]
+
+	var entities []t.MessageEntity
+	for _, e := range r.Entities {
+		entityStart := max(e.Offset, from)
+		entityEnd := min(e.Offset+e.Length, to)
+		if entityEnd <= entityStart {
+			continue
+		}
+
+		e.Offset = entityStart - from
+		e.Length = entityEnd - entityStart
+		entities = append(entities, e)
+	}
+
+	return Rendered{
+		Text:     string(runes[start:end]),
+		Entities: entities,
+	}
+}
+
+func parseFenceOpening(line string) (string, string, bool) {
+	for _, c := range []string{"`", "~"} {
+		n := 0
+		for n < len(line) && line[n] == c[0] {
+			n++
+		}
+		if n < 3 {
+			continue
+		}
+
+		info := strings.TrimSpace(line[n:])
+		if c == "`" && strings.Contains(info, "`") {
+			return "", "", false
+		}
+		lang, _, _ := strings.Cut(info, " ")
+
+		return line[:n], lang, true
+	}
+
+	return "", "", false
+}
+
+func parseHeading(line string) (string, bool) {
+	n := 0
+	for n < len(line) && line[n] == '#' {
+		n++
+	}
+	if n == 0 || n > 6 || n >= len(line) || line[n] != ' ' {
+		return "", false
+	}
+
+	return strings.TrimRight(strings.TrimSpace(line[n:]), "#"), true
+}
+
+func isThematicBreak(line string) bool {
+	line = strings.ReplaceAll(line, " ", "")
+	if len(line) < 3 {
+		return false
+	}
+
+	return strings.Count(line, "-") == len(line) || strings.Count(line, "*") == len(line) ||
+		strings.Count(line, "_") == len(line)
+}
+
+// parseLink parses "text](url)" starting right after the opening bracket. It returns the end of the link text,
+// the URL and the position after the link.
+func parseLink(runes []rune, textStart int) (int, string, int, bool) {
+	depth := 1
+	textEnd := textStart
+	for ; textEnd < len(runes); textEnd++ {
+		if runes[textEnd] == '\\' {
+			textEnd++
+			continue
+		}
+		if runes[textEnd] == '[' {
+			depth++
+		}
+		if runes[textEnd] == ']' {
+			depth--
+			if depth == 0 {
+				break
+			}
+		}
+	}
+	if textEnd+1 >= len(runes) || runes[textEnd+1] != '(' {
+		return 0, "", 0, false
+	}
+
+	depth = 1
+	urlEnd := textEnd + 2
+	for ; urlEnd < len(runes); urlEnd++ {
+		if runes[urlEnd] == '(' {
+			depth++
+		}
+		if runes[urlEnd] == ')' {
+			depth--
+			if depth == 0 {
+				break
+			}
+		}
+	}
+	if urlEnd >= len(runes) {
+		return 0, "", 0, false
+	}
+
+	url := strings.TrimSpace(string(runes[textEnd+2 : urlEnd]))
+	// Drop the optional link title
+	url, _, _ = strings.Cut(url, " ")
+	url = strings.TrimSuffix(strings.TrimPrefix(url, "<"), ">")
+	if url == "" {
+		return 0, "", 0, false
+	}
+
+	return textEnd, url, urlEnd + 1, true
+}
+
+// isValidLinkURL checks that Telegram accepts the URL of a text link. Relative links and unknown schemes are rejected.
+func isValidLinkURL(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "tg", "mailto":
+		return true
+	default:
+		return false
+	}
+}
+
+func runLength(runes []rune, start int, c rune) int {
+	n := 0
+	for start+n < len(runes) && runes[start+n] == c {
+		n++
+	}
+
+	return n
+}
+
+// findCodeSpanEnd returns the position of the backtick run of exactly n backticks closing the code span
+func findCodeSpanEnd(runes []rune, from int, n int) int {
+	for i := from; i < len(runes); {
+		if runes[i] != '`' {
+			i++
+			continue
+		}
+
+		length := runLength(runes, i, '`')
+		if length == n {
+			return i
+		}
+		i += length
+	}
+
+	return -1
+}
+
+func canOpenEmphasis(runes []rune, i int, marker []rune) bool {
+	next := i + len(marker)
+	if next >= len(runes) || unicode.IsSpace(runes[next]) {
+		return false
+	}
+	// Intraword underscores like in snake_case are not emphasis
+	if marker[0] == '_' && i > 0 && isWordRune(runes[i-1]) {
+		return false
+	}
+
+	return true
+}
+
+// findEmphasisCloser returns the position of the marker closing the emphasis opened right before from
+func findEmphasisCloser(runes []rune, from int, marker []rune) int {
+	for i := from; i < len(runes); {
+		switch {
+		case runes[i] == '\\':
+			i += 2
+			continue
+		case runes[i] == '`':
+			n := runLength(runes, i, '`')
+			if end := findCodeSpanEnd(runes, i+n, n); end >= 0 {
+				i = end + n
+			} else {
+				i += n
+			}
+			continue
+		}
+
+		if !hasRunePrefix(runes[i:], marker) {
+			i++
+			continue
+		}
+
+		// A run like "***" closes both nested entities, so the closer is at its end. A run of two characters is
+		// a double marker which can't close a single one.
+		runLen := runLength(runes, i, marker[0])
+		if runLen == 2 && len(marker) == 1 {
+			i += runLen
+			continue
+		}
+		closer := i + runLen - len(marker)
+
+		end := closer + len(marker)
+		if closer > from && !unicode.IsSpace(runes[i-1]) &&
+			(marker[0] != '_' || end >= len(runes) || !isWordRune(runes[end])) {
+			return closer
+		}
+		i += runLen
+	}
+
+	return -1
+}
+
+func hasRunePrefix(runes []rune, prefix []rune) bool {
+	return len(runes) >= len(prefix) && slices.Equal(runes[:len(prefix)], prefix)
+}
+
+func isEscapable(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16RuneLen(r)
+	}
+
+	return n
+}
+
+func utf16RuneLen(r rune) int {
+	if n := utf16.RuneLen(r); n > 0 {
+		return n
+	}
+
+	return 1
+}
@@ -0,0 +1,153 @@
+package markdown
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tg "github.com/mymmrac/telego"
+)
+
+func TestTgEntitiesRenderer_InlineFormatting(t *testing.T) {
+	r := NewTgEntitiesRenderer()
+	got := r.Render("**bold** *italic* _also italic_ `code` ~~strike~~ ||spoiler|| [link](https://example.com/a_(b))")
+	expected := Rendered{
+		Text: "bold italic also italic code strike spoiler link",
+		Entities: []tg.MessageEntity{
+			{Type: tg.EntityTypeBold, Offset: 0, Length: 4},
+			{Type: tg.EntityTypeItalic, Offset: 5, Length: 6},
+			{Type: tg.EntityTypeItalic, Offset: 12, Length: 11},
+			{Type: tg.EntityTypeCode, Offset: 24, Length: 4},
+			{Type: tg.EntityTypeStrikethrough, Offset: 29, Length: 6},
+			{Type: tg.EntityTypeSpoiler, Offset: 36, Length: 7},
+			{Type: tg.EntityTypeTextLink, Offset: 44, Length: 4, URL: "https://example.com/a_(b)"},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected render result:\nexpected: %+v\nactual:   %+v", expected, got)
+	}
+}
+
+func TestTgEntitiesRenderer_NestedFormatting(t *testing.T) {
+	r := NewTgEntitiesRenderer()
+	got := r.Render("**bold *bold italic***")
+	expected := Rendered{
+		Text: "bold bold italic",
+		Entities: []tg.MessageEntity{
+			{Type: tg.EntityTypeBold, Offset: 0, Length: 16},
+			{Type: tg.EntityTypeItalic, Offset: 5, Length: 11},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected render result:\nexpected: %+v\nactual:   %+v", expected, got)
+	}
+}
+
+func TestTgEntitiesRenderer_UTF16Offsets(t *testing.T) {
+	r := NewTgEntitiesRenderer()
+	got := r.Render("👍 **привет** 😀")
+	expected := Rendered{
+		Text:     "👍 привет 😀",
+		Entities: []tg.MessageEntity{{Type: tg.EntityTypeBold, Offset: 3, Length: 6}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected render result:\nexpected: %+v\nactual:   %+v", expected, got)
+	}
+}
+
+func TestTgEntitiesRenderer_Blocks(t *testing.T) {
+	r := NewTgEntitiesRenderer()
+	input := "# Title\n\n- item *one*\n- item two\n\n```go\nfmt.Println(\"*\")\n```\n> quote line 1\n> **quote** line 2"
+	got := r.Render(input)
+	expected := Rendered{
+		Text: "Title\n\n• item one\n• item two\n\nfmt.Println(\"*\")\nquote line 1\nquote line 2",
+		Entities: []tg.MessageEntity{
+			{Type: tg.EntityTypeBold, Offset: 0, Length: 5},
+			{Type: tg.EntityTypeItalic, Offset: 14, Length: 3},
+			{Type: tg.EntityTypePre, Offset: 30, Length: 16, Language: "go"},
+			{Type: tg.EntityTypeBlockquote, Offset: 47, Length: 25},
+			{Type: tg.EntityTypeBold, Offset: 60, Length: 5},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected render result:\nexpected: %+v\nactual:   %+v", expected, got)
+	}
+}
+
+func TestTgEntitiesRenderer_KeepsBrokenMarkupAsText(t *testing.T) {
+	r := NewTgEntitiesRenderer()
+	cases := []string{
+		"unclosed *bold",
+		"snake_case_name and 2 * 3 * 4",
+		"[not a link] (really)",
+		"`unclosed code",
+		"escaped \\*stars\\*",
+		"[relative](/docs/page) and [script](javascript:alert(1))",
+	}
+	expected := []string{
+		"unclosed *bold",
+		"snake_case_name and 2 * 3 * 4",
+		"[not a link] (really)",
+		"`unclosed code",
+		"escaped *stars*",
+		"relative and script",
+	}
+	for i, input := range cases {
+		got := r.Render(input)
+		if got.Text != expected[i] || len(got.Entities) != 0 {
+			t.Fatalf("unexpected render result for %q: %+v", input, got)
+		}
+	}
+}
+
+func TestRendered_Split(t *testing.T) {
+	r := NewTgEntitiesRenderer()
+	paragraph := "**" + strings.Repeat("word ", 10) + "end**"
+	rendered := r.Render(paragraph + "\n\n" + paragraph + "\n\n" + paragraph)
+
+	parts := rendered.Split(110)
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d: %+v", len(parts), parts)
+	}
+	for i, part := range parts {
+		if l := utf16Len(part.Text); l > 110 {
+			t.Fatalf("part %d length %d exceeds limit", i, l)
+		}
+		for _, e := range part.Entities {
+			if e.Offset < 0 || e.Offset+e.Length > utf16Len(part.Text) {
+				t.Fatalf("part %d has entity out of bounds: %+v", i, e)
+			}
+		}
+	}
+	if parts[1].Text != strings.Repeat("word ", 10)+"end" || len(parts[1].Entities) != 1 {
+		t.Fatalf("unexpected second part: %+v", parts[1])
+	}
+
+	long := r.Render("`" + strings.Repeat("x", 30) + "`")
+	parts = long.Split(10)
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d: %+v", len(parts), parts)
+	}
+	for i, part := range parts {
+		if len(part.Entities) != 1 || part.Entities[0].Type != tg.EntityTypeCode || part.Entities[0].Length != 10 {
+			t.Fatalf("entity is not clipped properly in part %d: %+v", i, part)
+		}
+	}
+}
+
+func TestRendered_CropAndAppend(t *testing.T) {
+	r := NewTgEntitiesRenderer()
+	cropped, changed := r.Render("**" + strings.Repeat("a", 20) + "**").Crop(10)
+	if !changed || cropped.Text != strings.Repeat("a", 9)+"…" || cropped.Entities[0].Length != 9 {
+		t.Fatalf("unexpected cropped text: %+v", cropped)
+	}
+
+	footer := Rendered{
+		Text:     "src",
+		Entities: []tg.MessageEntity{{Type: tg.EntityTypeTextLink, Length: 3, URL: "https://example.com"}},
+	}
+	joined := cropped.Append(Rendered{Text: "\n\n"}).Append(footer)
+	if joined.Text != cropped.Text+"\n\nsrc" || len(joined.Entities) != 2 || joined.Entities[1].Offset != 12 {
+		t.Fatalf("unexpected joined text: %+v", joined)
+	}
+}
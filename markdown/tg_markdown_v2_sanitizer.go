@@ -10,6 +10,7 @@ import "strings"
 type Sanitizer interface {
 	Sanitize(text string) string
 	EscapeURL(url string) string
+	EscapeText(text string) string
 }
 
 // NewTgMarkdownV2Sanitizer returns a Sanitizer for Telegram Markdown V2.
@@ -351,6 +352,18 @@ func (s tgMarkdownV2Sanitizer) Sanitize(text string) string {
 	return b.String()
 }
 
+// EscapeText escapes every Telegram Markdown V2 special character, so the text is shown as is.
+func (s tgMarkdownV2Sanitizer) EscapeText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune("_*[]()~`>#+-=|{}.!\\", r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 // EscapeURL escapes URL characters required by Telegram Markdown V2 inside link URLs.
 func (s tgMarkdownV2Sanitizer) EscapeURL(url string) string {
 	var b strings.Builder
@@ -0,0 +1,361 @@
+package markdown
+
+import (
+	"sort"
+	"strings"
+)
+
+// Split point ranks from the least to the most preferable
+const (
+	splitRankAny = iota
+	splitRankSpace
+	splitRankLine
+	splitRankParagraph
+)
+
+// splitState describes entities which are open at some position of the text
+type splitState struct {
+	// stack contains opening markers of entities from the outermost to the innermost.
+	// Fenced code blocks are stored as "```" followed by the language.
+	stack []string
+	// quote is true when the current line is a block quotation line
+	quote bool
+	// expandable is true inside an expandable block quotation
+	expandable bool
+}
+
+func (s splitState) top() string {
+	if len(s.stack) == 0 {
+		return ""
+	}
+
+	return s.stack[len(s.stack)-1]
+}
+
+func (s splitState) inPre() bool {
+	return strings.HasPrefix(s.top(), "```")
+}
+
+func (s splitState) inCode() bool {
+	return s.top() == "`"
+}
+
+// toggle closes the entity if it's open or opens it otherwise. The stack is never modified in place, so the states
+// saved earlier stay intact.
+func (s splitState) toggle(marker string) splitState {
+	for i := len(s.stack) - 1; i >= 0; i-- {
+		if s.stack[i] == marker {
+			stack := make([]string, 0, len(s.stack)-1)
+			stack = append(stack, s.stack[:i]...)
+			s.stack = append(stack, s.stack[i+1:]...)
+
+			return s
+		}
+	}
+
+	return s.push(marker)
+}
+
+func (s splitState) push(marker string) splitState {
+	stack := make([]string, 0, len(s.stack)+1)
+	stack = append(stack, s.stack...)
+	s.stack = append(stack, marker)
+
+	return s
+}
+
+func (s splitState) pop() splitState {
+	s.stack = s.stack[: len(s.stack)-1 : len(s.stack)-1]
+
+	return s
+}
+
+// closing returns the markup closing all open entities
+func (s splitState) closing() string {
+	var b strings.Builder
+	for i := len(s.stack) - 1; i >= 0; i-- {
+		if strings.HasPrefix(s.stack[i], "```") {
+			b.WriteString("\n```")
+		} else {
+			b.WriteString(s.stack[i])
+		}
+	}
+	if s.expandable {
+		b.WriteString("||")
+	}
+
+	return b.String()
+}
+
+// opening returns the markup re-opening all open entities. lineStart should be true when the continuation starts at
+// the beginning of a line which has its own block quotation marker.
+func (s splitState) opening(lineStart bool) string {
+	var b strings.Builder
+	if s.expandable {
+		b.WriteString("**")
+		if !lineStart {
+			b.WriteString(">")
+		}
+	} else if s.quote && !lineStart {
+		b.WriteString(">")
+	}
+	for _, marker := range s.stack {
+		b.WriteString(marker)
+		if strings.HasPrefix(marker, "```") {
+			b.WriteString("\n")
+		}
+	}
+
+	return b.String()
+}
+
+type splitPoint struct {
+	pos   int
+	rank  int
+	state splitState
+}
+
+// SplitMarkdownV2 splits Telegram Markdown V2 text into parts which are no longer than limit characters each.
+// Paragraph boundaries are preferred over line breaks and line breaks over spaces. Formatting entities and fenced
+// code blocks which are open at the split point are closed at the end of the part and re-opened at the beginning of
+// the next one. Links are never split. The text is expected to be already sanitized.
+func SplitMarkdownV2(text string, limit int) []string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return []string{text}
+	}
+
+	points := scanSplitPoints(runes)
+
+	var parts []string
+	start := 0
+	prefix := ""
+	for {
+		if len([]rune(prefix))+len(runes)-start <= limit {
+			parts = append(parts, prefix+string(runes[start:]))
+
+			return parts
+		}
+
+		point, ok := chooseSplitPoint(points, start, len([]rune(prefix)), limit)
+		if !ok {
+			// Nothing suitable, e.g. a link which is longer than the limit. Just cut it.
+			point = forcedSplitPoint(runes, points, start, limit-len([]rune(prefix)))
+		}
+
+		parts = append(parts, prefix+string(runes[start:point.pos])+point.state.closing())
+
+		prefix = point.state.opening(point.rank >= splitRankLine)
+		start = point.pos
+		switch point.rank {
+		case splitRankParagraph:
+			start += 2
+		case splitRankLine, splitRankSpace:
+			start++
+		}
+	}
+}
+
+// forcedSplitPoint cuts the part starting at start, so it fits into available characters with the closing markup. The
+// entities open at the cut are taken from the closest split point before it, and the cut is moved before a trailing
+// backslash to keep the escape sequence whole.
+func forcedSplitPoint(runes []rune, points []splitPoint, start int, available int) splitPoint {
+	stateAt := func(pos int) splitState {
+		i := sort.Search(len(points), func(i int) bool { return points[i].pos > pos })
+		if i == 0 {
+			return splitState{}
+		}
+
+		return points[i-1].state
+	}
+
+	pos := start + available
+	pos -= len([]rune(stateAt(pos).closing()))
+
+	backslashes := 0
+	for i := pos - 1; i >= start && runes[i] == '\\'; i-- {
+		backslashes++
+	}
+	if backslashes%2 == 1 {
+		pos--
+	}
+	pos = max(pos, start+1)
+
+	return splitPoint{pos: pos, rank: splitRankAny, state: stateAt(pos)}
+}
+
+// chooseSplitPoint finds the most preferable split point for the part starting at start. A point is considered only
+// if the part still fits the limit with the prefix and the closing markup. Points which would make the part shorter
+// than a half of the limit are used only when nothing else fits.
+func chooseSplitPoint(points []splitPoint, start int, prefixLen int, limit int) (splitPoint, bool) {
+	minLen := (limit - prefixLen) / 2
+
+	for minRank := splitRankParagraph; minRank >= splitRankAny; minRank-- {
+		for i := len(points) - 1; i >= 0; i-- {
+			p := points[i]
+			if p.pos <= start {
+				break
+			}
+			if p.rank < minRank {
+				continue
+			}
+			if prefixLen+p.pos-start+len([]rune(p.state.closing())) > limit {
+				continue
+			}
+			if minRank > splitRankAny && p.pos-start < minLen {
+				break
+			}
+
+			return p, true
+		}
+	}
+
+	return splitPoint{}, false
+}
+
+// scanSplitPoints walks through the text tracking open entities and returns every position where the text may be
+// split. Positions inside escape sequences, links and entity markers are skipped.
+func scanSplitPoints(runes []rune) []splitPoint {
+	points := make([]splitPoint, 0, len(runes))
+
+	var st splitState
+	lineStart := true
+	n := len(runes)
+	hasPrefix := func(i int, prefix string) bool {
+		return strings.HasPrefix(string(runes[i:min(n, i+len(prefix))]), prefix)
+	}
+
+	i := 0
+	for i < n {
+		r := runes[i]
+
+		if i > 0 {
+			rank := splitRankAny
+			switch {
+			case r == '\n' && i+1 < n && runes[i+1] == '\n' && len(st.stack) == 0:
+				rank = splitRankParagraph
+			case r == '\n' && !st.inCode():
+				rank = splitRankLine
+			case r == ' ':
+				rank = splitRankSpace
+			}
+			points = append(points, splitPoint{pos: i, rank: rank, state: st})
+		}
+
+		if r == '\n' {
+			lineStart = true
+			i++
+			continue
+		}
+
+		if st.inPre() {
+			switch {
+			case r == '\\':
+				i += 2
+			case hasPrefix(i, "```"):
+				st = st.pop()
+				i += 3
+			default:
+				i++
+			}
+			continue
+		}
+
+		if st.inCode() {
+			switch r {
+			case '\\':
+				i += 2
+			case '`':
+				st = st.pop()
+				i++
+			default:
+				i++
+			}
+			continue
+		}
+
+		if lineStart {
+			lineStart = false
+			switch {
+			case hasPrefix(i, "**>"):
+				st.quote = true
+				st.expandable = true
+				i += 3
+				continue
+			case r == '>':
+				st.quote = true
+				i++
+				continue
+			default:
+				st.quote = false
+				st.expandable = false
+			}
+		}
+
+		switch {
+		case r == '\\':
+			i += 2
+		case hasPrefix(i, "```"):
+			j := i + 3
+			for j < n && runes[j] != '\n' && runes[j] != ' ' && runes[j] != '`' {
+				j++
+			}
+			if j < n && runes[j] == '\n' {
+				st = st.push("```" + string(runes[i+3:j]))
+				i = j + 1
+			} else {
+				st = st.push("```")
+				i += 3
+			}
+		case r == '`':
+			st = st.push("`")
+			i++
+		case hasPrefix(i, "||"):
+			if st.expandable && (i+2 == n || runes[i+2] == '\n') {
+				st.expandable = false
+			} else {
+				st = st.toggle("||")
+			}
+			i += 2
+		case hasPrefix(i, "__"):
+			st = st.toggle("__")
+			i += 2
+		case r == '_' || r == '*' || r == '~':
+			st = st.toggle(string(r))
+			i++
+		case r == '[' || hasPrefix(i, "!["):
+			i = skipLink(runes, i)
+		default:
+			i++
+		}
+	}
+
+	return points
+}
+
+// skipLink returns the position right after the link starting at i or the next position if it's not a link
+func skipLink(runes []rune, i int) int {
+	j := i + 1
+	if runes[i] == '!' {
+		j++
+	}
+	for j < len(runes) && runes[j] != ']' {
+		if runes[j] == '\\' {
+			j++
+		}
+		j++
+	}
+	if j+1 >= len(runes) || runes[j+1] != '(' {
+		return i + 1
+	}
+	for j += 2; j < len(runes) && runes[j] != ')'; j++ {
+		if runes[j] == '\\' {
+			j++
+		}
+	}
+	if j >= len(runes) {
+		return i + 1
+	}
+
+	return j + 1
+}
@@ -0,0 +1,137 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func assertPartsFit(t *testing.T, parts []string, limit int) {
+	t.Helper()
+
+	s := NewTgMarkdownV2Sanitizer()
+	for i, part := range parts {
+		if l := len([]rune(part)); l > limit {
+			t.Fatalf("part %d length %d exceeds limit %d: %q", i, l, limit, part)
+		}
+		if sanitized := s.Sanitize(part); sanitized != part {
+			t.Fatalf("part %d is not valid markdown:\npart:      %q\nsanitized: %q", i, part, sanitized)
+		}
+	}
+}
+
+func TestSplitMarkdownV2_ShortText(t *testing.T) {
+	parts := SplitMarkdownV2("short text", 100)
+	if len(parts) != 1 || parts[0] != "short text" {
+		t.Fatalf("unexpected parts: %q", parts)
+	}
+}
+
+func TestSplitMarkdownV2_Paragraphs(t *testing.T) {
+	paragraph := strings.Repeat("word ", 10) + "end\\."
+	text := strings.Join([]string{paragraph, paragraph, paragraph, paragraph}, "\n\n")
+	parts := SplitMarkdownV2(text, 120)
+	assertPartsFit(t, parts, 120)
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d: %q", len(parts), parts)
+	}
+	if parts[0] != paragraph+"\n\n"+paragraph || parts[1] != paragraph+"\n\n"+paragraph {
+		t.Fatalf("text is not split on the paragraph boundary: %q", parts)
+	}
+}
+
+func TestSplitMarkdownV2_FencedCode(t *testing.T) {
+	text := "Code:\n```go\n" + strings.Repeat("fmt.Println(\"line\")\n", 10) + "```\nDone\\."
+	parts := SplitMarkdownV2(text, 100)
+	assertPartsFit(t, parts, 100)
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %q", parts)
+	}
+	for i, part := range parts[1:] {
+		if !strings.HasPrefix(part, "```go\n") && !strings.HasPrefix(part, "Done") {
+			t.Fatalf("code block is not re-opened in part %d: %q", i+1, part)
+		}
+	}
+	joined := strings.Join(parts, "")
+	if strings.Count(joined, "fmt.Println") != 10 {
+		t.Fatalf("code lines are lost: %q", parts)
+	}
+}
+
+func TestSplitMarkdownV2_Formatting(t *testing.T) {
+	text := "*bold _italic " + strings.Repeat("word ", 30) + "end_ bold*"
+	parts := SplitMarkdownV2(text, 80)
+	assertPartsFit(t, parts, 80)
+	if !strings.HasSuffix(parts[0], "_*") {
+		t.Fatalf("formatting is not closed in the first part: %q", parts[0])
+	}
+	if !strings.HasPrefix(parts[1], "*_") {
+		t.Fatalf("formatting is not re-opened in the second part: %q", parts[1])
+	}
+}
+
+func TestSplitMarkdownV2_KeepsLinks(t *testing.T) {
+	link := "[some link](https://example.com/" + strings.Repeat("a", 40) + ")"
+	text := strings.Repeat("x", 50) + link + strings.Repeat("y", 50)
+	parts := SplitMarkdownV2(text, 100)
+	assertPartsFit(t, parts, 100)
+	found := false
+	for _, part := range parts {
+		if strings.Contains(part, link) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("link is split: %q", parts)
+	}
+}
+
+func TestSplitMarkdownV2_BlockQuote(t *testing.T) {
+	text := ">" + strings.Repeat("quoted ", 20)
+	parts := SplitMarkdownV2(text, 60)
+	assertPartsFit(t, parts, 60)
+	for i, part := range parts {
+		if !strings.HasPrefix(part, ">") {
+			t.Fatalf("part %d is not a quote: %q", i, part)
+		}
+	}
+}
+
+func TestSplitMarkdownV2_LongSanitizedText(t *testing.T) {
+	s := NewTgMarkdownV2Sanitizer()
+	var sb strings.Builder
+	for i := 0; i < 200; i++ {
+		sb.WriteString("Paragraph with *bold*, _italic_, `code` and [link](https://example.com/page). ")
+		if i%5 == 0 {
+			sb.WriteString("\n```python\nprint('hello')\nprint('world')\n```\n")
+		}
+		if i%7 == 0 {
+			sb.WriteString("\n\n")
+		}
+	}
+	parts := SplitMarkdownV2(s.Sanitize(sb.String()), 4000)
+	assertPartsFit(t, parts, 4000)
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %d", len(parts))
+	}
+}
+
+func TestSplitMarkdownV2_ForcedCut(t *testing.T) {
+	// The link is longer than the limit, so there is no split point to choose
+	text := "*[" + strings.Repeat("ab\\.", 30) + "](https://example.com)*"
+	parts := SplitMarkdownV2(text, 40)
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %q", parts)
+	}
+	for i, part := range parts {
+		if l := len([]rune(part)); l > 40 {
+			t.Fatalf("part %d length %d exceeds the limit: %q", i, l, part)
+		}
+		body := strings.TrimSuffix(part, "*")
+		if trailing := len(body) - len(strings.TrimRight(body, "\\")); trailing%2 == 1 {
+			t.Fatalf("escape sequence is split in part %d: %q", i, part)
+		}
+		if !strings.HasPrefix(part, "*") || !strings.HasSuffix(part, "*") {
+			t.Fatalf("bold is not closed and re-opened in part %d: %q", i, part)
+		}
+	}
+}
@@ -25,8 +25,35 @@ type Stats struct {
 	CompletionTokens uint64
 	TotalTokens      uint64
 	TotalCost        float64
+	UsageByTask      map[string]TaskUsage
 
 	LlmTimeouts uint64
+
+	LlmBackends   map[string]LlmBackendStatus
+	LlmRetries    uint64
+	ModelRequests map[string]uint64
+	ToolCalls     map[string]ToolCalls
+
+	ReplyPlainTextFallbacks uint64
+	ReplyDocumentFallbacks  uint64
+
+	QueuedRequests uint64
+}
+
+type TaskUsage struct {
+	Requests    uint64  `json:"requests"`
+	TotalTokens uint64  `json:"total_tokens"`
+	Cost        float64 `json:"cost"`
+}
+
+type ToolCalls struct {
+	Calls    uint64 `json:"calls"`
+	Failures uint64 `json:"failures"`
+}
+
+type LlmBackendStatus struct {
+	BreakerState        string `json:"breaker_state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
 }
 
 func NewStats() *Stats {
@@ -45,12 +72,26 @@ func NewStats() *Stats {
 		CompletionTokens: 0,
 		TotalTokens:      0,
 		TotalCost:        0,
+		UsageByTask:      map[string]TaskUsage{},
 
 		LlmTimeouts: 0,
+
+		LlmBackends:   map[string]LlmBackendStatus{},
+		LlmRetries:    0,
+		ModelRequests: map[string]uint64{},
+		ToolCalls:     map[string]ToolCalls{},
+
+		ReplyPlainTextFallbacks: 0,
+		ReplyDocumentFallbacks:  0,
+
+		QueuedRequests: 0,
 	}
 }
 
 func (s *Stats) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	return json.Marshal(struct {
 		Uptime string `json:"uptime"`
 
@@ -62,12 +103,23 @@ func (s *Stats) MarshalJSON() ([]byte, error) {
 		SummarizeRequests uint64 `json:"summarize_requests"`
 		ChatHistoryResets uint64 `json:"chat_history_resets"`
 
-		PromptTokens     uint64  `json:"prompt_tokens"`
-		CompletionTokens uint64  `json:"completion_tokens"`
-		TotalTokens      uint64  `json:"total_tokens"`
-		TotalCost        float64 `json:"total_cost"`
+		PromptTokens     uint64               `json:"prompt_tokens"`
+		CompletionTokens uint64               `json:"completion_tokens"`
+		TotalTokens      uint64               `json:"total_tokens"`
+		TotalCost        float64              `json:"total_cost"`
+		UsageByTask      map[string]TaskUsage `json:"usage_by_task"`
 
 		LlmTimeouts uint64 `json:"llm_timeouts"`
+
+		LlmBackends   map[string]LlmBackendStatus `json:"llm_backends"`
+		LlmRetries    uint64                      `json:"llm_retries"`
+		ModelRequests map[string]uint64           `json:"model_requests"`
+		ToolCalls     map[string]ToolCalls        `json:"tool_calls"`
+
+		ReplyPlainTextFallbacks uint64 `json:"reply_plain_text_fallbacks"`
+		ReplyDocumentFallbacks  uint64 `json:"reply_document_fallbacks"`
+
+		QueuedRequests uint64 `json:"queued_requests"`
 	}{
 		Uptime: time.Now().Sub(s.RunningSince).String(),
 
@@ -83,8 +135,19 @@ func (s *Stats) MarshalJSON() ([]byte, error) {
 		CompletionTokens: s.CompletionTokens,
 		TotalTokens:      s.TotalTokens,
 		TotalCost:        s.TotalCost,
+		UsageByTask:      s.UsageByTask,
 
 		LlmTimeouts: s.LlmTimeouts,
+
+		LlmBackends:   s.LlmBackends,
+		LlmRetries:    s.LlmRetries,
+		ModelRequests: s.ModelRequests,
+		ToolCalls:     s.ToolCalls,
+
+		ReplyPlainTextFallbacks: s.ReplyPlainTextFallbacks,
+		ReplyDocumentFallbacks:  s.ReplyDocumentFallbacks,
+
+		QueuedRequests: s.QueuedRequests,
 	})
 }
 
@@ -135,13 +198,19 @@ func (s *Stats) ChatHistoryReset() {
 	s.ChatHistoryResets++
 }
 
-func (s *Stats) AddUsage(prompt, completion, total int, cost float64) {
+func (s *Stats) AddUsage(task string, prompt, completion, total int, cost float64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.PromptTokens += uint64(prompt)
 	s.CompletionTokens += uint64(completion)
 	s.TotalTokens += uint64(total)
 	s.TotalCost += cost
+
+	taskUsage := s.UsageByTask[task]
+	taskUsage.Requests++
+	taskUsage.TotalTokens += uint64(total)
+	taskUsage.Cost += cost
+	s.UsageByTask[task] = taskUsage
 }
 
 func (s *Stats) LlmTimeout() {
@@ -149,3 +218,56 @@ func (s *Stats) LlmTimeout() {
 	defer s.mu.Unlock()
 	s.LlmTimeouts++
 }
+
+// SetLlmBackendStatus updates the LLM back-end endpoint health which is tracked by the LLM connector
+func (s *Stats) SetLlmBackendStatus(endpoint string, breakerState string, consecutiveFailures int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LlmBackends[endpoint] = LlmBackendStatus{
+		BreakerState:        breakerState,
+		ConsecutiveFailures: consecutiveFailures,
+	}
+}
+
+func (s *Stats) SetLlmRetries(retries uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LlmRetries = retries
+}
+
+// ModelRequest counts LLM requests by the model which actually replied
+func (s *Stats) ModelRequest(model string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ModelRequests[model]++
+}
+
+func (s *Stats) ToolCall(tool string, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	calls := s.ToolCalls[tool]
+	calls.Calls++
+	if failed {
+		calls.Failures++
+	}
+	s.ToolCalls[tool] = calls
+}
+
+func (s *Stats) ReplyPlainTextFallback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ReplyPlainTextFallbacks++
+}
+
+func (s *Stats) ReplyDocumentFallback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ReplyDocumentFallbacks++
+}
+
+func (s *Stats) RequestQueued() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.QueuedRequests++
+}